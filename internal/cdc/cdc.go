@@ -0,0 +1,90 @@
+package cdc
+
+import (
+	"math/bits"
+)
+
+// content defined chunking, FastCDC style
+// a gear rolling hash over the last 64 bytes decides where chunks end,
+// so an insertion only changes the chunks around it and boundaries
+// after it are found again at the shifted position.
+// chunks below the average size are cut with a harder mask than the
+// ones above it, which keeps sizes close to the average.
+// https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+
+type Chunker struct {
+	Min int
+	Avg int
+	Max int
+
+	maskS uint64
+	maskL uint64
+}
+
+var gear [256]uint64
+
+// fixed pseudo random table, both peers must use the same one
+func init() {
+	seed := uint64(0x6763735f63646321)
+	for i := range gear {
+		// splitmix64
+		seed = seed + 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker with sizes from avg/4 to avg*8
+func NewChunker(avg int) Chunker {
+	if avg < 64 {
+		avg = 64
+	}
+	c := Chunker{Min: avg / 4, Avg: avg, Max: avg * 8}
+	// high bits of the hash depend on the most bytes
+	n := bits.Len(uint(avg)) - 1
+	c.maskS = ^uint64(0) << (64 - n - 1)
+	c.maskL = ^uint64(0) << (64 - n + 1)
+	return c
+}
+
+// length of the chunk data starts with
+func (c Chunker) Next(data []byte) int {
+	n := len(data)
+	if n <= c.Min {
+		return n
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	normal := c.Avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// end offset of every chunk of data, the last one is len(data)
+func (c Chunker) Split(data []byte) (ends []int) {
+	for pos := 0; pos < len(data); {
+		pos = pos + c.Next(data[pos:])
+		ends = append(ends, pos)
+	}
+	return ends
+}
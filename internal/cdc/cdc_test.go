@@ -0,0 +1,57 @@
+package cdc
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func chunks(c Chunker, data []byte) map[string]bool {
+	result := make(map[string]bool)
+	start := 0
+	for _, end := range c.Split(data) {
+		result[string(data[start:end])] = true
+		start = end
+	}
+	return result
+}
+
+func TestSplit(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	c := NewChunker(4096)
+
+	ends := c.Split(data)
+	if ends[len(ends)-1] != len(data) {
+		t.Fatalf("chunks end at %d, want %d", ends[len(ends)-1], len(data))
+	}
+	start := 0
+	for i, end := range ends {
+		if size := end - start; size > c.Max || size < c.Min && i != len(ends)-1 {
+			t.Fatalf("chunk %d has %d bytes, want %d to %d", i, size, c.Min, c.Max)
+		}
+		start = end
+	}
+	if avg := len(data) / len(ends); avg < c.Avg/2 || avg > c.Avg*2 {
+		t.Fatalf("average chunk size %d, want about %d", avg, c.Avg)
+	}
+}
+
+// an insertion only changes the chunks around it
+func TestSplitShift(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	c := NewChunker(4096)
+
+	shifted := append(append(append([]byte{}, data[:1000]...), []byte("inserted")...), data[1000:]...)
+	before := chunks(c, data)
+	after := chunks(c, shifted)
+	changed := 0
+	for chunk := range after {
+		if !before[chunk] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d of %d chunks changed by one insertion", changed, len(after))
+	}
+}
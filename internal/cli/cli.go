@@ -0,0 +1,328 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gcloudsync/internal/config"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exit status of Main
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitUsage   = 2
+)
+
+// flags a command accepts
+const (
+	flagConfig = 1 << iota
+	flagRoot
+	flagServer
+	flagPort
+	flagListen
+	flagOnce
+	flagDryRun
+	flagJSON
+)
+
+// config file a command reads
+const (
+	noConfig = iota
+	clientConfig
+	serverConfig
+	// either of them, trash is kept on server and client alike
+	anyConfig
+)
+
+type command struct {
+	name string
+	// arguments following the flags
+	args    string
+	summary string
+	flags   int
+	config  int
+	// runs until stopped and always logs
+	daemon bool
+	// number of arguments allowed, max -1 for any
+	minArgs int
+	maxArgs int
+	run     func(o *options, args []string) error
+}
+
+// values of flags shared by commands
+type options struct {
+	config  string
+	root    string
+	server  string
+	port    string
+	listen  string
+	once    bool
+	dryRun  bool
+	json    bool
+	verbose bool
+	stdout  io.Writer
+	// a client config has been read for a command taking either
+	client bool
+}
+
+var commands = []command{
+	{name: "serve", summary: "run the server",
+		flags: flagConfig | flagRoot | flagListen | flagPort, config: serverConfig, daemon: true, run: runServe},
+	{name: "sync", summary: "keep the local folder in sync with the server",
+		flags: flagConfig | flagRoot | flagServer | flagPort | flagOnce | flagDryRun | flagJSON, config: clientConfig,
+		daemon: true, run: runSync},
+	{name: "status", summary: "show what a sync would change",
+		flags: flagConfig | flagRoot | flagServer | flagPort | flagJSON, config: clientConfig, run: runStatus},
+	{name: "pull", summary: "download changes from the server once",
+		flags: flagConfig | flagRoot | flagServer | flagPort | flagDryRun | flagJSON, config: clientConfig, run: runPull},
+	{name: "push", summary: "upload local changes to the server once",
+		flags: flagConfig | flagRoot | flagServer | flagPort | flagDryRun | flagJSON, config: clientConfig, run: runPush},
+	{name: "ls-remote", summary: "list files and folders on the server",
+		flags: flagConfig | flagRoot | flagServer | flagPort, config: clientConfig, run: runLsRemote},
+	{name: "restore", args: "[id]", summary: "list trashed items, or restore the one with id",
+		flags: flagConfig | flagRoot, config: anyConfig, maxArgs: 1, run: runRestore},
+	{name: "trash", args: "list | restore <id> | purge", summary: "manage trashed items",
+		flags: flagConfig | flagRoot, config: anyConfig, minArgs: 1, maxArgs: 2, run: runTrash},
+	{name: "gc", summary: "remove unused chunks of a deduplicated store",
+		flags: flagConfig | flagRoot, config: serverConfig, run: runGC},
+	{name: "keygen", summary: "print a new master key for server encryption",
+		run: runKeygen},
+	{name: "rotate-key", args: "<new key file>", summary: "re-encrypt the store with a new master key",
+		flags: flagConfig | flagRoot, config: serverConfig, minArgs: 1, maxArgs: 1, run: runRotateKey},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func isHelp(arg string) bool {
+	return arg == "help" || arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+// run the command line without the program name
+// @return: exit status
+func Main(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return ExitUsage
+	}
+	if isHelp(args[0]) {
+		if len(args) > 1 && findCommand(args[1]) != nil {
+			return Main([]string{args[1], "--help"}, stdout, stderr)
+		}
+		printUsage(stdout)
+		return ExitOK
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "gcloudsync: unknown command %q\n", args[0])
+		fmt.Fprintln(stderr, "Run 'gcloudsync --help' for usage.")
+		return ExitUsage
+	}
+
+	o := &options{stdout: stdout}
+	fs := cmd.flagSet(o)
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	err := fs.Parse(args[1:])
+	if err == flag.ErrHelp {
+		stdout.Write(out.Bytes())
+		return ExitOK
+	}
+	if err == nil {
+		err = cmd.check(o, fs.Args())
+		if err != nil {
+			fmt.Fprintln(&out, err)
+			fs.Usage()
+		}
+	}
+	if err != nil {
+		stderr.Write(out.Bytes())
+		return ExitUsage
+	}
+
+	if (cmd.daemon && !o.once && !o.dryRun) || o.verbose {
+		log.SetOutput(stderr)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+	err = cmd.loadConfig(o)
+	if err == nil {
+		err = cmd.run(o, fs.Args())
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gcloudsync %s: %v\n", cmd.name, err)
+		return ExitFailure
+	}
+	return ExitOK
+}
+
+func (cmd *command) flagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("gcloudsync "+cmd.name, flag.ContinueOnError)
+	if cmd.flags&flagConfig != 0 {
+		fs.StringVar(&o.config, "config", "", "config file (default ./config.json, then ../config.json)")
+	}
+	if cmd.flags&flagRoot != 0 {
+		fs.StringVar(&o.root, "root", "", "root path of the synced folder, instead of RootPath of config")
+	}
+	if cmd.flags&flagServer != 0 {
+		fs.StringVar(&o.server, "server", "", "host name or address of server, optionally with port, instead of ServerIP of config")
+	}
+	if cmd.flags&flagListen != 0 {
+		fs.StringVar(&o.listen, "listen", "", "host name or address to listen on, instead of ListenAddress of config (default all interfaces)")
+	}
+	if cmd.flags&flagPort != 0 {
+		fs.StringVar(&o.port, "port", "", "port of server, instead of Port of config (default "+config.Port+")")
+	}
+	if cmd.flags&flagOnce != 0 {
+		fs.BoolVar(&o.once, "once", false, "sync once, print a summary and exit instead of watching")
+	}
+	if cmd.flags&flagDryRun != 0 {
+		fs.BoolVar(&o.dryRun, "dry-run", false, "print what would be changed on either side without changing anything")
+	}
+	if cmd.flags&flagJSON != 0 {
+		fs.BoolVar(&o.json, "json", false, "print the result as JSON")
+	}
+	if !cmd.daemon || cmd.flags&flagOnce != 0 {
+		fs.BoolVar(&o.verbose, "verbose", false, "print log messages")
+	}
+	fs.Usage = func() {
+		usage := "usage: gcloudsync " + cmd.name + " [flags]"
+		if cmd.args != "" {
+			usage = usage + " " + cmd.args
+		}
+		fmt.Fprintln(fs.Output(), usage)
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), strings.ToUpper(cmd.summary[:1])+cmd.summary[1:]+".")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "flags:")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// validate flags and arguments before anything is done
+func (cmd *command) check(o *options, args []string) error {
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return errors.New("wrong number of arguments")
+	}
+	if cmd.daemon && o.json && !o.once && !o.dryRun {
+		return errors.New("--json needs --once or --dry-run")
+	}
+	if o.once && o.dryRun {
+		return errors.New("--once and --dry-run can not be used together")
+	}
+	if o.port != "" {
+		if n, err := strconv.Atoi(o.port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", o.port)
+		}
+	}
+	return nil
+}
+
+// read config file and apply flags over it
+func (cmd *command) loadConfig(o *options) error {
+	if cmd.config == noConfig {
+		return nil
+	}
+	path := o.config
+	if path == "" {
+		for _, p := range []string{"./config.json", "../config.json"} {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+	}
+	if path == "" && o.root == "" {
+		return errors.New("no config.json found, use --config or --root")
+	}
+
+	root := ""
+	if o.root != "" {
+		root = filepath.ToSlash(filepath.Clean(o.root))
+	}
+	port, _ := strconv.Atoi(o.port)
+	kind := cmd.config
+	if kind == anyConfig {
+		kind = serverConfig
+		if path != "" && config.IsClientConfig(path) {
+			kind = clientConfig
+		}
+	}
+	o.client = kind == clientConfig
+	// flags are applied before values are checked, so that they can
+	// stand in for missing or invalid ones
+	var err error
+	if kind == serverConfig {
+		s := config.DefaultServerRoot()
+		if path != "" {
+			if s, err = config.DecodeServerRoot(path); err != nil {
+				return fmt.Errorf("read config %s: %v", path, err)
+			}
+		}
+		if root != "" {
+			s.RootPath = root
+		}
+		if o.listen != "" {
+			s.ListenAddress = o.listen
+		}
+		if port != 0 {
+			s.Port = port
+		}
+		err = config.ApplyServerRoot(s)
+	} else {
+		next := config.DefaultConfig()
+		if path != "" {
+			if next, err = config.DecodeConfig(path); err != nil {
+				return fmt.Errorf("read config %s: %v", path, err)
+			}
+		}
+		// with pairs --root selects one of them, see syncPairs
+		if root != "" && len(next.Pairs) == 0 {
+			next.RootPath = root
+		}
+		if o.server != "" {
+			next.ServerIP = o.server
+		}
+		if port != 0 {
+			next.Port = port
+		}
+		err = config.GetConfig().Apply(next)
+	}
+	if err != nil && path != "" {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return err
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "gcloudsync keeps a folder in sync with a gcloudsync server.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "usage: gcloudsync <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		if cmd.name == "trash" {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "server maintenance:")
+		}
+		fmt.Fprintf(w, "  %-11s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'gcloudsync <command> --help' for the flags of a command.")
+	fmt.Fprintln(w, "Exit status is 0 on success, 1 if the command failed and 2 on wrong usage.")
+}
@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"bytes"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/trash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func run(args ...string) (code int, stdout string, stderr string) {
+	var out, errOut bytes.Buffer
+	code = Main(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestUsage(t *testing.T) {
+	code, out, _ := run("--help")
+	if code != ExitOK {
+		t.Fatalf("--help exited with %d", code)
+	}
+	for _, cmd := range commands {
+		if !strings.Contains(out, cmd.name) {
+			t.Errorf("%s missing in usage", cmd.name)
+		}
+	}
+	if code, out, _ := run("pull", "--help"); code != ExitOK || !strings.Contains(out, "-server") {
+		t.Fatalf("pull --help exited with %d: %s", code, out)
+	}
+	if code, out, _ := run("help", "serve"); code != ExitOK || strings.Contains(out, "-server") {
+		t.Fatalf("help serve exited with %d: %s", code, out)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"pull", "--bogus"},
+		{"pull", "--port", "70000"},
+		{"pull", "extra"},
+		{"rotate-key"},
+		{"sync", "--json"},
+		{"sync", "--once", "--dry-run"},
+		{"status", "--dry-run"},
+	} {
+		if code, _, errOut := run(args...); code != ExitUsage || errOut == "" {
+			t.Errorf("%v exited with %d: %s", args, code, errOut)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	root := t.TempDir()
+	code, _, errOut := run("pull", "--root", root+"/missing")
+	if code != ExitFailure || !strings.Contains(errOut, "RootPath: "+filepath.ToSlash(root)+"/missing does not exist") {
+		t.Fatalf("pull exited with %d: %s", code, errOut)
+	}
+	// nothing listens on the port
+	code, out, errOut := run("sync", "--once", "--root", root, "--port", "1")
+	if code != ExitFailure || !strings.Contains(out, "failed 0") {
+		t.Fatalf("sync --once exited with %d: %s %s", code, out, errOut)
+	}
+	code, _, errOut = run("status", "--config", root+"/missing.json")
+	if code != ExitFailure || !strings.Contains(errOut, "missing.json") {
+		t.Fatalf("status exited with %d: %s", code, errOut)
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	defer func(ip string, port string) {
+		config.ServerIP, config.Port = ip, port
+	}(config.ServerIP, config.Port)
+
+	dir := filepath.ToSlash(t.TempDir())
+	path := filepath.Join(dir, "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"ServerIP": "10.0.0.1", "Port": 8000, "RootPath": "`+dir+`"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findCommand("status")
+	o := &options{config: path}
+	if err := cmd.loadConfig(o); err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientRootPath != dir || config.ServerIP != "10.0.0.1" || config.Port != "8000" {
+		t.Fatalf("config read as %s %s %s", config.ClientRootPath, config.ServerIP, config.Port)
+	}
+
+	flagRoot := dir + "/flag"
+	if err := os.Mkdir(flagRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	o = &options{config: path, root: flagRoot + "/", server: "10.0.0.2", port: "9000"}
+	if err := cmd.loadConfig(o); err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientRootPath != flagRoot || config.ServerIP != "10.0.0.2" || config.Port != "9000" {
+		t.Fatalf("flags applied as %s %s %s", config.ClientRootPath, config.ServerIP, config.Port)
+	}
+	// kept when server sends its config
+	cg := config.GetConfig()
+	if err := cg.ConfigFromBytes(cg.ToBytes()); err != nil || config.ClientRootPath != flagRoot || config.Port != "9000" {
+		t.Fatalf("root and port after config sync %s %s, %v", config.ClientRootPath, config.Port, err)
+	}
+
+	if err := cmd.loadConfig(&options{}); err == nil {
+		t.Fatal("loaded without config file or root")
+	}
+}
+
+// flags stand in for keys missing in config file
+func TestFlagsBeforeValidation(t *testing.T) {
+	defer func(ip string, port string, root string) {
+		config.ServerIP, config.Port, config.ServerRootPath = ip, port, root
+	}(config.ServerIP, config.Port, config.ServerRootPath)
+
+	dir := filepath.ToSlash(t.TempDir())
+	client := filepath.Join(dir, "client.json")
+	server := filepath.Join(dir, "server.json")
+	if err := ioutil.WriteFile(client, []byte(`{"ServerIP": "10.0.0.1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(server, []byte(`{"RootPath": "`+dir+`/missing"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := findCommand("status").loadConfig(&options{config: client, root: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := findCommand("gc").loadConfig(&options{config: server, root: dir}); err != nil || config.ServerRootPath != dir {
+		t.Fatalf("server root %s, %v", config.ServerRootPath, err)
+	}
+	err := findCommand("serve").loadConfig(&options{config: server, root: dir, port: "70000"})
+	if err == nil || !strings.Contains(err.Error(), "Port") {
+		t.Fatalf("invalid port flag accepted, %v", err)
+	}
+}
+
+func TestSyncPairs(t *testing.T) {
+	defer func(ip string, port string) {
+		config.ServerIP, config.Port = ip, port
+	}(config.ServerIP, config.Port)
+	cg := config.GetConfig()
+	defer func(pairs []config.SyncPair) { cg.Pairs = pairs }(cg.Pairs)
+
+	dir := filepath.ToSlash(t.TempDir())
+	photos, work := dir+"/photos", dir+"/work"
+	for _, folder := range []string{photos, work} {
+		if err := os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "config.json")
+	err := ioutil.WriteFile(path, []byte(`{"ServerIP": "10.0.0.1", "Port": 8000, "Pairs": [
+		{"RootPath": "`+photos+`", "Remote": "photos", "Ignore": ["*.tmp"], "Direction": "backup"},
+		{"RootPath": "`+work+`/", "ServerIP": "10.0.0.2", "Port": 9000}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := findCommand("status")
+	o := &options{config: path}
+	if err := cmd.loadConfig(o); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := syncPairs(o)
+	if err != nil || len(pairs) != 2 {
+		t.Fatalf("pairs %+v, %v", pairs, err)
+	}
+	if p := pairs[0]; p.ServerIP != "10.0.0.1" || p.Port != 8000 || p.Direction != config.DirectionUpload {
+		t.Fatalf("first pair %+v", p)
+	}
+	if p := pairs[1]; p.ServerIP != "10.0.0.2" || p.Port != 9000 || p.Direction != config.DirectionBoth {
+		t.Fatalf("second pair %+v", p)
+	}
+
+	o = &options{config: path, root: work, port: "9100"}
+	if err := cmd.loadConfig(o); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, err := syncPairs(o); err != nil || len(pairs) != 1 || pairs[0].Port != 9100 || pairs[0].ServerIP != "10.0.0.2" {
+		t.Fatalf("pairs under --root %+v, %v", pairs, err)
+	}
+	o = &options{config: path, root: "/elsewhere"}
+	if err := cmd.loadConfig(o); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, err := syncPairs(o); err != nil || len(pairs) != 1 || pairs[0].RootPath != "/elsewhere" || pairs[0].Remote != "" {
+		t.Fatalf("pairs of other --root %+v, %v", pairs, err)
+	}
+
+	cg.Pairs = append(cg.Pairs, config.SyncPair{RootPath: "/elsewhere", Direction: "sideways"})
+	if _, err := syncPairs(&options{}); err == nil || !strings.Contains(err.Error(), "Pairs[2].Direction") {
+		t.Fatalf("invalid pairs accepted, %v", err)
+	}
+}
+
+// trash is managed with either config, with pairs in each of their folders
+func TestTrashConfigs(t *testing.T) {
+	defer func(ip string, port string, root string) {
+		config.ServerIP, config.Port, config.ServerRootPath = ip, port, root
+	}(config.ServerIP, config.Port, config.ServerRootPath)
+
+	dir := filepath.ToSlash(t.TempDir())
+	photos, work := dir+"/photos", dir+"/work"
+	for _, folder := range []string{photos, work} {
+		if err := os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := filepath.Join(dir, "client.json")
+	err := ioutil.WriteFile(client, []byte(`{"ServerIP": "10.0.0.1", "Pairs": [
+		{"RootPath": "`+photos+`", "Remote": "photos"}, {"RootPath": "`+work+`"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := filepath.Join(dir, "server.json")
+	if err := ioutil.WriteFile(server, []byte(`{"RootPath": "`+photos+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(work+"/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.MoveToTrash(fsops.OS, work, work+"/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := trash.List(fsops.OS, work)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("trash of work %v, %v", items, err)
+	}
+
+	if code, _, errOut := run("trash", "--config", client, "list"); code != ExitOK {
+		t.Fatalf("trash list exited with %d: %s", code, errOut)
+	}
+	if code, _, errOut := run("trash", "--config", server, "list"); code != ExitOK {
+		t.Fatalf("trash list of server exited with %d: %s", code, errOut)
+	}
+	if code, _, errOut := run("restore", "--config", client, "bogus"); code != ExitFailure || !strings.Contains(errOut, "no such item") {
+		t.Fatalf("restore of unknown item exited with %d: %s", code, errOut)
+	}
+	if code, _, errOut := run("restore", "--config", client, items[0].ID); code != ExitOK {
+		t.Fatalf("restore exited with %d: %s", code, errOut)
+	}
+	if _, err := os.Stat(work + "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,431 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/core"
+	"gcloudsync/internal/crypt"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/network"
+	"gcloudsync/internal/storage"
+	"gcloudsync/internal/trash"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+func runServe(o *options, args []string) error {
+	common.PrintLogo()
+	fsys, err := storage.Open(config.ServerStorage, config.ServerRootPath)
+	if err != nil {
+		return err
+	}
+	srv := network.NewServer(config.ListenAddress, config.Port)
+	if err := srv.Listen(); err != nil {
+		return err
+	}
+	defer storage.Close(fsys)
+
+	// stopped cleanly, the chunk store is not left locked
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan bool, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		stopped <- true
+		srv.Close()
+	}()
+	sc := core.NewServerCore(fsys, config.ServerRootPath, srv)
+	sc.ReadOnlyFolders = config.ServerReadOnlyFolders
+	sc.StartServer()
+	select {
+	case <-stopped:
+		return nil
+	default:
+		return errors.New("server stopped")
+	}
+}
+
+func runSync(o *options, args []string) error {
+	if o.dryRun {
+		return dryRun(o, nil)
+	}
+	if o.once {
+		return syncOnce(o, nil)
+	}
+	common.PrintLogo()
+	pairs, err := syncPairs(o)
+	if err != nil {
+		return err
+	}
+	var clients []*core.ClientCore
+	for _, pair := range pairs {
+		cc, _, err := newClient(pair)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, cc)
+	}
+
+	// each folder has its own connection and reconnects on its own
+	errs := make(chan error, len(clients))
+	for i, cc := range clients {
+		go func(pair config.SyncPair, cc *core.ClientCore) {
+			cc.StartClient()
+			if err := cc.Err(); err != nil {
+				errs <- fmt.Errorf("%s: %v", pair.RootPath, err)
+				return
+			}
+			errs <- nil
+		}(pairs[i], cc)
+	}
+	var first error
+	for range clients {
+		if err := <-errs; err != nil {
+			log.Println(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func runStatus(o *options, args []string) error {
+	return dryRun(o, nil)
+}
+
+func runPull(o *options, args []string) error {
+	dir := core.SyncDownload
+	if o.dryRun {
+		return dryRun(o, &dir)
+	}
+	return syncOnce(o, &dir)
+}
+
+func runPush(o *options, args []string) error {
+	dir := core.SyncUpload
+	if o.dryRun {
+		return dryRun(o, &dir)
+	}
+	return syncOnce(o, &dir)
+}
+
+// print what a sync would change, nothing is written on either side
+// @dir: direction of all folders, the one of each folder if nil
+func dryRun(o *options, dir *core.Direction) error {
+	var plans []jsonPlan
+	err := eachPair(o, func(pair config.SyncPair, cc *core.ClientCore, fsys fsops.FS) error {
+		actions, err := cc.Plan(direction(pair, dir))
+		if err != nil {
+			return err
+		}
+		if o.json {
+			plans = append(plans, newJSONPlan(pair, fsys, actions))
+			return nil
+		}
+		printActions(o.stdout, pair, fsys, "", actions)
+		if len(actions) == 0 {
+			fmt.Fprintln(o.stdout, "up to date")
+			return nil
+		}
+		printTotals(o.stdout, actions)
+		return nil
+	})
+	if len(plans) > 0 {
+		if err := printJSON(o.stdout, oneOrList(plans)); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// sync once and print what has been done
+// @dir: direction of all folders, the one of each folder if nil
+func syncOnce(o *options, dir *core.Direction) error {
+	var summaries []jsonSummary
+	err := eachPair(o, func(pair config.SyncPair, cc *core.ClientCore, fsys fsops.FS) error {
+		summary, err := cc.SyncOnce(direction(pair, dir))
+		if o.json {
+			summaries = append(summaries, newJSONSummary(pair, fsys, summary, err))
+			return err
+		}
+		printActions(o.stdout, pair, fsys, "", summary.Done)
+		printActions(o.stdout, pair, fsys, "failed\t", summary.Failed)
+		fmt.Fprintf(o.stdout, "added %d, updated %d, deleted %d, failed %d, %d bytes sent\n",
+			added(summary), summary.Count(common.OpModify), summary.Count(common.OpRemove),
+			len(summary.Failed), summary.BytesSent)
+		return err
+	})
+	if len(summaries) > 0 {
+		if err := printJSON(o.stdout, oneOrList(summaries)); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func runLsRemote(o *options, args []string) error {
+	return eachPair(o, func(pair config.SyncPair, cc *core.ClientCore, fsys fsops.FS) error {
+		entries, err := cc.ListRemote()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			kind, size := "file", strconv.FormatInt(e.Size, 10)
+			if e.IsDir {
+				kind, size = "dir", "-"
+			}
+			fmt.Fprintf(o.stdout, "%s\t%s\t%s\n", kind, size, displayPath(pair, fsys, e.Path))
+		}
+		return nil
+	})
+}
+
+func runRestore(o *options, args []string) error {
+	if len(args) == 0 {
+		return runTrash(o, []string{"list"})
+	}
+	return runTrash(o, []string{"restore", args[0]})
+}
+
+// trash of server, or of each synced folder with a client config
+func runTrash(o *options, args []string) error {
+	if !o.client {
+		fsys, err := storage.Open(config.ServerStorage, config.ServerRootPath)
+		if err != nil {
+			return err
+		}
+		defer storage.Close(fsys)
+		return trash.RunCommand(fsys, config.ServerRootPath, config.TrashRetentionDays, args)
+	}
+	if args[0] == "restore" && len(args) == 2 {
+		return restoreOnClient(o, args[1])
+	}
+	return eachPair(o, func(pair config.SyncPair, cc *core.ClientCore, fsys fsops.FS) error {
+		return trash.RunCommand(fsys, pair.RootPath, config.TrashRetentionDays, args)
+	})
+}
+
+// restore item from trash of whichever synced folder keeps it
+func restoreOnClient(o *options, id string) error {
+	pairs, err := syncPairs(o)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		_, fsys, err := newClient(pair)
+		if err != nil {
+			return err
+		}
+		items, err := trash.List(fsys, pair.RootPath)
+		if err != nil {
+			return err
+		}
+		for _, it := range items {
+			if it.ID == id {
+				return trash.RunCommand(fsys, pair.RootPath, config.TrashRetentionDays, []string{"restore", id})
+			}
+		}
+	}
+	return errors.New("no such item: " + id)
+}
+
+func runGC(o *options, args []string) error {
+	fsys, err := storage.Open(config.ServerStorage, config.ServerRootPath)
+	if err != nil {
+		return err
+	}
+	defer storage.Close(fsys)
+	return storage.RunGC(fsys, config.ServerRootPath)
+}
+
+func runKeygen(o *options, args []string) error {
+	return storage.RunKeygen()
+}
+
+// key commands work on the store as it is on disk
+func runRotateKey(o *options, args []string) error {
+	return storage.RunRotateKey(config.ServerStorage, config.ServerRootPath, args)
+}
+
+// folders to sync, only the one under --root if given
+// --server and --port apply to all of them
+func syncPairs(o *options) ([]config.SyncPair, error) {
+	cg := config.GetConfig()
+	pairs, err := cg.SyncPairs()
+	if err != nil {
+		return nil, err
+	}
+	if o.root != "" {
+		root := filepath.ToSlash(filepath.Clean(o.root))
+		var selected []config.SyncPair
+		for _, pair := range pairs {
+			if filepath.ToSlash(filepath.Clean(pair.RootPath)) == root {
+				selected = append(selected, pair)
+			}
+		}
+		if len(selected) == 0 {
+			// a folder of its own, synced with root of server
+			selected = []config.SyncPair{{RootPath: root, ServerIP: cg.ServerIP, Port: cg.Port,
+				Direction: config.DirectionBoth}}
+		}
+		pairs = selected
+	}
+	for i := range pairs {
+		if o.server != "" {
+			pairs[i].ServerIP = o.server
+		}
+		if o.port != "" {
+			pairs[i].Port, _ = strconv.Atoi(o.port)
+		}
+	}
+	return pairs, nil
+}
+
+// run fn on a client of each folder to sync, one after the other
+// a header line tells folders apart if there are several
+// @return: first error, prefixed with its folder if there are several
+func eachPair(o *options, fn func(pair config.SyncPair, cc *core.ClientCore, fsys fsops.FS) error) error {
+	pairs, err := syncPairs(o)
+	if err != nil {
+		return err
+	}
+	var first error
+	for i, pair := range pairs {
+		if len(pairs) > 1 && !o.json {
+			if i > 0 {
+				fmt.Fprintln(o.stdout)
+			}
+			fmt.Fprintf(o.stdout, "==> %s\n", describePair(pair))
+		}
+		cc, fsys, err := newClient(pair)
+		if err == nil {
+			err = fn(pair, cc, fsys)
+		}
+		if err != nil && len(pairs) > 1 {
+			err = fmt.Errorf("%s: %v", pair.RootPath, err)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// local folder and where it is synced to
+func describePair(pair config.SyncPair) string {
+	remote := "/" + pair.Remote
+	if pair.ServerIP != config.ServerIP || pair.Port != config.GetConfig().Port {
+		remote = pair.ServerIP + ":" + strconv.Itoa(pair.Port) + remote
+	}
+	return pair.RootPath + " <-> " + remote + " (" + pair.Direction + ")"
+}
+
+// @dir: overrides direction of the folder if not nil
+func direction(pair config.SyncPair, dir *core.Direction) core.Direction {
+	if dir != nil {
+		return *dir
+	}
+	return core.DirectionOf(pair.Direction)
+}
+
+// client of one folder and its server
+// names and contents are encrypted on the way between disk and server if configured
+func newClient(pair config.SyncPair) (*core.ClientCore, fsops.FS, error) {
+	if ok, _ := fsops.IsFolder(fsops.OS, pair.RootPath); !ok {
+		return nil, nil, fmt.Errorf("root path %s is not a folder", pair.RootPath)
+	}
+	fsys := fsops.OS
+	if config.Encrypt {
+		passphrase, err := crypt.ReadPassphrase(config.PassphraseFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		fsys = crypt.NewView(fsops.OS, pair.RootPath, passphrase)
+	}
+	port := config.Port
+	if pair.Port != 0 {
+		port = strconv.Itoa(pair.Port)
+	}
+	dialer := network.NewClient(pair.ServerIP, port)
+	cc := core.NewClientCore(fsys, pair.RootPath, dialer)
+	cc.Remote = pair.Remote
+	cc.Ignore = pair.Ignore
+	cc.Direction = core.DirectionOf(pair.Direction)
+	return &cc, fsys, nil
+}
+
+// path relative to root as the user knows it, decrypted if needed
+func displayPath(pair config.SyncPair, fsys fsops.FS, path string) string {
+	if view, ok := fsys.(fsops.View); ok {
+		return fsops.RemoveRootPrefix(view.ToDisk(pair.RootPath+path), pair.RootPath)
+	}
+	return path
+}
+
+// direction and name of the operation of an action
+func describe(a core.Action) (way string, op string) {
+	way = "download"
+	if a.Upload {
+		way = "upload"
+	}
+	switch a.Op {
+	case common.OpCreate:
+		op = "create"
+	case common.OpModify:
+		op = "modify"
+	case common.OpMkdir:
+		op = "mkdir"
+	case common.OpRemove:
+		op = "remove"
+	}
+	return way, op
+}
+
+// files and folders created on either side
+func added(summary core.Summary) int {
+	return summary.Count(common.OpCreate) + summary.Count(common.OpMkdir)
+}
+
+// one line for each action
+// +-----------+--------+------+------+
+// | direction | op     | size | path |
+// +-----------+--------+------+------+
+// @prefix: put in front of each line
+func printActions(w io.Writer, pair config.SyncPair, fsys fsops.FS, prefix string, actions []core.Action) {
+	for _, a := range actions {
+		way, op := describe(a)
+		size := strconv.FormatInt(a.Size, 10)
+		if a.Op == common.OpMkdir || a.Op == common.OpRemove {
+			size = "-"
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\n", prefix, way, op, size, displayPath(pair, fsys, a.Path))
+	}
+}
+
+// number of changes and bytes in each direction
+func printTotals(w io.Writer, actions []core.Action) {
+	up, down := totals(actions)
+	fmt.Fprintf(w, "%d to upload (%d bytes), %d to download (%d bytes)\n",
+		up.Count, up.Bytes, down.Count, down.Bytes)
+}
+
+func totals(actions []core.Action) (up jsonTotal, down jsonTotal) {
+	for _, a := range actions {
+		if a.Upload {
+			up.Count++
+			up.Bytes = up.Bytes + a.Size
+		} else {
+			down.Count++
+			down.Bytes = down.Bytes + a.Size
+		}
+	}
+	return up, down
+}
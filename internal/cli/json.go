@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"encoding/json"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/core"
+	"gcloudsync/internal/fsops"
+	"io"
+	"reflect"
+)
+
+// output of --json
+
+type jsonAction struct {
+	// "upload" or "download"
+	Direction string `json:"direction"`
+	// "create", "modify", "mkdir" or "remove"
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type jsonTotal struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// changes a sync would make
+type jsonPlan struct {
+	Root     string       `json:"root"`
+	Remote   string       `json:"remote"`
+	Actions  []jsonAction `json:"actions"`
+	Upload   jsonTotal    `json:"upload"`
+	Download jsonTotal    `json:"download"`
+}
+
+// changes a sync run once has made
+type jsonSummary struct {
+	Root      string       `json:"root"`
+	Remote    string       `json:"remote"`
+	Done      []jsonAction `json:"done"`
+	Failed    []jsonAction `json:"failed"`
+	Added     int          `json:"added"`
+	Updated   int          `json:"updated"`
+	Deleted   int          `json:"deleted"`
+	BytesSent int64        `json:"bytesSent"`
+	Error     string       `json:"error,omitempty"`
+}
+
+func newJSONActions(pair config.SyncPair, fsys fsops.FS, actions []core.Action) []jsonAction {
+	result := make([]jsonAction, 0, len(actions))
+	for _, a := range actions {
+		way, op := describe(a)
+		result = append(result, jsonAction{Direction: way, Op: op, Path: displayPath(pair, fsys, a.Path), Size: a.Size})
+	}
+	return result
+}
+
+func newJSONPlan(pair config.SyncPair, fsys fsops.FS, actions []core.Action) jsonPlan {
+	up, down := totals(actions)
+	return jsonPlan{Root: pair.RootPath, Remote: "/" + pair.Remote,
+		Actions: newJSONActions(pair, fsys, actions), Upload: up, Download: down}
+}
+
+// @err: why the sync failed, nil if it succeeded
+func newJSONSummary(pair config.SyncPair, fsys fsops.FS, summary core.Summary, err error) jsonSummary {
+	result := jsonSummary{Root: pair.RootPath, Remote: "/" + pair.Remote,
+		Done: newJSONActions(pair, fsys, summary.Done), Failed: newJSONActions(pair, fsys, summary.Failed),
+		Added: added(summary), Updated: summary.Count(common.OpModify), Deleted: summary.Count(common.OpRemove),
+		BytesSent: summary.BytesSent}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// one object for a single folder, a list for several
+func oneOrList(results interface{}) interface{} {
+	v := reflect.ValueOf(results)
+	if v.Len() == 1 {
+		return v.Index(0).Interface()
+	}
+	return results
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -1,26 +1,15 @@
 package main
 
 import (
-	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
-	"gcloudsync/internal/core"
-	"log"
+	"gcloudsync/internal/cli"
+	"os"
 )
 
-var logtag string = "[Main]"
-
+// same as "gcloudsync sync", other commands are passed through
 func main() {
-	common.PrintLogo()
-	// get config from json
-	cg := config.GetConfig()
-	err := cg.ReadConfigFromJson("./config.json")
-	if err != nil {
-		err := cg.ReadConfigFromJson("../config.json")
-		if err != nil {
-			log.Panicln(logtag, "unable to process config.json.")
-		}
+	args := os.Args[1:]
+	if len(args) == 0 || (args[0] != "trash" && args[0] != "help") {
+		args = append([]string{"sync"}, args...)
 	}
-	// start client
-	cc := core.NewClientCore(config.ClientRootPath)
-	cc.StartClient()
+	os.Exit(cli.Main(args, os.Stdout, os.Stderr))
 }
@@ -33,6 +33,15 @@ const (
 	Done     = "Done"
 )
 
+// reserved folders under root path, never synced
+const (
+	TrashDir   = ".gcs-trash"
+	StagingDir = ".gcs-tmp"
+	ChunkDir   = ".gcs-chunks"
+	// salt and key check value of an encrypted folder
+	KeyCheckFile = ".gcs-keycheck"
+)
+
 const (
 	IsLastPackage   = 51
 	IsNotLastPacage = 52
@@ -62,6 +71,15 @@ const (
 	SysOpRename
 	SysOpMkdir
 	SysOpChmod
+
+	SysSyncFileHash
+	SysSyncFailed
+	SysSyncGenerateChunkDiff
+	SysKeyCheck
+	SysListFiles
+	SysSelectFolder
+	SysReadOnly
+	SysSyncBusy
 )
 
 type FsEvent struct {
@@ -123,6 +141,7 @@ func MergeArray(b1 []byte, b2 []byte) []byte {
 func GetFileMd5(path string) []byte {
 	file, err := os.Open(path)
 	ErrorHandleFatal(logtag, err)
+	defer file.Close()
 	md5h := md5.New()
 	io.Copy(md5h, file)
 	result := md5h.Sum([]byte{})
@@ -3,25 +3,81 @@ package config
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
-	"gcloudsync/internal/common"
 	"log"
-	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var logtag string = "[Config]"
 
 type Config struct {
-	ServerIP          string
-	TruncateBlockSize int
-	TransferBlockSize int
-	RootPath          string
+	// host name or IP address of server, v4 or v6, may carry a port
+	// as in "example.com:9000" or "[::1]:9000"
+	ServerIP string
+	// port of server, DefaultPort if unset
+	Port                   int
+	TruncateBlockSize      int
+	TransferBlockSize      int
+	RootPath               string
+	TrashRetentionDays     int
+	MaxConcurrentTransfers int
+	// delta algorithm for modified files: "rsync" (default) or "cdc"
+	DeltaMode string
+	// encrypt names and contents before they leave the client
+	Encrypt bool
+	// file holding the passphrase, GCS_PASSPHRASE is used if unset
+	PassphraseFile string
+	// folders to sync, RootPath alone is synced with root of server if unset
+	Pairs []SyncPair
 }
 
-type ServerRoot struct {
+// one local folder synced with one folder on server
+type SyncPair struct {
 	RootPath string
+	// folder below root of server, root itself if unset
+	Remote string
+	// server of this folder, ServerIP and Port of config if unset
+	ServerIP string
+	Port     int
+	// paths not synced: "*.log" matches a name anywhere, "build/tmp" matches from root on
+	Ignore []string
+	// DirectionBoth (default), DirectionUpload or DirectionDownload
+	// local files of an upload only folder are never changed, those of a
+	// download only folder are kept identical to server
+	Direction string
+}
+
+type ServerRoot struct {
+	// host name or IP address to listen on, all interfaces if unset
+	ListenAddress string
+	// port to listen on, DefaultPort if unset
+	Port               int
+	RootPath           string
+	TrashRetentionDays int
+	Storage            StorageConfig
+	// folders below RootPath no client may write to, whatever it declares, "." for all of them
+	ReadOnlyFolders []string
+}
+
+// where server keeps the synced folder
+// Type: "dir" (default) for a plain folder on disk, "s3" for an S3 compatible store
+type StorageConfig struct {
+	Type      string
+	Endpoint  string // such as http://127.0.0.1:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// keep each distinct chunk of file content only once
+	Dedup bool
+	// bytes per chunk when Dedup is on, 1 MiB if unset
+	ChunkSize int
+	// encrypt file contents with a master key
+	Encrypt bool
+	// file holding the master key, GCS_MASTER_KEY is used if unset
+	KeyFile string
 }
 
 // configurable
@@ -31,11 +87,64 @@ var TransferBlockSize int = 1024 * 4
 var MaxBufferSize int = 1024 * 1024 * 192
 var ClientRootPath string = "./"
 
+// days to keep deleted items in trash, 0 means keep forever
+var TrashRetentionDays int = 30
+
+// number of files transferred in parallel
+var MaxConcurrentTransfers int = 4
+
+// rsync: checksums of fixed blocks, matches found by a rolling scan
+// cdc: content defined chunks, averaging TruncateBlockSize bytes
+const (
+	DeltaRsync = "rsync"
+	DeltaCDC   = "cdc"
+)
+
+var DeltaMode string = DeltaRsync
+
+// which way a folder is synced
+// backup is the same as upload and mirror as download
+const (
+	DirectionBoth     = "both"
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+	DirectionBackup   = "backup"
+	DirectionMirror   = "mirror"
+)
+
+// end to end encryption on client
+var Encrypt bool = false
+var PassphraseFile string = ""
+
+// port of server, for both client and server
+var Port string = strconv.Itoa(DefaultPort)
+
+// address server listens on, all interfaces if empty
+var ListenAddress string = ""
+
 // un-configurable
-var Port string = "8909"
 var BuffChanSize int = 1000
 var EventChanSize int = 1000
 var ServerRootPath string = "./"
+var ServerStorage StorageConfig
+var ServerReadOnlyFolders []string
+var MaxSyncRetry int = 3
+
+// a transfer without any progress for this long means packages got lost
+// the connection is dropped and everything unfinished is synced again
+var TransferIdleTimeout = 30 * time.Second
+
+// wait before connecting to server again after connection is lost
+var ReconnectInterval = 3 * time.Second
+
+// wait for local changes of a download only folder to settle before reverting them
+var RevertDelay = 500 * time.Millisecond
+
+// bytes peer may send ahead before receiver consumes them
+var ReceiveWindowSize int = 1024 * 1024 * 8
+
+// max payload of one package, larger data is split into pieces
+var MaxPackageSize int = 1024 * 1024
 
 var config *Config
 var once sync.Once
@@ -43,39 +152,105 @@ var once sync.Once
 func GetConfig() *Config {
 	once.Do(func() {
 		config = new(Config)
+		config.ServerIP = ServerIP
+		config.Port, _ = strconv.Atoi(Port)
+		config.TruncateBlockSize = TruncateBlockSize
+		config.TransferBlockSize = TransferBlockSize
+		config.TrashRetentionDays = TrashRetentionDays
+		config.MaxConcurrentTransfers = MaxConcurrentTransfers
+		config.DeltaMode = DeltaMode
+		config.Encrypt = Encrypt
+		config.PassphraseFile = PassphraseFile
 	})
 	return config
 }
 
+// read client config, keys not in the file keep their defaults
+// current config is kept if the file is invalid
 func (c *Config) ReadConfigFromJson(path string) error {
-	file, err := os.Open(path)
-
+	next, err := DecodeConfig(path)
 	if err != nil {
-		return errors.New("open json failed")
+		return err
 	}
-	defer file.Close()
-
-	fileinfo, err := os.Stat(path)
-	common.ErrorHandleDebug(logtag, err)
-	filesize := fileinfo.Size()
-
-	data := make([]byte, filesize)
-	_, err = file.Read(data)
-	common.ErrorHandleDebug(logtag, err)
+	return c.Apply(next)
+}
 
-	err = json.Unmarshal(data, c)
+// read client config onto defaults, values are checked by Apply
+// so that they can still be changed, such as by command line flags
+func DecodeConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	err := decodeJson(path, &c)
+	return c, err
+}
 
+// make next the current config, c is kept if next is invalid
+func (c *Config) Apply(next Config) error {
+	if err := next.validate(); err != nil {
+		return err
+	}
+	*c = next
 	c.changeGlobalConfigStatus()
 
 	PrintCurrentConfig()
-	return err
+	return nil
+}
+
+// folders to sync with defaults filled in
+// a config without pairs syncs RootPath with root of server
+func (c *Config) SyncPairs() ([]SyncPair, error) {
+	pairs := c.Pairs
+	if len(pairs) == 0 {
+		pairs = []SyncPair{{RootPath: c.RootPath}}
+	}
+	result := make([]SyncPair, 0, len(pairs))
+	seen := make(map[string]bool)
+	for i, p := range pairs {
+		key := "Pairs[" + strconv.Itoa(i) + "]."
+		if len(c.Pairs) == 0 {
+			key = ""
+		}
+		if p.RootPath == "" {
+			return nil, keyError(key+"RootPath", "not set")
+		}
+		if seen[p.RootPath] {
+			return nil, keyError(key+"RootPath", "%s is synced twice", p.RootPath)
+		}
+		seen[p.RootPath] = true
+		if p.ServerIP == "" {
+			p.ServerIP = c.ServerIP
+		}
+		if p.Port == 0 {
+			p.Port = c.Port
+		}
+		switch p.Direction {
+		case "":
+			p.Direction = DirectionBoth
+		case DirectionBoth, DirectionUpload, DirectionDownload:
+		case DirectionBackup:
+			p.Direction = DirectionUpload
+		case DirectionMirror:
+			p.Direction = DirectionDownload
+		default:
+			return nil, keyError(key+"Direction", "unknown direction %q", p.Direction)
+		}
+		result = append(result, p)
+	}
+	return result, nil
 }
 
 func (c *Config) changeGlobalConfigStatus() {
 	ServerIP = c.ServerIP
+	if c.Port != 0 {
+		Port = strconv.Itoa(c.Port)
+	}
 	TruncateBlockSize = c.TruncateBlockSize
 	TransferBlockSize = c.TransferBlockSize
 	ClientRootPath = c.RootPath
+	TrashRetentionDays = c.TrashRetentionDays
+	MaxConcurrentTransfers = c.MaxConcurrentTransfers
+	DeltaMode = c.DeltaMode
+	Encrypt = c.Encrypt
+	PassphraseFile = c.PassphraseFile
 }
 
 func (c *Config) ToBytes() []byte {
@@ -87,14 +262,42 @@ func (c *Config) ToBytes() []byte {
 	binary.BigEndian.PutUint32(b, uint32(c.TransferBlockSize))
 
 	buf.Write([]byte(b))
+	if c.DeltaMode == DeltaCDC {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
 
 	return buf.Bytes()
 }
 
-func (c *Config) ConfigFromBytes(b []byte) {
-	c.TruncateBlockSize = int(binary.BigEndian.Uint32(b[0:4]))
-	c.TransferBlockSize = int(binary.BigEndian.Uint32(b[4:8]))
-	c.changeGlobalConfigStatus()
+// config sent by peer, c is kept if it is invalid
+// peers without delta mode send 8 bytes and use rsync
+// only c is changed, settings of peer apply to its connection alone
+func (c *Config) ConfigFromBytes(b []byte) error {
+	if len(b) != 8 && len(b) != 9 {
+		return errors.New("invalid config length")
+	}
+	mode := DeltaRsync
+	if len(b) == 9 {
+		switch b[8] {
+		case 0:
+		case 1:
+			mode = DeltaCDC
+		default:
+			return errors.New("unknown delta mode")
+		}
+	}
+	truncate := int64(binary.BigEndian.Uint32(b[0:4]))
+	transfer := int64(binary.BigEndian.Uint32(b[4:8]))
+	if truncate <= 0 || truncate > int64(MaxBufferSize) ||
+		transfer <= 0 || transfer > int64(MaxPackageSize) {
+		return errors.New("block size out of range")
+	}
+	c.TruncateBlockSize = int(truncate)
+	c.TransferBlockSize = int(transfer)
+	c.DeltaMode = mode
+	return nil
 }
 
 func PrintCurrentConfig() {
@@ -102,32 +305,48 @@ func PrintCurrentConfig() {
 	if ServerIP != "" {
 		log.Println(logtag, "ServerIP:", ServerIP)
 	}
+	log.Println(logtag, "Port:", Port)
 	log.Println(logtag, "TruncateBlockSize:", TruncateBlockSize)
 	log.Println(logtag, "TransferBlockSize:", TransferBlockSize)
 	log.Println(logtag, "MaxBufferSize:", MaxBufferSize)
 	if ClientRootPath != "" {
 		log.Println(logtag, "ClientRootPath:", ClientRootPath)
 	}
+	log.Println(logtag, "TrashRetentionDays:", TrashRetentionDays)
+	log.Println(logtag, "MaxConcurrentTransfers:", MaxConcurrentTransfers)
+	log.Println(logtag, "DeltaMode:", DeltaMode)
+	if Encrypt {
+		log.Println(logtag, "Encrypt:", Encrypt)
+	}
 }
 
+// read server config, keys not in the file keep their defaults
+// current config is kept if the file is invalid
 func ConfigServerRootPath(path string) error {
-	file, err := os.Open(path)
-
+	s, err := DecodeServerRoot(path)
 	if err != nil {
-		return errors.New("open json failed")
+		return err
 	}
-	defer file.Close()
-
-	fileinfo, err := os.Stat(path)
-	common.ErrorHandleDebug(logtag, err)
-	filesize := fileinfo.Size()
+	return ApplyServerRoot(s)
+}
 
-	data := make([]byte, filesize)
-	_, err = file.Read(data)
-	common.ErrorHandleDebug(logtag, err)
+// read server config onto defaults, values are checked by ApplyServerRoot
+func DecodeServerRoot(path string) (ServerRoot, error) {
+	s := DefaultServerRoot()
+	err := decodeJson(path, &s)
+	return s, err
+}
 
-	s := ServerRoot{}
-	err = json.Unmarshal(data, &s)
+// make s the server config, current one is kept if s is invalid
+func ApplyServerRoot(s ServerRoot) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	ListenAddress = s.ListenAddress
+	Port = strconv.Itoa(s.Port)
 	ServerRootPath = s.RootPath
-	return err
+	ServerStorage = s.Storage
+	ServerReadOnlyFolders = s.ReadOnlyFolders
+	TrashRetentionDays = s.TrashRetentionDays
+	return nil
 }
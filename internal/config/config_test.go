@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzConfigFromBytes(f *testing.F) {
+	f.Add((&Config{TruncateBlockSize: 1024, TransferBlockSize: 4096}).ToBytes())
+	f.Add((&Config{TruncateBlockSize: 9192, TransferBlockSize: 1}).ToBytes())
+	f.Add((&Config{TruncateBlockSize: 1024, TransferBlockSize: 4096, DeltaMode: DeltaCDC}).ToBytes())
+	// peer without delta mode
+	f.Add([]byte{0, 0, 4, 0, 0, 0, 16, 0})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := new(Config)
+		if err := c.ConfigFromBytes(b); err != nil {
+			return
+		}
+		if c.TruncateBlockSize <= 0 || c.TransferBlockSize <= 0 {
+			t.Fatalf("accepted invalid block size %d %d", c.TruncateBlockSize, c.TransferBlockSize)
+		}
+		if encoded := c.ToBytes(); !bytes.Equal(encoded[:len(b)], b) {
+			t.Fatalf("config does not encode back to input")
+		}
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFromJson(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	file := root + "/file"
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(Config)
+	if err := c.ReadConfigFromJson(writeConfig(t, `{"RootPath": "`+root+`", "ServerIP": "[::1]:9000"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if c.TruncateBlockSize != 1024 || c.TransferBlockSize != 4096 || c.Port != DefaultPort ||
+		c.DeltaMode != DeltaRsync || c.MaxConcurrentTransfers != 4 || TruncateBlockSize != 1024 {
+		t.Fatalf("defaults not applied: %+v", c)
+	}
+
+	for content, want := range map[string]string{
+		`{"RootPath": "` + root + `", "TruncateBlockSize": 0}`:         "TruncateBlockSize: must be between",
+		`{"RootPath": "` + root + `", "TransferBlockSize": -1}`:        "TransferBlockSize: must be between",
+		`{"RootPath": "` + root + `", "Port": 70000}`:                  "Port: must be between",
+		`{"RootPath": "` + root + `", "Port": "9000"}`:                 "Port: int expected, got string",
+		`{"RootPath": "` + root + `", "ServerIP": "bad host"}`:         "ServerIP: invalid host name",
+		`{"RootPath": "` + root + `", "ServerIP": "host:0"}`:           "ServerIP: invalid port",
+		`{"RootPath": "` + root + `", "DeltaMode": "zip"}`:             "DeltaMode:",
+		`{"RootPath": "` + root + `", "TruncateSize": 1024}`:           "TruncateSize: unknown key",
+		`{"RootPath": "` + root + `/missing"}`:                         "RootPath: " + root + "/missing does not exist",
+		`{"RootPath": "` + file + `"}`:                                 "RootPath: " + file + " is not a folder",
+		`{"ServerIP": "127.0.0.1"}`:                                    "RootPath: not set",
+		`{"Pairs": [{"RootPath": "` + root + `", "Direction": "up"}]}`: "Pairs[0].Direction: unknown direction",
+		`{"Pairs": [{"RootPath": "` + root + `", "Remote": "../x"}]}`:  "Pairs[0].Remote:",
+		`{"Pairs": [{"RootPath": "` + root + `", "Bogus": 1}]}`:        "Pairs[0].Bogus: unknown key",
+		`{"Pairs": [{"RootPath": "` + root + `"}, {"bogus": 1}]}`:      "Pairs[1].bogus: unknown key",
+		"{\n\"RootPath\": ,\n}":                                        "line 2:",
+		``:                                                             "empty config",
+	} {
+		err := c.ReadConfigFromJson(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", content, err, want)
+		}
+	}
+	if c.TruncateBlockSize != 1024 || TruncateBlockSize != 1024 {
+		t.Fatal("invalid config applied")
+	}
+}
+
+func TestConfigServerRootPath(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	if err := ConfigServerRootPath(writeConfig(t, `{"RootPath": "`+root+`", "ListenAddress": "::1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if ServerRootPath != root || ListenAddress != "::1" || Port != "8909" || TrashRetentionDays != 30 {
+		t.Fatalf("read as %s %s %s %d", ServerRootPath, ListenAddress, Port, TrashRetentionDays)
+	}
+
+	for content, want := range map[string]string{
+		`{"RootPath": "` + root + `/missing"}`:                              "RootPath: " + root + "/missing does not exist",
+		`{"RootPath": "` + root + `", "TrashRetentionDays": -1}`:            "TrashRetentionDays: must be between",
+		`{"RootPath": "` + root + `", "ListenAddress": "10.0.0.1:x"}`:       "ListenAddress: invalid port",
+		`{"RootPath": "` + root + `", "Storage": {"Type": "ftp"}}`:          "Storage.Type:",
+		`{"RootPath": "/prefix", "Storage": {"Type": "s3", "Bucket": "b"}}`: "Storage.Endpoint: not set",
+		`{"RootPath": "` + root + `", "Storage": {"ChunkSize": 10}}`:        "Storage.ChunkSize: must be between",
+		`{"RootPath": "` + root + `", "Storage": {"Dedupe": true}}`:         "Storage.Dedupe: unknown key",
+		`{"RootPath": "` + root + `", "Storage": {"Encrypt": "yes"}}`:       "Storage.Encrypt: bool expected",
+		`{"RootPath": "` + root + `", "ReadOnlyFolders": ["../other"]}`:     "ReadOnlyFolders: \"../other\" is not a folder below RootPath",
+		`{"TruncateBlockSize": 1024}`:                                       "TruncateBlockSize: unknown key",
+	} {
+		err := ConfigServerRootPath(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", content, err, want)
+		}
+	}
+	// s3 keeps RootPath as key prefix, it needs no folder
+	err := ConfigServerRootPath(writeConfig(t, `{"RootPath": "/prefix",
+		"Storage": {"Type": "s3", "Endpoint": "http://127.0.0.1:9000", "Bucket": "b"}}`))
+	if err != nil || ServerRootPath != "/prefix" {
+		t.Fatalf("s3 config read as %s, %v", ServerRootPath, err)
+	}
+}
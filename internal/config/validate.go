@@ -0,0 +1,371 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// config files are read strictly: unknown keys, values of the wrong type
+// and values out of range are refused, and the error names the key
+
+// port used when a config does not name one
+const DefaultPort = 8909
+
+// client config with every optional key set to its default
+func DefaultConfig() Config {
+	return Config{
+		ServerIP:               "127.0.0.1",
+		Port:                   DefaultPort,
+		TruncateBlockSize:      1024,
+		TransferBlockSize:      1024 * 4,
+		TrashRetentionDays:     30,
+		MaxConcurrentTransfers: 4,
+		DeltaMode:              DeltaRsync,
+	}
+}
+
+// server config with every optional key set to its default
+func DefaultServerRoot() ServerRoot {
+	return ServerRoot{Port: DefaultPort, TrashRetentionDays: 30}
+}
+
+// a key of a config file with an invalid value
+type KeyError struct {
+	Key string
+	Err string
+}
+
+func (e *KeyError) Error() string {
+	return e.Key + ": " + e.Err
+}
+
+func keyError(key string, format string, a ...interface{}) error {
+	return &KeyError{Key: key, Err: fmt.Sprintf(format, a...)}
+}
+
+// read json file into v, keys v does not have are refused
+func decodeJson(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after config")
+	}
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case err == io.EOF:
+		return errors.New("empty config")
+	case errors.As(err, &syntax):
+		line := bytes.Count(data[:syntax.Offset], []byte("\n")) + 1
+		return fmt.Errorf("line %d: %v", line, syntax)
+	case errors.As(err, &typ):
+		return keyError(typ.Field, "%s expected, got %s", typ.Type, typ.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// error of decoder names the key without the objects it is in
+		key, kerr := unknownKey(json.NewDecoder(bytes.NewReader(data)), reflect.TypeOf(v), "")
+		if kerr != nil || key == "" {
+			key = strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		}
+		return keyError(key, "unknown key")
+	}
+	return err
+}
+
+// full path of the first key t has no field for, as in "Pairs[0].Bogus"
+// @t: type the next value of dec is decoded into, nil if it takes any key
+// @path: path of the next value of dec
+func unknownKey(dec *json.Decoder, t reflect.Type, path string) (string, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			key := tok.(string)
+			if path != "" {
+				key = path + "." + key
+			}
+			var elem reflect.Type
+			if t != nil && t.Kind() == reflect.Struct {
+				field, ok := fieldByKey(t, tok.(string))
+				if !ok {
+					return key, nil
+				}
+				elem = field.Type
+			} else if t != nil && t.Kind() == reflect.Map {
+				elem = t.Elem()
+			}
+			if found, err := unknownKey(dec, elem, key); found != "" || err != nil {
+				return found, err
+			}
+		}
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			if found, err := unknownKey(dec, elem, path+"["+strconv.Itoa(i)+"]"); found != "" || err != nil {
+				return found, err
+			}
+		}
+	default:
+		return "", nil
+	}
+	// closing delimiter
+	_, err = dec.Token()
+	return "", err
+}
+
+// field a key is decoded into, matched as encoding/json does:
+// exact name first, then ignoring case. configs carry no json tags.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	var folded reflect.StructField
+	found := false
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Name == key {
+			return field, true
+		}
+		if !found && strings.EqualFold(field.Name, key) {
+			folded, found = field, true
+		}
+	}
+	return folded, found
+}
+
+// whether the file at path is a client config rather than a server config
+// told by keys only a client config has, values are not looked at
+func IsClientConfig(path string) bool {
+	var s ServerRoot
+	var c Config
+	return isUnknownKey(decodeJson(path, &s)) && !isUnknownKey(decodeJson(path, &c))
+}
+
+func isUnknownKey(err error) bool {
+	var ke *KeyError
+	return errors.As(err, &ke) && ke.Err == "unknown key"
+}
+
+func (c *Config) validate() error {
+	if err := checkAddress("ServerIP", c.ServerIP); err != nil {
+		return err
+	}
+	checks := []error{
+		checkRange("Port", c.Port, 1, 65535),
+		checkRange("TruncateBlockSize", c.TruncateBlockSize, 1, MaxBufferSize),
+		checkRange("TransferBlockSize", c.TransferBlockSize, 1, MaxPackageSize),
+		checkRange("TrashRetentionDays", c.TrashRetentionDays, 0, 36500),
+		checkRange("MaxConcurrentTransfers", c.MaxConcurrentTransfers, 1, 1024),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	if c.DeltaMode != DeltaRsync && c.DeltaMode != DeltaCDC {
+		return keyError("DeltaMode", "%q is neither %q nor %q", c.DeltaMode, DeltaRsync, DeltaCDC)
+	}
+	if c.Encrypt && c.PassphraseFile != "" {
+		if err := checkFile("PassphraseFile", c.PassphraseFile); err != nil {
+			return err
+		}
+	}
+	if len(c.Pairs) == 0 {
+		if c.RootPath == "" {
+			return keyError("RootPath", "not set")
+		}
+		return checkFolder("RootPath", c.RootPath)
+	}
+	if c.RootPath != "" {
+		return keyError("RootPath", "can not be used together with Pairs")
+	}
+	for i, p := range c.Pairs {
+		if err := p.validate(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @i: index of pair in config, for errors
+func (p *SyncPair) validate(i int) error {
+	key := "Pairs[" + strconv.Itoa(i) + "]."
+	if p.RootPath == "" {
+		return keyError(key+"RootPath", "not set")
+	}
+	if err := checkFolder(key+"RootPath", p.RootPath); err != nil {
+		return err
+	}
+	if p.Remote != "" {
+		for _, part := range strings.Split(p.Remote, "/") {
+			if part == "" || part == "." || part == ".." {
+				return keyError(key+"Remote", "%q is not a folder below root of server", p.Remote)
+			}
+		}
+	}
+	if p.ServerIP != "" {
+		if err := checkAddress(key+"ServerIP", p.ServerIP); err != nil {
+			return err
+		}
+	}
+	if p.Port != 0 {
+		if err := checkRange(key+"Port", p.Port, 1, 65535); err != nil {
+			return err
+		}
+	}
+	switch p.Direction {
+	case "", DirectionBoth, DirectionUpload, DirectionDownload, DirectionBackup, DirectionMirror:
+	default:
+		return keyError(key+"Direction", "unknown direction %q", p.Direction)
+	}
+	return nil
+}
+
+func (s *ServerRoot) validate() error {
+	if s.ListenAddress != "" {
+		if err := checkAddress("ListenAddress", s.ListenAddress); err != nil {
+			return err
+		}
+	}
+	if err := checkRange("Port", s.Port, 1, 65535); err != nil {
+		return err
+	}
+	if err := checkRange("TrashRetentionDays", s.TrashRetentionDays, 0, 36500); err != nil {
+		return err
+	}
+	if s.RootPath == "" {
+		return keyError("RootPath", "not set")
+	}
+	for _, name := range s.ReadOnlyFolders {
+		if clean := path.Clean(name); name == "" || path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return keyError("ReadOnlyFolders", "%q is not a folder below RootPath", name)
+		}
+	}
+
+	st := s.Storage
+	switch st.Type {
+	case "", "dir":
+		// with s3 it is a key prefix inside the bucket
+		if err := checkFolder("RootPath", s.RootPath); err != nil {
+			return err
+		}
+	case "s3":
+		if st.Endpoint == "" {
+			return keyError("Storage.Endpoint", "not set")
+		}
+		if !strings.HasPrefix(st.Endpoint, "http://") && !strings.HasPrefix(st.Endpoint, "https://") {
+			return keyError("Storage.Endpoint", "%q is not an http or https url", st.Endpoint)
+		}
+		if st.Bucket == "" {
+			return keyError("Storage.Bucket", "not set")
+		}
+	default:
+		return keyError("Storage.Type", "%q is neither \"dir\" nor \"s3\"", st.Type)
+	}
+	if st.ChunkSize != 0 {
+		if err := checkRange("Storage.ChunkSize", st.ChunkSize, 1024, MaxBufferSize); err != nil {
+			return err
+		}
+	}
+	if st.Encrypt && st.KeyFile != "" {
+		if err := checkFile("Storage.KeyFile", st.KeyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRange(key string, value int, min int, max int) error {
+	if value < min || value > max {
+		return keyError(key, "must be between %d and %d, got %d", min, max, value)
+	}
+	return nil
+}
+
+func checkFolder(key string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return keyError(key, "%s does not exist", path)
+	}
+	if !info.IsDir() {
+		return keyError(key, "%s is not a folder", path)
+	}
+	return nil
+}
+
+func checkFile(key string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return keyError(key, "%s does not exist", path)
+	}
+	if info.IsDir() {
+		return keyError(key, "%s is a folder", path)
+	}
+	return nil
+}
+
+// host name or IP address, optionally with port as in "example.com:9000" or "[::1]:9000"
+func checkAddress(key string, address string) error {
+	host := address
+	if strings.HasPrefix(address, "[") || strings.Count(address, ":") == 1 {
+		h, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return keyError(key, "invalid address %q", address)
+		}
+		if port != "" {
+			n, err := strconv.Atoi(port)
+			if err != nil || n < 1 || n > 65535 {
+				return keyError(key, "invalid port in %q", address)
+			}
+		}
+		host = h
+	}
+	if host == "" {
+		return keyError(key, "no host in %q", address)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return keyError(key, "host name too long")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return keyError(key, "invalid host name %q", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return keyError(key, "invalid host name %q", host)
+			}
+		}
+	}
+	return nil
+}
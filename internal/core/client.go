@@ -1,180 +1,683 @@
 package core
 
 import (
+	"errors"
 	"gcloudsync/internal/common"
 	"gcloudsync/internal/config"
 	"gcloudsync/internal/fsops"
 	"gcloudsync/internal/fswatcher"
 	"gcloudsync/internal/network"
+	"gcloudsync/internal/trash"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClientCore struct {
-	client    network.ITCPClient
+	fs        fsops.FS
+	dialer    network.Dialer
 	watchPath string
 	eventChan chan common.FsEvent
-	eventDone chan bool
+	// closed once init is finished and fs is being watched
+	ready chan bool
+	stop  chan bool
+	// signaled on local changes of a download only folder
+	revert chan bool
+
+	lock *sync.Mutex
+	// connection being set up or in use, nil if none
+	client network.Conn
+	// nil unless connected and init is finished
+	session *session
+	// events not synced because connection was lost, replayed after reconnect
+	deferred []common.FsEvent
+	// why StartClient gave up, nil if it was stopped
+	err error
+
+	// folder below root of server to sync with, root itself if empty
+	Remote string
+	// patterns of paths neither side syncs, see fsops.IsIgnored
+	Ignore []string
+	// delta settings sent to server, config.GetConfig() if nil
+	Config *config.Config
+	// which way changes are synced, a download only folder is kept
+	// identical to server and local changes are reverted
+	Direction Direction
+}
+
+// one connection to server
+type session struct {
+	conn      *countingConn
+	transfers *transferTable
+	// closed once connection is gone
+	lost chan bool
+	// signaled by handleCore once config is synced
+	done chan bool
+	// files to sync sent by server on request of older clients
+	events chan common.FsEvent
+}
+
+// connection counting bytes sent through it
+type countingConn struct {
+	// first so that it is aligned for atomic access on 32 bit platforms
+	bytes int64
+	network.Conn
 }
 
-func NewClientCore(path string) ClientCore {
+func (c *countingConn) Send(stream uint32, b []byte) error {
+	atomic.AddInt64(&c.bytes, int64(len(b)))
+	return c.Conn.Send(stream, b)
+}
+
+func (c *countingConn) sent() int64 {
+	return atomic.LoadInt64(&c.bytes)
+}
+
+var errLost = errors.New("connection to server lost")
+var errStopped = errors.New("client stopped")
+var errUploadOnly = errors.New("folder is upload only, local files are never changed")
+var errDownloadOnly = errors.New("folder is download only, nothing is sent to server")
+
+// @fsys: filesystem the synced folder lives on, watching requires the real disk
+// @path: root path of the folder to be synced
+// @dialer: transport to connect to server
+func NewClientCore(fsys fsops.FS, path string, dialer network.Dialer) ClientCore {
 	eventChan := make(chan common.FsEvent, config.EventChanSize)
-	eventDone := make(chan bool)
-	cli := network.NewClient(config.ServerIP, config.Port)
-	return ClientCore{client: cli, watchPath: path,
-		eventChan: eventChan, eventDone: eventDone}
+	return ClientCore{fs: fsys, dialer: dialer, watchPath: path, eventChan: eventChan,
+		ready: make(chan bool), stop: make(chan bool), revert: make(chan bool, 1), lock: new(sync.Mutex)}
 }
 
+// closed once init is finished and local changes are being synced
+func (c *ClientCore) Ready() chan bool {
+	return c.ready
+}
+
+// error StartClient returned for, nil if stopped by Stop
+func (c *ClientCore) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// disconnect from server and stop watching, StartClient will return
+func (c *ClientCore) Stop() {
+	close(c.stop)
+	c.lock.Lock()
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.lock.Unlock()
+}
+
+// connect to server and keep folder synced
+// connect again whenever connection is lost, until Stop is called
+// or the encryption key is not accepted
 func (c *ClientCore) StartClient() {
-	err := c.client.Connect()
-	common.ErrorHandleFatal(logtag, err)
-	defer c.client.Close()
+	err := fsops.CleanStagingDir(c.fs, c.watchPath)
+	common.ErrorHandleDebug(logtag, err)
+
+	for {
+		if !c.runSession() {
+			return
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(config.ReconnectInterval):
+		}
+		log.Println(logtag, "reconnecting...")
+	}
+}
+
+// sync with server over one connection, returns when it is lost
+// @return: false if connecting again is of no use
+func (c *ClientCore) runSession() bool {
+	sess, retry, err := c.handshake(false)
+	if err != nil {
+		if !retry {
+			c.lock.Lock()
+			c.err = err
+			c.lock.Unlock()
+		}
+		return retry
+	}
+	defer c.endSession(sess)
+	conn := sess.conn
+
+	// finish what was interrupted by the last connection first
+	s := newScheduler(config.MaxConcurrentTransfers)
+	if !c.replayDeferred(sess, s, false) {
+		return true
+	}
+
+	log.Println(logtag, "sync all files...")
+	if _, err := c.reconcile(sess, c.Direction, nil); err != nil {
+		return true
+	}
+
+	// changes made during init
+	if !c.replayDeferred(sess, s, true) {
+		return true
+	}
+	WrappAndSend(conn, 0, common.SysInitFinished, []byte{}, common.IsLastPackage)
+
+	select {
+	case <-c.ready:
+	default:
+		// first session, start syncing local changes
+		go c.startEventLoop()
+		go c.startWatching()
+		if c.Direction == SyncDownload {
+			go c.startReverting()
+		}
+		go trash.StartPurging(c.fs, c.watchPath, config.TrashRetentionDays)
+	}
+
+	select {
+	case <-sess.lost:
+		c.lock.Lock()
+		c.session = nil
+		c.lock.Unlock()
+		log.Println(logtag, "connection lost.")
+	case <-c.stop:
+	}
+	return true
+}
+
+// connect to server, sync config and agree on keys
+// @readOnly: nothing is going to be written to server, always so for a download only folder
+// @return: session ready for syncing files, or err and whether connecting again may help
+func (c *ClientCore) handshake(readOnly bool) (*session, bool, error) {
+	readOnly = readOnly || c.Direction == SyncDownload
+	raw, err := c.dialer.Dial()
+	if err != nil {
+		common.ErrorHandleDebug(logtag, err)
+		return nil, true, err
+	}
+	conn := &countingConn{Conn: raw}
+	if !c.setClient(conn) {
+		conn.Close()
+		return nil, true, errStopped
+	}
 
 	log.Println(logtag, "connected successfully.")
-	done := make(chan bool)
-	initDone := make(chan bool)
-	bc := c.client.GetBuffChan()
+	sess := &session{conn: conn, transfers: newTransferTable(c.fs), lost: make(chan bool),
+		done: make(chan bool, 2), events: make(chan common.FsEvent, config.EventChanSize)}
+	cg := c.Config
+	if cg == nil {
+		cg = config.GetConfig()
+	}
+	sess.transfers.blockSize, sess.transfers.deltaMode = cg.TruncateBlockSize, cg.DeltaMode
 
 	// handle received message
-	go handleCore(c.client, bc, done, c.eventChan, c.eventDone)
-
-	// start receiving
-	go c.client.ReadFromServer()
+	go func() {
+		handleCore(conn, RoleClient, c.fs, c.watchPath, nil, sess.done, sess.events, sess.transfers)
+		sess.transfers.abort()
+		close(sess.lost)
+	}()
 
 	// init config
-
-	c.syncConfig()
+	c.syncConfig(conn, cg)
 	log.Println(logtag, "sync config...")
 
 	// init config ok
-	<-done
-
+	if !c.waitSession(sess, nil, nil) {
+		c.endSession(sess)
+		return nil, true, errLost
+	}
 	log.Println(logtag, "sync config ok.")
 
-	// send init signal
-	WrappAndSend(c.client, common.SysInit, []byte{}, common.IsLastPackage)
-	log.Println(logtag, "sync all files...")
+	// server refuses any write from now on
+	if readOnly {
+		t := sess.transfers.start(c.watchPath)
+		WrappAndSend(conn, t.id, common.SysReadOnly, []byte{}, common.IsLastPackage)
+		if !waitTransfer(sess, t) {
+			c.endSession(sess)
+			return nil, true, errLost
+		}
+	}
 
-	// init file list ok
-	<-done
+	if c.Remote != "" {
+		if err := c.selectRemote(sess); err != nil {
+			log.Println(logtag, "select folder failed:", err)
+			c.endSession(sess)
+			return nil, err == errLost, err
+		}
+	}
 
-	go c.startEventLoop(c.eventDone, initDone)
-	// process the remain event in eventChen
-	// before start watching fs
-	<-initDone
-	// next start watching fs
+	// keys of an encrypted folder are agreed on before any file is touched
+	if fsys, ok := c.fs.(keyed); ok {
+		unlocked, err := c.unlock(sess, fsys, readOnly)
+		if err != nil {
+			log.Println(logtag, "encryption key check failed:", err)
+			c.endSession(sess)
+			return nil, false, err
+		}
+		if !unlocked {
+			c.endSession(sess)
+			return nil, true, errLost
+		}
+		log.Println(logtag, "encryption key ok.")
+	}
+	return sess, false, nil
+}
 
-	go c.startWatching()
+// ask server to sync with the named folder instead of its root
+func (c *ClientCore) selectRemote(sess *session) error {
+	t := sess.transfers.start(c.watchPath)
+	WrappAndSend(sess.conn, t.id, common.SysSelectFolder, []byte(c.Remote), common.IsLastPackage)
+	if !waitTransfer(sess, t) {
+		return errLost
+	}
+	if len(t.reply) > 0 {
+		return errors.New("server refused folder " + c.Remote + ": " + string(t.reply))
+	}
+	return nil
+}
 
-	<-done
-	close(done)
+// bring both sides in line once
+// @record: called with each change and whether it succeeded, may be nil
+// @return: changes planned, err if files on server could not be listed
+func (c *ClientCore) reconcile(sess *session, dir Direction, record func(a Action, ok bool)) ([]Action, error) {
+	remote, err := c.listRemote(sess)
+	if err != nil {
+		return nil, err
+	}
+	actions := c.plan(remote, dir)
+	if record == nil {
+		record = func(a Action, ok bool) {}
+	}
+
+	s := newScheduler(config.MaxConcurrentTransfers)
+	for _, a := range actions {
+		a := a
+		absPath := c.watchPath + a.Path
+		if a.Op == common.OpRemove {
+			// reverted, kept in local trash in case it was wanted
+			log.Println(logtag, "revert:", absPath)
+			err := trash.MoveToTrash(c.fs, c.watchPath, absPath)
+			common.ErrorHandleDebug(logtag, err)
+			record(a, err == nil)
+			continue
+		}
+		if a.Op == common.OpMkdir && !a.Upload {
+			// content of the folder is only submitted after it exists
+			log.Println(logtag, "mkdir:", absPath)
+			err := fsops.Makedir(c.fs, absPath)
+			common.ErrorHandleDebug(logtag, err)
+			record(a, err == nil)
+			continue
+		}
+		event := common.FsEvent{Op: a.Op, FileName: absPath}
+		if !a.Upload {
+			event.Op = common.OpFetch
+		}
+		s.submit(event, func() {
+			record(a, c.sendEvent(sess, event, true))
+		})
+	}
+	s.wait()
+	return actions, nil
+}
+
+// changes to bring local folder in line with entries on server
+// a download only folder has files and folders the server lacks reverted
+func (c *ClientCore) plan(remote []Entry, dir Direction) []Action {
+	local := c.unignored(listFolder(c.fs, c.watchPath))
+	remote = c.unignored(remote)
+	actions := planSync(local, remote, dir)
+	if c.Direction == SyncDownload && dir == SyncDownload {
+		actions = append(planRevert(local, remote), actions...)
+	}
+	return actions
 }
 
-func (c *ClientCore) syncConfig() {
-	data := config.GetConfig().ToBytes()
-	WrappAndSend(c.client, common.SysInitSyncConfig, data, common.IsLastPackage)
+// whether a sync in the given direction is allowed for this folder
+func (c *ClientCore) allows(dir Direction) error {
+	switch {
+	case c.Direction == SyncUpload && dir != SyncUpload:
+		return errUploadOnly
+	case c.Direction == SyncDownload && dir != SyncDownload:
+		return errDownloadOnly
+	}
+	return nil
+}
+
+// entries not matched by ignore patterns
+func (c *ClientCore) unignored(entries []Entry) []Entry {
+	if len(c.Ignore) == 0 {
+		return entries
+	}
+	var result []Entry
+	for _, e := range entries {
+		if !c.ignored(c.watchPath + e.Path) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// whether the path is matched by ignore patterns
+// patterns apply to names as they are on disk
+func (c *ClientCore) ignored(absPath string) bool {
+	if len(c.Ignore) == 0 {
+		return false
+	}
+	if view, ok := c.fs.(fsops.View); ok {
+		absPath = view.ToDisk(absPath)
+	}
+	return fsops.IsIgnored(c.Ignore, fsops.RemoveRootPrefix(absPath, c.watchPath))
+}
+
+// close the connection of a session
+func (c *ClientCore) endSession(sess *session) {
+	sess.conn.Close()
+	c.setClient(nil)
+}
+
+// @return: false if client has been stopped
+func (c *ClientCore) setClient(conn network.Conn) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.stop:
+		return false
+	default:
+	}
+	c.client = conn
+	return true
+}
+
+// wait for the next done signal of handleCore
+// events received meanwhile are submitted to scheduler
+// @return: false if connection is gone or server stops responding
+func (c *ClientCore) waitSession(sess *session, events chan common.FsEvent, s *scheduler) bool {
+	for {
+		select {
+		case <-sess.done:
+			// events are queued ahead of done signal
+			for len(events) > 0 {
+				c.submitEvent(sess, s, <-events, false)
+			}
+			return true
+		case event := <-events:
+			c.submitEvent(sess, s, event, false)
+		case <-sess.lost:
+			return false
+		case <-c.stop:
+			return false
+		case <-time.After(config.TransferIdleTimeout):
+			log.Println(logtag, "server not responding.")
+			sess.conn.Close()
+			return false
+		}
+	}
+}
+
+// sync deferred events until there is none left
+// @online: mark session as online once there is nothing left to replay
+// @return: false if connection is lost
+func (c *ClientCore) replayDeferred(sess *session, s *scheduler, online bool) bool {
+	for {
+		c.lock.Lock()
+		events := c.deferred
+		c.deferred = nil
+		if len(events) == 0 && online {
+			c.session = sess
+		}
+		c.lock.Unlock()
+
+		if len(events) == 0 {
+			return true
+		}
+		log.Println(logtag, "resume", len(events), "unfinished events...")
+		for _, event := range events {
+			c.submitEvent(sess, s, event, false)
+		}
+		s.wait()
+
+		select {
+		case <-sess.lost:
+			return false
+		default:
+		}
+	}
+}
+
+func (c *ClientCore) submitEvent(sess *session, s *scheduler, event common.FsEvent, verbose bool) {
+	s.submit(event, func() {
+		c.sendEvent(sess, event, verbose)
+	})
+}
+
+func (c *ClientCore) deferEvent(event common.FsEvent) {
+	c.lock.Lock()
+	c.deferred = append(c.deferred, event)
+	c.lock.Unlock()
+}
+
+func (c *ClientCore) syncConfig(conn network.Conn, cg *config.Config) {
+	data := cg.ToBytes()
+	WrappAndSend(conn, 0, common.SysInitSyncConfig, data, common.IsLastPackage)
 }
 
 // start watching fs
+// a view is watched on the disk below it and events are mapped into it
 func (c *ClientCore) startWatching() {
-	fw := fswatcher.NewFsWatcher(c.watchPath)
+	disk := c.fs
+	view, isView := c.fs.(fsops.View)
+	if isView {
+		disk = view.Disk()
+	}
+	fw := fswatcher.NewFsWatcher(disk, c.watchPath)
 	fschan := fw.GetChan()
 
 	// start watching
 	go fw.StartWatching()
 
 	log.Println(logtag, "start watching folder:", c.watchPath)
+	close(c.ready)
 
 	// dispatch fs event
 	for {
-		event := <-fschan
-		// log.Println(logtag, event)
-		c.eventChan <- event
+		select {
+		case event := <-fschan:
+			// log.Println(logtag, event)
+			if isView {
+				event.FileName = view.ToView(event.FileName)
+				if event.OriginFile != "" {
+					event.OriginFile = view.ToView(event.OriginFile)
+				}
+			}
+			c.eventChan <- event
+		case <-c.stop:
+			fw.Close()
+			return
+		}
 	}
 }
 
-func (c *ClientCore) startEventLoop(eventDone chan bool, initDone chan bool) {
+// dispatch events to a pool of workers
+// files on independent paths are transferred in parallel
+func (c *ClientCore) startEventLoop() {
 	log.Println(logtag, "start event loop...")
-	inited := false
-	if len(c.eventChan) == 0 && !inited {
-		initDone <- true
-		inited = true
-		WrappAndSend(c.client, common.SysInitFinished, []byte{}, common.IsLastPackage)
-	}
+	s := newScheduler(config.MaxConcurrentTransfers)
 	for {
-		if len(c.eventChan) == 0 && !inited {
-			initDone <- true
-			inited = true
-			WrappAndSend(c.client, common.SysInitFinished, []byte{}, common.IsLastPackage)
+		var event common.FsEvent
+		select {
+		case event = <-c.eventChan:
+		case <-c.stop:
+			return
 		}
-		event := <-c.eventChan
 		// log.Println(logtag, "process event:", event)
-		currentFilePath = event.FileName
-		path := fsops.RemoveRootPrefix(event.FileName, true)
 
 		// emit
 		if fsops.FileHasSuffix(event.FileName, ".DS_Store") ||
 			fsops.FileHasSuffix(event.FileName, ".swp") ||
-			fsops.FileHasSuffix(event.FileName, "~") {
+			fsops.FileHasSuffix(event.FileName, "~") ||
+			fsops.IsInternalPath(event.FileName) {
 			continue
 		}
-		switch event.Op {
-		case common.OpFetch:
-			// sync file
-			if fsops.IsFileExist(event.FileName) {
-				// rsync
-				// log.Println(logtag, "need rsync")
-				// get md5
-				checksum := common.GetFileMd5(event.FileName)
-				// package structure:
-				// +------------+--------------------+
-				// |checksum    |filename            |
-				// +------------+--------------------+
-				// <---16bytes-->
-
-				data := common.MergeArray(checksum, []byte(path))
-				// log.Println(logtag, "sync:", event.FileName)
-				WrappAndSend(c.client, common.SysSyncFileNotEmpty, data, common.IsLastPackage)
-			} else {
-				// direct file
-				log.Println(logtag, "fetch:", event.FileName)
-				WrappAndSend(c.client, common.SysSyncFileEmpty, []byte(path), common.IsLastPackage)
-			}
-		case common.OpCreate:
-			if inited {
-				log.Println(logtag, "create:", event.FileName)
-			}
-			WrappAndSend(c.client, common.SysOpCreate, []byte(path), common.IsLastPackage)
-		case common.OpModify:
-			if inited {
-				log.Println(logtag, "modify:", event.FileName)
-			}
-			WrappAndSend(c.client, common.SysOpModify, []byte(path), common.IsLastPackage)
-		case common.OpRename:
-			if inited {
-				log.Println(logtag, "rename from:", event.OriginFile)
-				log.Println(logtag, "to:", event.FileName)
-			}
-			data := RenameEventToBytes(event)
-			WrappAndSend(c.client, common.SysOpRename, []byte(data), common.IsLastPackage)
-		case common.OpRemove:
-			if inited {
-				log.Println(logtag, "remove:", event.FileName)
-			}
-			WrappAndSend(c.client, common.SysOpRemove, []byte(path), common.IsLastPackage)
-		case common.OpMkdir:
-			if inited {
-				log.Println(logtag, "mkdir:", event.FileName)
-			}
-			WrappAndSend(c.client, common.SysOpMkdir, []byte(path), common.IsLastPackage)
-		case common.OpChmod:
+		if event.Op == common.OpChmod {
 			// do nothing
 			continue
+		}
+		if c.ignored(event.FileName) || (event.OriginFile != "" && c.ignored(event.OriginFile)) {
+			continue
+		}
+		if c.Direction == SyncDownload {
+			// never sent, reverted once changes settle
+			select {
+			case c.revert <- true:
+			default:
+			}
+			continue
+		}
+
+		s.submit(event, func() {
+			c.processEvent(event, true)
+		})
+	}
+}
+
+// bring local folder of a download only client back in line with server
+// whenever it has been changed locally
+func (c *ClientCore) startReverting() {
+	for {
+		select {
+		case <-c.revert:
+		case <-c.stop:
+			return
+		}
+		// let a burst of changes settle, reverting causes a few more
+		select {
+		case <-time.After(config.RevertDelay):
+		case <-c.stop:
+			return
+		}
+		select {
+		case <-c.revert:
+		default:
+		}
+
+		c.lock.Lock()
+		sess := c.session
+		c.lock.Unlock()
+		if sess == nil {
+			// the next connection brings it in line anyway
+			continue
+		}
+		log.Println(logtag, "revert local changes...")
+		_, err := c.reconcile(sess, SyncDownload, nil)
+		common.ErrorHandleDebug(logtag, err)
+	}
+}
+
+// sync one event, or keep it for later if not connected
+func (c *ClientCore) processEvent(event common.FsEvent, verbose bool) {
+	c.lock.Lock()
+	sess := c.session
+	if sess == nil {
+		c.deferred = append(c.deferred, event)
+	}
+	c.lock.Unlock()
+
+	if sess != nil {
+		c.sendEvent(sess, event, verbose)
+	}
+}
+
+// send one event to server and wait until it is finished
+// @return: false if it failed
+func (c *ClientCore) sendEvent(sess *session, event common.FsEvent, verbose bool) bool {
+	path := fsops.RemoveRootPrefix(event.FileName, c.watchPath)
+	conn := sess.conn
+
+	t := sess.transfers.start(event.FileName)
+	switch event.Op {
+	case common.OpFetch:
+		// sync file
+		if fsops.IsFileExist(c.fs, event.FileName) {
+			// rsync
+			// log.Println(logtag, "need rsync")
+			// get md5
+			checksum := fsops.GetFileMd5(c.fs, event.FileName)
+			// package structure:
+			// +------------+--------------------+
+			// |checksum    |filename            |
+			// +------------+--------------------+
+			// <---16bytes-->
+
+			data := common.MergeArray(checksum, []byte(path))
+			// log.Println(logtag, "sync:", event.FileName)
+			WrappAndSend(conn, t.id, common.SysSyncFileNotEmpty, data, common.IsLastPackage)
+		} else {
+			// direct file
+			log.Println(logtag, "fetch:", event.FileName)
+			WrappAndSend(conn, t.id, common.SysSyncFileEmpty, []byte(path), common.IsLastPackage)
+		}
+	case common.OpCreate:
+		if verbose {
+			log.Println(logtag, "create:", event.FileName)
+		}
+		WrappAndSend(conn, t.id, common.SysOpCreate, []byte(path), common.IsLastPackage)
+	case common.OpModify:
+		if verbose {
+			log.Println(logtag, "modify:", event.FileName)
+		}
+		WrappAndSend(conn, t.id, common.SysOpModify, []byte(path), common.IsLastPackage)
+	case common.OpRename:
+		if verbose {
+			log.Println(logtag, "rename from:", event.OriginFile)
+			log.Println(logtag, "to:", event.FileName)
+		}
+		data := RenameEventToBytes(event, c.watchPath)
+		WrappAndSend(conn, t.id, common.SysOpRename, []byte(data), common.IsLastPackage)
+	case common.OpRemove:
+		if verbose {
+			log.Println(logtag, "remove:", event.FileName)
+		}
+		WrappAndSend(conn, t.id, common.SysOpRemove, []byte(path), common.IsLastPackage)
+	case common.OpMkdir:
+		if verbose {
+			log.Println(logtag, "mkdir:", event.FileName)
+		}
+		WrappAndSend(conn, t.id, common.SysOpMkdir, []byte(path), common.IsLastPackage)
+	default:
+		log.Panic(logtag, "unknown event")
+	}
+
+	// if handleCore finished current event
+	// transfer will be released
+	if !waitTransfer(sess, t) {
+		select {
+		case <-sess.lost:
+			// try again on next connection
+			c.deferEvent(event)
 		default:
-			log.Panic(logtag, "unknown event")
 		}
+		return false
+	}
+	return true
+}
 
-		// if handleCore finished current event
-		// eventDone will be released
-		<-eventDone
+// wait for the result of a transfer
+// a transfer without progress is considered lost together with its connection
+func waitTransfer(sess *session, t *transfer) bool {
+	for {
+		select {
+		case ok := <-t.done:
+			return ok
+		case <-time.After(config.TransferIdleTimeout / 4):
+			if t.idle() > config.TransferIdleTimeout {
+				// absPath belongs to handleCore once the transfer runs
+				log.Println(logtag, "transfer stalled:", t.id)
+				// handleCore returns and the transfer is aborted
+				sess.conn.Close()
+			}
+		}
 	}
 }
@@ -8,100 +8,242 @@ import (
 	"gcloudsync/internal/config"
 	"gcloudsync/internal/fsops"
 	"gcloudsync/internal/metadata"
+	"gcloudsync/internal/network"
 	"gcloudsync/internal/rsync"
+	"gcloudsync/internal/trash"
 
 	"log"
-	"reflect"
+	"path"
+	"strings"
+	"time"
 )
 
 var logtag string = "[Core]"
-var currentFilePath string
 
-var serverFileList = make(map[string]int)
+// which side of the connection a core is running on
+type Role int
 
-func WrappAndSend(base interface{}, op common.SysOp, data []byte, last uint32) error {
+const (
+	RoleClient Role = iota
+	RoleServer
+)
+
+// ops only one side of the connection should ever receive
+var serverOnlyOps = map[common.SysOp]bool{
+	common.SysInit: true, common.SysInitSyncConfig: true, common.SysInitFinished: true,
+	common.SysOpCreate: true, common.SysOpRemove: true, common.SysOpRename: true, common.SysOpMkdir: true,
+}
+var clientOnlyOps = map[common.SysOp]bool{
+	common.SysDone: true, common.SysInitUpload: true,
+	common.SysInitSyncFolder: true, common.SysInitSyncFile: true,
+}
+
+// ops a read only client may not send, as they write to server
+var writeOps = map[common.SysOp]bool{
+	common.SysOpCreate: true, common.SysOpRemove: true, common.SysOpRename: true, common.SysOpMkdir: true,
+	common.SysOpModify: true, common.SysSyncFileHash: true, common.SysSyncFileDirect: true,
+	common.SysSyncReformFile: true,
+}
+
+// ops whose data may be larger than one package, sent in pieces by sendPieces
+// and put together again before they are handled
+var piecedOps = map[common.SysOp]bool{
+	common.SysSyncGenerateDiff: true, common.SysSyncGenerateChunkDiff: true, common.SysSyncReformFile: true,
+	common.SysListFiles: true,
+}
+
+// ops whose whole data is a path relative to the synced folder
+var pathOps = map[common.SysOp]bool{
+	common.SysInitSyncFolder: true, common.SysInitSyncFile: true, common.SysSyncFileEmpty: true,
+	common.SysOpCreate: true, common.SysOpRemove: true, common.SysOpMkdir: true, common.SysOpModify: true,
+}
+
+// whether the paths a package carries stay inside the synced folder
+// a path escaping it would let peer write anywhere on this side
+func validPaths(op common.SysOp, data []byte) bool {
+	switch {
+	case pathOps[op]:
+		return validRelPath(string(data))
+	case op == common.SysSyncFileNotEmpty:
+		return len(data) >= 16 && validRelPath(string(data[16:]))
+	case op == common.SysOpRename:
+		event, err := BytesToRenameEvent(data)
+		return err == nil && validRelPath(event.FileName) && validRelPath(event.OriginFile)
+	}
+	return true
+}
+
+func roleAccepts(role Role, op common.SysOp) bool {
+	if role == RoleClient {
+		return !serverOnlyOps[op]
+	}
+	return !clientOnlyOps[op]
+}
+
+// @tid: id of the transfer the package belongs to, 0 if none
+func WrappAndSend(conn network.Conn, tid uint32, op common.SysOp, data []byte, last uint32) error {
 	// get header
-	header := metadata.NewHeader(uint32(len(data)), op, last)
+	header := metadata.NewHeader(uint32(len(data)), op, last, tid)
+	header.SetChecksum(data)
 	sendByte, err := header.ToByteArray()
-	common.ErrorHandleDebug(logtag, err)
+	if err != nil {
+		return err
+	}
 
 	// merge to array
 	sendByte = common.MergeArray(sendByte, data)
 
 	// log.Println(logtag, "send:", string(data), "len:", len(data))
 
-	in := make([]reflect.Value, 1)
-	in[0] = reflect.ValueOf(sendByte)
-	reflect.ValueOf(base).MethodByName("Send").Call(in)
-
-	return err
+	// every transfer has its own stream, others go to control stream
+	return conn.Send(tid, sendByte)
 }
 
-// main loog for data exchanging
-// @base: interface for server or client
-// @bufferChan: buffer channel for comming data
+// main loog for data exchanging, returns when connection is closed
+// @conn: connection to peer
+// @role: whether running on client or server
+// @fsys: filesystem the synced folder lives on
+// @root: root path of the synced folder on this side, keeps trash and staging
+// files even when client selects a folder below it
+// @readOnlyFolders: folders below root refusing writes of any client, server only
 // @done: a bool channel represent whether everything is done
-func handleCore(base interface{}, bufferChan chan []byte, done chan bool,
-	eventChan chan common.FsEvent, eventDone chan bool) {
+// @transfers: files in flight on this connection
+func handleCore(conn network.Conn, role Role, fsys fsops.FS, root string, readOnlyFolders []string, done chan bool,
+	eventChan chan common.FsEvent, transfers *transferTable) {
 
+	// data received but not yet parsed, for each stream
+	buffers := make(map[uint32][]byte)
 	var buffer []byte
 	var header metadata.Header
 	var data []byte
 	var err error
-	var isClient bool
-	var pathPrefix string
-
-	baseTypeString := reflect.TypeOf(base).String()
-	// log.Println(logtag, "current base:", baseTypeString)
-
-	if baseTypeString == "*network.TCPClient" {
-		isClient = true
-		pathPrefix = config.ClientRootPath
-	} else {
-		isClient = false
-		pathPrefix = config.ServerRootPath
-	}
+	// files exist on server, recorded by client during init
+	serverFileList := make(map[string]int)
+	// client agreed on keys of an encrypted folder
+	keyChecked := false
+	// folder synced on this connection, root or a named folder below it
+	folder := root
+	// client declared it never writes to server
+	readOnly := false
+	// folder is read only on server, whatever client declares
+	folderReadOnly := isReadOnlyFolder(root, folder, readOnlyFolders)
+	// checksum, diff and reform run off this loop, in order for each path
+	deltaWork := newScheduler(config.MaxConcurrentTransfers)
+	defer deltaWork.wait()
 
 	// main loop for data processing
 	for {
-		tempBuffer := <-bufferChan
-		buffer = common.MergeArray(buffer, tempBuffer)
+		frame, ok := <-conn.Frames()
+		if !ok {
+			log.Println(logtag, "connection closed:", conn.RemoteAddr())
+			return
+		}
+		buffer = append(buffers[frame.Stream], frame.Data...)
+		conn.Release(frame)
 
-		// log.Println(logtag, "bufferlen:", len(tempBuffer))
+		// log.Println(logtag, "bufferlen:", len(frame.Data))
 		for {
+			size := len(buffer)
 			buffer, header, data, err = getOnePackageFromBuffer(buffer)
-			if err != nil {
-				// log.Println(logtag, "invalid package")
+			if err == metadata.ErrShortBuffer {
+				// wait for more data
 				break
 			}
+			// peer may send more once a package is taken out, not before,
+			// so that partial packages can not pile up
+			conn.Consumed(size - len(buffer))
+			if err != nil {
+				// damaged frame has been dropped, go on with the next one
+				log.Println(logtag, "protocol error:", err)
+				continue
+			}
+			if !roleAccepts(role, header.Tag) {
+				log.Println(logtag, "protocol error: unexpected op", header.Tag)
+				continue
+			}
+			tid := header.Transfer
+			if tid != 0 {
+				transfers.touch(tid)
+			}
+			if !validPaths(header.Tag, data) {
+				log.Println(logtag, "protocol error: invalid path for op", header.Tag)
+				if tid != 0 {
+					WrappAndSend(conn, tid, common.SysSyncFailed, []byte("invalid path"), common.IsLastPackage)
+					transfers.finish(tid, false)
+				}
+				continue
+			}
+			if role == RoleServer && (readOnly || folderReadOnly) && writeOps[header.Tag] {
+				log.Println(logtag, "refused write of read only client:", conn.RemoteAddr())
+				if header.Last == common.IsLastPackage {
+					WrappAndSend(conn, tid, common.SysSyncFailed, []byte("read only"), common.IsLastPackage)
+				}
+				continue
+			}
+			if piecedOps[header.Tag] && tid != 0 {
+				t, ok := transfers.find(tid)
+				if header.Last != common.IsLastPackage {
+					// pieces are only taken for transfers in flight, and no more than fit one buffer
+					if !ok {
+						log.Println(logtag, "protocol error: pieces of unknown transfer", tid)
+						continue
+					}
+					if t.overflow || len(t.pieces)+len(data) > config.MaxBufferSize {
+						t.overflow = true
+						t.pieces = nil
+						continue
+					}
+					t.pieces = append(t.pieces, data...)
+					continue
+				}
+				if ok && t.overflow {
+					t.overflow = false
+					log.Println(logtag, "pieces too large for transfer:", tid)
+					if header.Tag == common.SysSyncReformFile {
+						// whole file is streamed instead of a diff
+						finishReceiving(conn, t, transfers, folder, errors.New("diff too large"))
+					} else {
+						WrappAndSend(conn, tid, common.SysSyncFailed, []byte("too large"), common.IsLastPackage)
+						transfers.finish(tid, false)
+					}
+					continue
+				}
+				if ok && t.pieces != nil {
+					data = append(t.pieces, data...)
+					t.pieces = nil
+				}
+			}
 			// processing different system event
 			// log.Println(logtag, "event tag:", header.Tag)
 			switch header.Tag {
 			case common.SysInit:
 				// server respond client init
+				if !keyChecked && isEncrypted(fsys, folder) {
+					log.Println(logtag, "refused client without encryption key:", conn.RemoteAddr())
+					conn.Close()
+					continue
+				}
 				log.Println(logtag, "client initing...")
 				// get all file list and send to client
-				flist := fsops.GetAllFile(config.ServerRootPath)
-				common.ErrorHandleDebug(logtag, err)
+				flist := fsops.GetAllFile(fsys, folder)
 				// for each file and folder, sync to client
 				for _, filePath := range flist {
-					syncOneFileSend(fsops.RemoveRootPrefix(filePath, false), base, isClient)
+					syncOneFileSend(fsys, fsops.RemoveRootPrefix(filePath, folder), conn, folder)
 				}
-				WrappAndSend(base, common.SysInitUpload, []byte{}, common.IsLastPackage)
+				WrappAndSend(conn, 0, common.SysInitUpload, []byte{}, common.IsLastPackage)
 
 			case common.SysInitUpload:
 				// for files not exist in server
 				// upload to keep in consistance
 				log.Println(logtag, "upload new files...")
-				flist := fsops.GetAllFile(config.ClientRootPath)
-				common.ErrorHandleDebug(logtag, err)
+				flist := fsops.GetAllFile(fsys, folder)
 				var op common.FsOp
 				// add to event loop
 				for _, filePath := range flist {
 					if serverFileList[filePath] == 1 {
 						continue
 					}
-					if ok, _ := fsops.IsFolder(filePath); ok {
+					if ok, _ := fsops.IsFolder(fsys, filePath); ok {
 						op = common.OpMkdir
 					} else {
 						op = common.OpCreate
@@ -113,26 +255,30 @@ func handleCore(base interface{}, bufferChan chan []byte, done chan bool,
 				done <- true
 
 			case common.SysInitSyncConfig:
-				cg := config.GetConfig()
-				cg.ConfigFromBytes(data)
-				log.Println(logtag, "config sync finished.")
-
-				config.PrintCurrentConfig()
-				WrappAndSend(base, common.SysDone, []byte{}, common.IsLastPackage)
+				peer := new(config.Config)
+				if err := peer.ConfigFromBytes(data); err != nil {
+					log.Println(logtag, "protocol error:", err)
+				} else {
+					// only touched by this goroutine once the connection is running
+					transfers.blockSize, transfers.deltaMode = peer.TruncateBlockSize, peer.DeltaMode
+					log.Println(logtag, "config sync finished, block size:", peer.TruncateBlockSize,
+						"delta mode:", peer.DeltaMode)
+				}
+				WrappAndSend(conn, 0, common.SysDone, []byte{}, common.IsLastPackage)
 
 			case common.SysInitSyncFolder:
-				absPath := pathPrefix + string(data)
+				absPath := folder + string(data)
 
 				serverFileList[absPath] = 1
 
-				if !fsops.IsFileExist(absPath) {
-					fsops.Makedir(absPath)
+				if !fsops.IsFileExist(fsys, absPath) {
+					fsops.Makedir(fsys, absPath)
 				}
 
 			case common.SysInitSyncFile:
 				// entry for transfering file
 				// log.Println(logtag, "file to be transfered:", string(data))
-				absPath := pathPrefix + string(data)
+				absPath := folder + string(data)
 
 				serverFileList[absPath] = 1
 
@@ -148,203 +294,484 @@ func handleCore(base interface{}, bufferChan chan []byte, done chan bool,
 
 			case common.SysSyncFileEmpty:
 				// transfer the file directly
-				path := string(data)
-				absPath := pathPrefix + path
-				directFileSend(base, absPath)
+				t := transfers.get(tid)
+				t.absPath = folder + string(data)
+				// send in background so that other streams keep going
+				go directFileSend(fsys, conn, t, transfers, folder)
 
 			case common.SysSyncFileNotEmpty:
 				// receive checksum from sender
+				if len(data) < 16 {
+					log.Println(logtag, "protocol error: invalid checksum package")
+					continue
+				}
 				checksum := data[0:16]
 				path := string(data[16:])
-				absPath := pathPrefix + path
+				t := transfers.get(tid)
+				t.absPath = folder + path
 
 				// validate local file
-				md5 := common.GetFileMd5(absPath)
+				md5 := fsops.GetFileMd5(fsys, t.absPath)
 				if bytes.Equal(md5, checksum) {
 					// no need to sync
 					// log.Println(logtag, absPath, "no need to sync")
-					WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+					WrappAndSend(conn, tid, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+					transfers.finish(tid, true)
 				} else {
 					// apply rsync algo
-					log.Println(logtag, absPath, "need rsync")
-					currentFilePath = absPath
-					WrappAndSend(base, common.SysOpModify, []byte(path), common.IsLastPackage)
+					log.Println(logtag, t.absPath, "need rsync")
+					WrappAndSend(conn, tid, common.SysOpModify, []byte(path), common.IsLastPackage)
 				}
 
-			case common.SysSyncFileDirect:
-				// log.Println(logtag, "write file:", currentFilePath, "datalen:", len(data))
-				_, err := fsops.Write(currentFilePath, data, 0)
+			case common.SysSyncFileHash:
+				// a direct file transfer begins
+				// stage incoming data until the whole file is verified
+				t := transfers.get(tid)
+				fsops.DiscardStagingFile(fsys, t.stagingFile)
+				t.stagingFile, err = fsops.CreateStagingFile(fsys, root)
 				common.ErrorHandleDebug(logtag, err)
+				t.expectedHash = append([]byte{}, data...)
+				t.received = 0
+
+			case common.SysSyncFileDirect:
+				t := transfers.get(tid)
+				// log.Println(logtag, "write file:", t.absPath, "datalen:", len(data))
+				if t.stagingFile != nil {
+					_, err := t.stagingFile.WriteAt(data, t.received)
+					common.ErrorHandleDebug(logtag, err)
+					t.received = t.received + int64(len(data))
+				}
 				if header.Last == common.IsLastPackage {
-					fsops.CloseCurrentFile()
-					if eventChan != nil {
-						eventDone <- true
-					} else {
-						// server receive file
-						WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+					err = errors.New("transfer not started")
+					if t.stagingFile != nil {
+						err = fsops.CommitStagingFile(fsys, t.stagingFile, t.absPath, t.expectedHash)
+						t.stagingFile = nil
 					}
+					finishReceiving(conn, t, transfers, folder, err)
 				}
+
 			case common.SysSyncFinished:
-				log.Println(logtag, "sync finished:", currentFilePath)
-				if eventDone != nil {
-					eventDone <- true
+				if t := transfers.finish(tid, true); t != nil {
+					log.Println(logtag, "sync finished:", t.absPath)
 				}
 
+			case common.SysSyncFailed:
+				// peer gave up receiving the file
+				log.Println(logtag, "sync failed on peer:", string(data))
+				transfers.finish(tid, false)
+
 			case common.SysOpCreate:
-				absPath := pathPrefix + string(data)
-				// 1. touch
-				err := fsops.Create(absPath)
-				log.Println(logtag, "create:", absPath)
-				common.ErrorHandleDebug(logtag, err)
-				// 2. sync
-				currentFilePath = absPath
-				WrappAndSend(base, common.SysSyncFileEmpty, []byte(string(data)), common.IsLastPackage)
+				// file will be created once its content arrives
+				t := transfers.get(tid)
+				t.absPath = folder + string(data)
+				log.Println(logtag, "create:", t.absPath)
+				WrappAndSend(conn, tid, common.SysSyncFileEmpty, data, common.IsLastPackage)
 
 			case common.SysOpRemove:
-				absPath := pathPrefix + string(data)
-				err := fsops.Delete(absPath)
+				// keep a copy in trash in case of mistaken deletion
+				absPath := folder + string(data)
+				err := trash.MoveToTrash(fsys, root, absPath)
 				log.Println(logtag, "remove:", absPath)
 				common.ErrorHandleDebug(logtag, err)
-				WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+				WrappAndSend(conn, tid, common.SysSyncFinished, []byte{}, common.IsLastPackage)
 
 			case common.SysOpMkdir:
 				// generate new folder
-				absPath := pathPrefix + string(data)
-				err = fsops.Makedir(absPath)
+				absPath := folder + string(data)
+				err = fsops.Makedir(fsys, absPath)
 				log.Println(logtag, "mkdir:", absPath)
 				common.ErrorHandleDebug(logtag, err)
-				WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+				WrappAndSend(conn, tid, common.SysSyncFinished, []byte{}, common.IsLastPackage)
 			case common.SysOpRename:
-				event := BytesToRenameEvent(data)
-				new := pathPrefix + event.FileName
-				old := pathPrefix + event.OriginFile
+				event, err := BytesToRenameEvent(data)
+				if err != nil {
+					log.Println(logtag, "protocol error:", err)
+					WrappAndSend(conn, tid, common.SysSyncFailed, []byte{}, common.IsLastPackage)
+					continue
+				}
+				new := folder + event.FileName
+				old := folder + event.OriginFile
 				log.Println(logtag, "rename from:", old)
 				log.Println(logtag, "to:", new)
-				err := fsops.Rename(old, new)
+				err = fsops.Rename(fsys, old, new)
 				common.ErrorHandleDebug(logtag, err)
-				WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+				WrappAndSend(conn, tid, common.SysSyncFinished, []byte{}, common.IsLastPackage)
 
 			case common.SysOpModify:
 				// both client and server can get here
 				// generate checksum
-				path := string(data)
-				absPath := pathPrefix + path
+				t := transfers.get(tid)
+				t.absPath = folder + string(data)
 
 				// if file not exist, create one
-				if fsops.IsFileExist(absPath) {
-					fsops.Create(absPath)
+				if !fsops.IsFileExist(fsys, t.absPath) {
+					fsops.Create(fsys, t.absPath)
 				}
 
-				currentFilePath = absPath
-				cks := rsync.GetCheckSums(absPath)
-
-				log.Println(logtag, "modifying:", absPath)
-				WrappAndSend(base, common.SysSyncGenerateDiff, cks, common.IsLastPackage)
+				log.Println(logtag, "modifying:", t.absPath)
+				blockSize, deltaMode := transfers.blockSize, transfers.deltaMode
+				deltaWork.submit(deltaEvent(t), func() {
+					stop := keepBusy(conn, transfers, tid)
+					if deltaMode == config.DeltaCDC {
+						list, err := rsync.GetChunkList(fsys, t.absPath, blockSize)
+						common.ErrorHandleDebug(logtag, err)
+						stop()
+						sendPieces(conn, transfers, tid, common.SysSyncGenerateChunkDiff, list)
+					} else {
+						cks := rsync.GetCheckSums(fsys, t.absPath, blockSize)
+						stop()
+						sendPieces(conn, transfers, tid, common.SysSyncGenerateDiff, cks)
+					}
+				})
 
 			case common.SysSyncGenerateDiff:
-				diff, err := rsync.GetDiff(data, currentFilePath)
-				common.ErrorHandleDebug(logtag, err)
-
-				WrappAndSend(base, common.SysSyncReformFile, diff, common.IsLastPackage)
+				t, ok := transfers.find(tid)
+				if !ok {
+					log.Println(logtag, "dropped package of unknown transfer:", tid)
+					continue
+				}
+				table, blockSize := data, transfers.blockSize
+				deltaWork.submit(deltaEvent(t), func() {
+					stop := keepBusy(conn, transfers, tid)
+					diff, err := rsync.GetDiff(fsys, table, t.absPath, blockSize)
+					common.ErrorHandleDebug(logtag, err)
+
+					// package structure:
+					// +------------+--------------------+
+					// |checksum    |diff                |
+					// +------------+--------------------+
+					// <---16bytes-->
+					// checksum is md5 of the whole file expected after reform
+					checksum := fsops.GetFileMd5(fsys, t.absPath)
+					stop()
+					sendPieces(conn, transfers, tid, common.SysSyncReformFile, common.MergeArray(checksum, diff))
+				})
+
+			case common.SysSyncGenerateChunkDiff:
+				// same as above, against content defined chunks of peer
+				t, ok := transfers.find(tid)
+				if !ok {
+					log.Println(logtag, "dropped package of unknown transfer:", tid)
+					continue
+				}
+				list, blockSize := data, transfers.blockSize
+				deltaWork.submit(deltaEvent(t), func() {
+					stop := keepBusy(conn, transfers, tid)
+					diff, err := rsync.GetChunkDiff(fsys, list, t.absPath, blockSize)
+					common.ErrorHandleDebug(logtag, err)
+					checksum := fsops.GetFileMd5(fsys, t.absPath)
+					stop()
+					sendPieces(conn, transfers, tid, common.SysSyncReformFile, common.MergeArray(checksum, diff))
+				})
 
 			case common.SysSyncReformFile:
+				t, ok := transfers.find(tid)
+				if !ok {
+					log.Println(logtag, "dropped package of unknown transfer:", tid)
+					continue
+				}
+				reform, blockSize, prefix := data, transfers.blockSize, folder
+				deltaWork.submit(deltaEvent(t), func() {
+					stop := keepBusy(conn, transfers, tid)
+					err := errors.New("invalid reform package")
+					if len(reform) >= 16 {
+						err = rsync.ReformFile(fsys, reform[16:], t.absPath, root, reform[0:16], blockSize)
+					}
+					stop()
+					finishReceiving(conn, t, transfers, prefix, err)
+				})
+
+			case common.SysKeyCheck:
+				if role == RoleServer {
+					if readOnly || folderReadOnly {
+						// nothing is stored for a read only client
+						data = nil
+					}
+					check := serverKeyCheck(fsys, folder, data)
+					keyChecked = len(check) > 0
+					WrappAndSend(conn, tid, common.SysKeyCheck, check, common.IsLastPackage)
+				} else {
+					receiveReply(transfers, tid, data)
+				}
 
-				err := rsync.ReformFile(data, currentFilePath)
-				log.Println(logtag, "sync finished:", currentFilePath)
-				common.ErrorHandleDebug(logtag, err)
+			case common.SysListFiles:
+				if role == RoleServer {
+					if !keyChecked && isEncrypted(fsys, folder) {
+						log.Println(logtag, "refused client without encryption key:", conn.RemoteAddr())
+						conn.Close()
+						continue
+					}
+					listing := EncodeListing(listFolder(fsys, folder))
+					go sendPieces(conn, transfers, tid, common.SysListFiles, listing)
+				} else {
+					receiveReply(transfers, tid, data)
+				}
 
-				WrappAndSend(base, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+			case common.SysSelectFolder:
+				if role == RoleServer {
+					// everything from now on happens in the named folder
+					reply := ""
+					lock := isReadOnlyFolder(root, root+"/"+string(data), readOnlyFolders)
+					if path, err := selectFolder(fsys, root, string(data), !readOnly && !lock); err != nil {
+						log.Println(logtag, "select folder failed:", err)
+						reply = err.Error()
+					} else {
+						log.Println(logtag, "select folder:", path)
+						folder = path
+						folderReadOnly = lock
+						keyChecked = false
+						serverFileList = make(map[string]int)
+					}
+					WrappAndSend(conn, tid, common.SysSelectFolder, []byte(reply), common.IsLastPackage)
+				} else {
+					receiveReply(transfers, tid, data)
+				}
 
-				if eventDone != nil {
-					eventDone <- true
+			case common.SysReadOnly:
+				if role == RoleServer {
+					// kept for the rest of the connection
+					log.Println(logtag, "read only client:", conn.RemoteAddr())
+					readOnly = true
+					WrappAndSend(conn, tid, common.SysReadOnly, []byte{}, common.IsLastPackage)
+				} else {
+					receiveReply(transfers, tid, data)
 				}
 
+			case common.SysSyncBusy:
+				// transfer has been touched above, peer is still working on it
+
 			case common.SysDone:
 				done <- true
 			default:
-				log.Panic(logtag, "unknown op")
+				log.Println(logtag, "protocol error: unknown op", header.Tag)
+			}
+		}
+
+		if len(buffer) == 0 {
+			delete(buffers, frame.Stream)
+		} else {
+			buffers[frame.Stream] = buffer
+		}
+	}
+
+}
+
+// the receiving side of a file reports the result to peer
+// @err: error while committing the received file, nil if succeeded
+func finishReceiving(conn network.Conn, t *transfer, transfers *transferTable, pathPrefix string, err error) {
+	if err == nil {
+		t.retries = 0
+		log.Println(logtag, "sync finished:", t.absPath)
+		WrappAndSend(conn, t.id, common.SysSyncFinished, []byte{}, common.IsLastPackage)
+		transfers.finish(t.id, true)
+		return
+	}
+
+	log.Println(logtag, "verification failed:", t.absPath, err)
+	if retryWholeFile(conn, t, pathPrefix) {
+		return
+	}
+	WrappAndSend(conn, t.id, common.SysSyncFailed,
+		[]byte(t.absPath[len(pathPrefix):]), common.IsLastPackage)
+	transfers.finish(t.id, false)
+}
+
+// keep a transfer alive on both sides while local work on it runs,
+// so that a slow checksum, diff or reform is not taken for a stall by peer
+// @return: stops the keep alive once the work is done
+func keepBusy(conn network.Conn, transfers *transferTable, tid uint32) (stop func()) {
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(config.TransferIdleTimeout / 4):
+				transfers.touch(tid)
+				WrappAndSend(conn, tid, common.SysSyncBusy, []byte{}, common.IsLastPackage)
 			}
 		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// key of delta work on the file of a transfer, see deltaWork in handleCore
+func deltaEvent(t *transfer) common.FsEvent {
+	return common.FsEvent{Op: common.OpModify, FileName: t.absPath}
+}
+
+// folder below root a client asked for
+// @name: relative path of the folder
+// @create: create the folder if it does not exist
+func selectFolder(fsys fsops.FS, root string, name string, create bool) (string, error) {
+	if !validRelPath("/" + name) {
+		return "", errors.New("invalid folder name: " + name)
+	}
+	path := root + "/" + name
+	if !fsops.IsFileExist(fsys, path) {
+		if !create {
+			return "", errors.New("no such folder: " + name)
+		}
+		if err := fsops.MakedirAll(fsys, path); err != nil {
+			return "", err
+		}
 	}
+	if ok, _ := fsops.IsFolder(fsys, path); !ok {
+		return "", errors.New("not a folder: " + name)
+	}
+	return path, nil
+}
 
+// whether folder is one of readOnly below root or inside one of them
+func isReadOnlyFolder(root string, folder string, readOnly []string) bool {
+	folder = path.Clean(folder)
+	for _, name := range readOnly {
+		locked := path.Clean(root + "/" + name)
+		if locked == "." || folder == locked || strings.HasPrefix(folder, locked+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// answer of peer to a request which is not a file transfer
+func receiveReply(transfers *transferTable, tid uint32, data []byte) {
+	t := transfers.get(tid)
+	t.reply = append([]byte{}, data...)
+	transfers.finish(tid, true)
 }
 
 // sync one file with peer
 // @path: relative path of the file or folder
-func syncOneFileSend(path string, base interface{}, isClient bool) {
-	var ok bool
-	var absPath string
-	if isClient {
-		absPath = config.ClientRootPath + path
-	} else {
-		absPath = config.ServerRootPath + path
-	}
+func syncOneFileSend(fsys fsops.FS, path string, conn network.Conn, root string) {
+	absPath := root + path
 
-	ok, _ = fsops.IsFolder(absPath)
+	ok, _ := fsops.IsFolder(fsys, absPath)
 
 	if ok {
-		WrappAndSend(base, common.SysInitSyncFolder, []byte(path), common.IsLastPackage)
+		WrappAndSend(conn, 0, common.SysInitSyncFolder, []byte(path), common.IsLastPackage)
 	} else {
-		WrappAndSend(base, common.SysInitSyncFile, []byte(path), common.IsLastPackage)
+		WrappAndSend(conn, 0, common.SysInitSyncFile, []byte(path), common.IsLastPackage)
+	}
+}
+
+// ask peer to transfer the whole file again after verification failed
+// @return: false if retry limit is reached and the file should be reported as failed
+func retryWholeFile(conn network.Conn, t *transfer, pathPrefix string) bool {
+	if t.retries >= config.MaxSyncRetry {
+		log.Println(logtag, "give up syncing after", t.retries, "retries:", t.absPath)
+		return false
 	}
+	t.retries = t.retries + 1
+	log.Println(logtag, "retry with whole file transfer:", t.absPath)
+	WrappAndSend(conn, t.id, common.SysSyncFileEmpty, []byte(t.absPath[len(pathPrefix):]), common.IsLastPackage)
+	return true
 }
 
+// split one package from buffer
+// on damaged data, remainBuffer skips to where the next header may start
 func getOnePackageFromBuffer(buffer []byte) (remainBuffer []byte, header metadata.Header, packageData []byte, err error) {
 	header, err = metadata.GetHeaderFromData(buffer)
 	// common.ErrorHandleDebug(logtag, err)
 	// log.Println(logtag, "buffer len:", len(buffer))
 
 	// the error case include:
-	if err != nil {
+	if err == metadata.ErrShortBuffer {
 		// 1. data buffer size smaller than header
-		// 2. invalid signiture
 		return buffer, header, nil, err
+	} else if err != nil {
+		// 2. invalid signiture, version or length, resync
+		return buffer[metadata.NextHeaderOffset(buffer):], header, nil, err
 	}
 
-	if len(buffer) < int(header.Length)+24 {
+	size := metadata.HeaderSize
+	if len(buffer) < int(header.Length)+size {
 		// 3. expect more data
-		return buffer, header, nil, errors.New("expect more")
+		return buffer, header, nil, metadata.ErrShortBuffer
 	}
 
-	packageData = buffer[24 : header.Length+24]
-	remainBuffer = buffer[header.Length+24:]
+	packageData = buffer[size : int(header.Length)+size]
+	if err = header.Verify(packageData); err != nil {
+		// 4. damaged header or payload, resync
+		return buffer[metadata.NextHeaderOffset(buffer):], header, nil, err
+	}
+	remainBuffer = buffer[int(header.Length)+size:]
 
 	return remainBuffer, header, packageData, nil
 }
 
-func directFileSend(base interface{}, absPath string) {
-	databuff := make([]byte, config.MaxBufferSize)
+func directFileSend(fsys fsops.FS, conn network.Conn, t *transfer, transfers *transferTable, pathPrefix string) {
+	file, err := fsops.OpenRead(fsys, t.absPath)
+	if err != nil {
+		// nothing to send, let peer give up
+		common.ErrorHandleDebug(logtag, err)
+		WrappAndSend(conn, t.id, common.SysSyncFailed,
+			[]byte(t.absPath[len(pathPrefix):]), common.IsLastPackage)
+		transfers.finish(t.id, false)
+		return
+	}
+	defer file.Close()
 
-	fileSize, err := fsops.GetFileSize(absPath)
+	fileSize, err := fsops.GetFileSize(fsys, t.absPath)
 	common.ErrorHandleDebug(logtag, err)
 
+	// no need to allocate more than the file size
+	buffSize := config.MaxPackageSize
+	if fileSize < int64(buffSize) {
+		buffSize = int(fileSize)
+	}
+	databuff := make([]byte, buffSize)
+
+	// send checksum ahead so that receiver can verify the whole file
+	checksum := fsops.GetFileMd5(fsys, t.absPath)
+	WrappAndSend(conn, t.id, common.SysSyncFileHash, checksum, common.IsLastPackage)
+
 	// start sending file
-	var count int64
-	count = 0
+	t.sent = 0
 
 	// log.Println(logtag, "sync:", path)
 	for {
-		n, _ := fsops.ReadOnce(absPath, databuff, count)
-		count = count + int64(n)
+		n, err := file.ReadAt(databuff, t.sent)
+		t.sent = t.sent + int64(n)
 
 		filedata := databuff[0:n]
-		if n == int(fileSize) {
-			// read once is enough
-			WrappAndSend(base, common.SysSyncFileDirect, filedata, common.IsLastPackage)
+		if t.sent >= fileSize || err != nil {
+			// read finished
+			WrappAndSend(conn, t.id, common.SysSyncFileDirect, filedata, common.IsLastPackage)
 			break
 		} else {
-			WrappAndSend(base, common.SysSyncFileDirect, filedata, common.IsNotLastPacage)
-			if count == fileSize {
-				log.Println(logtag, absPath, "read finished")
-				WrappAndSend(base, common.SysSyncFileDirect, []byte{}, common.IsLastPackage)
-				break
-			}
+			WrappAndSend(conn, t.id, common.SysSyncFileDirect, filedata, common.IsNotLastPacage)
 		}
+		// do not read ahead more than one package
+		if err := conn.WaitQueued(t.id, config.MaxPackageSize); err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			break
+		}
+		t.touch()
 	}
-	fsops.CloseCurrentFile()
 }
 
-func RenameEventToBytes(fe common.FsEvent) (b []byte) {
+// send data of one of piecedOps, at most one package is queued at a time
+// runs off the receive loop so that other streams keep going
+func sendPieces(conn network.Conn, transfers *transferTable, tid uint32, op common.SysOp, data []byte) {
+	for len(data) > config.MaxPackageSize {
+		WrappAndSend(conn, tid, op, data[:config.MaxPackageSize], common.IsNotLastPacage)
+		data = data[config.MaxPackageSize:]
+		if err := conn.WaitQueued(tid, config.MaxPackageSize); err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			return
+		}
+		transfers.touch(tid)
+	}
+	WrappAndSend(conn, tid, op, data, common.IsLastPackage)
+}
+
+func RenameEventToBytes(fe common.FsEvent, root string) (b []byte) {
 	if fe.Op == common.OpRename {
 		// package structure:
 		// +-----+----------+-----+----------+
@@ -355,8 +782,8 @@ func RenameEventToBytes(fe common.FsEvent) (b []byte) {
 		var buf bytes.Buffer
 		b := make([]byte, 4)
 
-		new := fsops.RemoveRootPrefix(fe.FileName, true)
-		old := fsops.RemoveRootPrefix(fe.OriginFile, true)
+		new := fsops.RemoveRootPrefix(fe.FileName, root)
+		old := fsops.RemoveRootPrefix(fe.OriginFile, root)
 		binary.BigEndian.PutUint32(b, uint32(len(new)))
 		buf.Write([]byte(b))
 		buf.Write([]byte(new))
@@ -369,16 +796,35 @@ func RenameEventToBytes(fe common.FsEvent) (b []byte) {
 	return b
 }
 
-func BytesToRenameEvent(b []byte) (fe common.FsEvent) {
-
-	newlen := int(binary.BigEndian.Uint32(b[0:4]))
-	new := string(b[4 : 4+newlen])
-	oldlen := int(binary.BigEndian.Uint32(b[4+newlen : 8+newlen]))
-	old := string(b[8+newlen : 8+newlen+oldlen])
+// decode rename package from peer
+func BytesToRenameEvent(b []byte) (fe common.FsEvent, err error) {
+	new, rest, err := splitLengthPrefixed(b)
+	if err != nil {
+		return fe, err
+	}
+	old, rest, err := splitLengthPrefixed(rest)
+	if err != nil {
+		return fe, err
+	}
+	if len(rest) != 0 {
+		return fe, errors.New("trailing data in rename package")
+	}
 
-	fe.FileName = new
-	fe.OriginFile = old
+	fe.FileName = string(new)
+	fe.OriginFile = string(old)
 	fe.Op = common.OpRename
 
-	return
+	return fe, nil
+}
+
+// split a field prefixed by its 4 bytes length from the rest of b
+func splitLengthPrefixed(b []byte) (field []byte, rest []byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short rename package")
+	}
+	n := uint64(binary.BigEndian.Uint32(b[0:4]))
+	if n > uint64(len(b)-4) {
+		return nil, nil, errors.New("invalid path length in rename package")
+	}
+	return b[4 : 4+n], b[4+n:], nil
 }
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"bytes"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/network"
+	"testing"
+)
+
+func FuzzBytesToRenameEvent(f *testing.F) {
+	root := "/root"
+	for _, paths := range [][2]string{
+		{"/new.txt", "/old.txt"},
+		{"/dir/sub", "/dir2"},
+		{"", ""},
+	} {
+		event := common.FsEvent{Op: common.OpRename, FileName: root + paths[0], OriginFile: root + paths[1]}
+		f.Add(RenameEventToBytes(event, root))
+	}
+	f.Add([]byte{0, 0, 0, 9, 'a'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		event, err := BytesToRenameEvent(b)
+		if err != nil {
+			return
+		}
+		event.FileName = root + event.FileName
+		event.OriginFile = root + event.OriginFile
+		if encoded := RenameEventToBytes(event, root); !bytes.Equal(encoded, b) {
+			t.Fatalf("rename event does not encode back to input")
+		}
+	})
+}
+
+func FuzzDecodeListing(f *testing.F) {
+	f.Add(EncodeListing([]Entry{
+		{Path: "/docs", IsDir: true},
+		{Path: "/docs/a.txt", Size: 10, Md5: bytes.Repeat([]byte{1}, 16)},
+	}))
+	f.Add([]byte{0, 0, 0, 3, '/', '.', '.', 1})
+	f.Add([]byte{0, 0, 0, 2, '/', 'a', 0, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		entries, err := DecodeListing(b)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if !validRelPath(e.Path) {
+				t.Fatalf("path %q escapes root", e.Path)
+			}
+		}
+		if encoded := EncodeListing(entries); !bytes.Equal(encoded, b) {
+			t.Fatalf("listing does not encode back to input")
+		}
+	})
+}
+
+// server refuses writes of a client which declared itself read only,
+// even if the client sends them anyway
+func TestReadOnlyClient(t *testing.T) {
+	fsys := fsops.NewMemFS()
+	for _, err := range []error{
+		fsops.MakedirAll(fsys, "/server/mirror"),
+		fsops.MakedirAll(fsys, "/client"),
+		fsops.WriteAll(fsys, "/client/new.txt", []byte("local")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener := network.NewMemListener()
+	defer listener.Close()
+	sc := NewServerCore(fsys, "/server", listener)
+	go sc.StartServer()
+
+	cc := NewClientCore(fsys, "/client", listener)
+	cc.Remote = "missing"
+	cc.Direction = SyncDownload
+	if _, _, err := cc.handshake(false); err == nil {
+		t.Fatal("read only client created folder on server")
+	}
+
+	cc.Remote = "mirror"
+	sess, _, err := cc.handshake(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.endSession(sess)
+	for _, event := range []common.FsEvent{
+		{Op: common.OpCreate, FileName: "/client/new.txt"},
+		{Op: common.OpMkdir, FileName: "/client/dir"},
+	} {
+		if cc.sendEvent(sess, event, false) {
+			t.Fatalf("%v accepted from read only client", event)
+		}
+	}
+	if files := fsops.GetAllFile(fsys, "/server"); len(files) != 2 {
+		t.Fatalf("server holds %v", files)
+	}
+	if fsops.IsFileExist(fsys, "/server/missing") {
+		t.Fatal("folder created for read only client")
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"errors"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"log"
+	"sync"
+)
+
+// a folder encrypted by clients has a key check file on server, holding
+// what clients need to derive the keys and to find a wrong passphrase.
+// server can not read it, it only hands it out and refuses clients which
+// did not ask for it, so nothing unencrypted ends up in the folder.
+
+// filesystem which needs keys agreed on with server before use
+type keyed interface {
+	// key check file to offer when server has none
+	KeyCheck() ([]byte, error)
+	// use key check file sent by server
+	Unlock(check []byte) error
+}
+
+var errNotEncrypted = errors.New("server folder holds unencrypted files")
+
+// clients of the same server must not store different files at once
+var keyCheckLock sync.Mutex
+
+func keyCheckPath(root string) string {
+	return root + "/" + common.KeyCheckFile
+}
+
+func isEncrypted(fsys fsops.FS, root string) bool {
+	return fsops.IsFileExist(fsys, keyCheckPath(root))
+}
+
+// key check file of folder, the offered one is stored if there is none
+// and the folder is empty, as no client could read what is already there
+// @return: key check file to use, empty if folder is not encrypted
+func serverKeyCheck(fsys fsops.FS, root string, offered []byte) []byte {
+	keyCheckLock.Lock()
+	defer keyCheckLock.Unlock()
+
+	path := keyCheckPath(root)
+	if fsops.IsFileExist(fsys, path) {
+		check, err := fsops.ReadAll(fsys, path)
+		common.ErrorHandleDebug(logtag, err)
+		return check
+	}
+	if len(offered) == 0 || len(fsops.GetAllFile(fsys, root)) > 1 {
+		return nil
+	}
+	if err := fsops.WriteAll(fsys, path, offered); err != nil {
+		common.ErrorHandleDebug(logtag, err)
+		return nil
+	}
+	log.Println(logtag, "folder is encrypted from now on")
+	return offered
+}
+
+// agree on keys with server
+// @readOnly: keep server from storing the key check file if it has none,
+// keys derived locally are used as long as the server folder is empty
+// @return: false if connection is lost, err if keys can never be agreed on
+func (c *ClientCore) unlock(sess *session, fsys keyed, readOnly bool) (ok bool, err error) {
+	offered, err := fsys.KeyCheck()
+	if err != nil {
+		return false, err
+	}
+	if readOnly {
+		offered = nil
+	}
+	t := sess.transfers.start(keyCheckPath(c.watchPath))
+	WrappAndSend(sess.conn, t.id, common.SysKeyCheck, offered, common.IsLastPackage)
+	if !waitTransfer(sess, t) {
+		return false, nil
+	}
+	if len(t.reply) == 0 && readOnly {
+		remote, err := c.listRemote(sess)
+		if err == errLost {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if len(remote) > 0 {
+			return false, errNotEncrypted
+		}
+		return true, nil
+	}
+	if len(t.reply) == 0 {
+		return false, errNotEncrypted
+	}
+	if err := fsys.Unlock(t.reply); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"gcloudsync/internal/common"
+	"sync"
+)
+
+// commands which connect once, do their work and return
+// the folder is not watched and the connection is not set up again if lost
+
+// files and folders on server, ignored ones included
+func (c *ClientCore) ListRemote() ([]Entry, error) {
+	sess, _, err := c.handshake(true)
+	if err != nil {
+		return nil, err
+	}
+	defer c.endSession(sess)
+	return c.listRemote(sess)
+}
+
+// files and folders of the local folder
+func (c *ClientCore) ListLocal() []Entry {
+	return listFolder(c.fs, c.watchPath)
+}
+
+// changes a sync in the given direction would make
+// nothing is written on either side
+func (c *ClientCore) Plan(dir Direction) ([]Action, error) {
+	if err := c.allows(dir); err != nil {
+		return nil, err
+	}
+	sess, _, err := c.handshake(true)
+	if err != nil {
+		return nil, err
+	}
+	defer c.endSession(sess)
+	remote, err := c.listRemote(sess)
+	if err != nil {
+		return nil, err
+	}
+	return c.plan(remote, dir), nil
+}
+
+// outcome of a sync run once
+type Summary struct {
+	// changes made
+	Done []Action
+	// changes which could not be made
+	Failed []Action
+	// bytes sent to server, protocol overhead included
+	BytesSent int64
+}
+
+// number of changes made with op, in both directions
+func (s Summary) Count(op common.FsOp) int {
+	n := 0
+	for _, a := range s.Done {
+		if a.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// sync in the given direction once and return when all transfers are finished
+// @return: what has been done, err if anything failed
+func (c *ClientCore) SyncOnce(dir Direction) (Summary, error) {
+	var summary Summary
+	if err := c.allows(dir); err != nil {
+		return summary, err
+	}
+	sess, _, err := c.handshake(dir == SyncDownload)
+	if err != nil {
+		return summary, err
+	}
+	defer c.endSession(sess)
+	var lock sync.Mutex
+	actions, err := c.reconcile(sess, dir, func(a Action, ok bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		if ok {
+			summary.Done = append(summary.Done, a)
+		} else {
+			summary.Failed = append(summary.Failed, a)
+		}
+	})
+	if err != nil {
+		summary.BytesSent = sess.conn.sent()
+		return summary, err
+	}
+	summary.BytesSent = sess.conn.sent()
+
+	select {
+	case <-sess.lost:
+		return summary, errLost
+	default:
+	}
+	if len(summary.Failed) > 0 {
+		return summary, fmt.Errorf("%d of %d changes failed", len(summary.Failed), len(actions))
+	}
+	return summary, nil
+}
+
+// ask server for its files and folders
+func (c *ClientCore) listRemote(sess *session) ([]Entry, error) {
+	t := sess.transfers.start(c.watchPath)
+	WrappAndSend(sess.conn, t.id, common.SysListFiles, []byte{}, common.IsLastPackage)
+	if !waitTransfer(sess, t) {
+		return nil, errLost
+	}
+	return DecodeListing(t.reply)
+}
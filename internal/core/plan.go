@@ -0,0 +1,241 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"math"
+	"strings"
+)
+
+// one file or folder of a synced folder
+type Entry struct {
+	// relative to root, starting with "/"
+	Path  string
+	IsDir bool
+	// size and md5 of content, unset for folders
+	Size int64
+	Md5  []byte
+}
+
+// which way changes are synced
+type Direction int
+
+const (
+	// both ways, the version on server wins where both sides differ
+	SyncBoth Direction = iota
+	// local changes only, the local folder is not written to
+	SyncUpload
+	// server changes only, the server is not written to
+	// a download only folder also has local changes reverted
+	SyncDownload
+)
+
+// direction named in config, both ways if unknown
+func DirectionOf(name string) Direction {
+	switch name {
+	case config.DirectionUpload, config.DirectionBackup:
+		return SyncUpload
+	case config.DirectionDownload, config.DirectionMirror:
+		return SyncDownload
+	}
+	return SyncBoth
+}
+
+// one change needed to bring a path in line on both sides
+type Action struct {
+	// OpCreate, OpModify or OpMkdir, or OpRemove of a reverted local path
+	Op common.FsOp
+	// sent from the local folder to server, otherwise the other way
+	Upload bool
+	// relative to root, starting with "/"
+	Path string
+	// bytes of the file to be sent, 0 for folders
+	Size int64
+}
+
+// files and folders under root, reserved ones left out
+func listFolder(fsys fsops.FS, root string) []Entry {
+	var entries []Entry
+	for _, path := range fsops.GetAllFile(fsys, root) {
+		if path == root {
+			continue
+		}
+		info, err := fsys.Stat(path)
+		if err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			continue
+		}
+		e := Entry{Path: fsops.RemoveRootPrefix(path, root), IsDir: info.IsDir()}
+		if !e.IsDir {
+			e.Size = info.Size()
+			e.Md5 = fsops.GetFileMd5(fsys, path)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// changes needed to bring both folders in line, in the order they are
+// applied, parents ahead of their content. nothing is ever removed, and
+// a path which is a file on one side and a folder on the other is left alone
+// @local: entries of the local folder
+// @remote: entries of the folder on server
+func planSync(local []Entry, remote []Entry, dir Direction) []Action {
+	localIndex := make(map[string]Entry, len(local))
+	for _, e := range local {
+		localIndex[e.Path] = e
+	}
+	remoteIndex := make(map[string]Entry, len(remote))
+	for _, e := range remote {
+		remoteIndex[e.Path] = e
+	}
+
+	var actions []Action
+	for _, r := range remote {
+		l, exist := localIndex[r.Path]
+		switch {
+		case exist && l.IsDir != r.IsDir:
+		case r.IsDir:
+			if !exist && dir != SyncUpload {
+				actions = append(actions, Action{Op: common.OpMkdir, Path: r.Path})
+			}
+		case !exist:
+			if dir != SyncUpload {
+				actions = append(actions, Action{Op: common.OpCreate, Path: r.Path, Size: r.Size})
+			}
+		case bytes.Equal(l.Md5, r.Md5):
+		case dir == SyncUpload:
+			actions = append(actions, Action{Op: common.OpModify, Upload: true, Path: l.Path, Size: l.Size})
+		default:
+			actions = append(actions, Action{Op: common.OpModify, Path: r.Path, Size: r.Size})
+		}
+	}
+	if dir == SyncDownload {
+		return actions
+	}
+	for _, l := range local {
+		if _, exist := remoteIndex[l.Path]; exist {
+			continue
+		}
+		if l.IsDir {
+			actions = append(actions, Action{Op: common.OpMkdir, Upload: true, Path: l.Path})
+		} else {
+			actions = append(actions, Action{Op: common.OpCreate, Upload: true, Path: l.Path, Size: l.Size})
+		}
+	}
+	return actions
+}
+
+// files and folders of the local folder which server lacks, to be removed
+// only the topmost one of a local subtree is listed
+func planRevert(local []Entry, remote []Entry) []Action {
+	remoteIndex := make(map[string]bool, len(remote))
+	for _, e := range remote {
+		remoteIndex[e.Path] = true
+	}
+	var actions []Action
+	var removed []string
+	for _, l := range local {
+		if remoteIndex[l.Path] {
+			continue
+		}
+		below := false
+		for _, dir := range removed {
+			if strings.HasPrefix(l.Path, dir+"/") {
+				below = true
+				break
+			}
+		}
+		if below {
+			continue
+		}
+		if l.IsDir {
+			removed = append(removed, l.Path)
+		}
+		actions = append(actions, Action{Op: common.OpRemove, Path: l.Path})
+	}
+	return actions
+}
+
+// package structure, for each entry:
+// +-----+------+------+------+------+
+// | len | path | kind | size | md5  |
+// +-----+------+------+------+------+
+// |  4  |      |  1   |  8   |  16  |
+// +-----+------+------+------+------+
+// kind is 0 for a file and 1 for a folder, folders end after kind
+func EncodeListing(entries []Entry) []byte {
+	var buf bytes.Buffer
+	b := make([]byte, 8)
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(b, uint32(len(e.Path)))
+		buf.Write(b[:4])
+		buf.WriteString(e.Path)
+		if e.IsDir {
+			buf.WriteByte(1)
+			continue
+		}
+		buf.WriteByte(0)
+		binary.BigEndian.PutUint64(b, uint64(e.Size))
+		buf.Write(b)
+		md5 := make([]byte, 16)
+		copy(md5, e.Md5)
+		buf.Write(md5)
+	}
+	return buf.Bytes()
+}
+
+// decode listing sent by peer
+func DecodeListing(b []byte) ([]Entry, error) {
+	var entries []Entry
+	for len(b) > 0 {
+		path, rest, err := splitLengthPrefixed(b)
+		if err != nil {
+			return nil, errors.New("invalid listing")
+		}
+		if !validRelPath(string(path)) {
+			return nil, errors.New("invalid path in listing")
+		}
+		if len(rest) < 1 {
+			return nil, errors.New("short listing")
+		}
+		e := Entry{Path: string(path)}
+		switch rest[0] {
+		case 1:
+			e.IsDir = true
+			b = rest[1:]
+		case 0:
+			if len(rest) < 1+8+16 {
+				return nil, errors.New("short listing")
+			}
+			size := binary.BigEndian.Uint64(rest[1:9])
+			if size > math.MaxInt64 {
+				return nil, errors.New("invalid size in listing")
+			}
+			e.Size = int64(size)
+			e.Md5 = append([]byte{}, rest[9:25]...)
+			b = rest[25:]
+		default:
+			return nil, errors.New("unknown entry kind in listing")
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// path relative to root which stays below it
+func validRelPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || fsops.IsInternalPath(path) {
+		return false
+	}
+	for _, part := range strings.Split(path[1:], "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"gcloudsync/internal/common"
+	"strings"
+	"sync"
+)
+
+// run fs events concurrently with a limit
+// events touching the same path, or a parent folder of it,
+// are always processed in the order they are submitted
+type scheduler struct {
+	lock    sync.Mutex
+	limit   int
+	running []*task
+	pending []*task
+	wg      sync.WaitGroup
+}
+
+type task struct {
+	event common.FsEvent
+	run   func()
+}
+
+func newScheduler(limit int) *scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	return &scheduler{limit: limit}
+}
+
+// queue an event, run will be called in its own goroutine
+func (s *scheduler) submit(event common.FsEvent, run func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.wg.Add(1)
+	s.pending = append(s.pending, &task{event: event, run: run})
+	s.dispatch()
+}
+
+// block until all submitted events are processed
+func (s *scheduler) wait() {
+	s.wg.Wait()
+}
+
+// start pending tasks which do not conflict with running ones
+// or with earlier pending ones, must be called with lock held
+func (s *scheduler) dispatch() {
+	var blocked []*task
+	var remain []*task
+	for _, t := range s.pending {
+		if len(s.running) >= s.limit || conflictWith(t, s.running) || conflictWith(t, blocked) {
+			blocked = append(blocked, t)
+			remain = append(remain, t)
+			continue
+		}
+		s.running = append(s.running, t)
+		go s.execute(t)
+	}
+	s.pending = remain
+}
+
+func (s *scheduler) execute(t *task) {
+	t.run()
+
+	s.lock.Lock()
+	for i, r := range s.running {
+		if r == t {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+	s.dispatch()
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
+func conflictWith(t *task, tasks []*task) bool {
+	for _, other := range tasks {
+		if eventsRelated(t.event, other.event) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether two events touch the same path or one path contains the other
+func eventsRelated(a common.FsEvent, b common.FsEvent) bool {
+	for _, pa := range eventPaths(a) {
+		for _, pb := range eventPaths(b) {
+			if pa == pb || strings.HasPrefix(pa, pb+"/") || strings.HasPrefix(pb, pa+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func eventPaths(e common.FsEvent) []string {
+	if e.OriginFile != "" {
+		return []string{e.FileName, e.OriginFile}
+	}
+	return []string{e.FileName}
+}
@@ -1,28 +1,66 @@
 package core
 
 import (
+	"gcloudsync/internal/common"
 	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
 	"gcloudsync/internal/network"
+	"gcloudsync/internal/trash"
 	"log"
+	"sync"
 )
 
 type ServerCore struct {
-	server network.ITCPServer
-	path   string
+	// folders below path no client may write to, whatever it declares, "." for all of them
+	ReadOnlyFolders []string
+
+	fs       fsops.FS
+	listener network.Listener
+	path     string
+	// connections being served
+	conns *sync.WaitGroup
 }
 
-func NewServerCore(path string) ServerCore {
-	server := network.NewServer(config.Port)
-	return ServerCore{server: server, path: path}
+// @fsys: filesystem the served folder lives on
+// @path: root path of the folder to be served
+// @listener: transport accepting client connections
+func NewServerCore(fsys fsops.FS, path string, listener network.Listener) ServerCore {
+	return ServerCore{fs: fsys, listener: listener, path: path, conns: &sync.WaitGroup{}}
 }
 
 // main entry
 func (s *ServerCore) StartServer() {
-	done := make(chan bool)
-	bc := s.server.GetBuffChan()
-	go s.server.Listen()
-	go handleCore(s.server, bc, done, nil, nil)
+	err := fsops.CleanStagingDir(s.fs, s.path)
+	common.ErrorHandleDebug(logtag, err)
+
+	go trash.StartPurging(s.fs, s.path, config.TrashRetentionDays)
 
 	log.Println(logtag, "start listening")
-	<-done
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			return
+		}
+		s.conns.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// wait until every accepted connection is closed and handled,
+// listener should be closed first
+func (s *ServerCore) Wait() {
+	s.conns.Wait()
+}
+
+// every client has its own transfers
+func (s *ServerCore) serve(conn network.Conn) {
+	defer s.conns.Done()
+	defer conn.Close()
+
+	done := make(chan bool, 1)
+	transfers := newTransferTable(s.fs)
+	handleCore(conn, RoleServer, s.fs, s.path, s.ReadOnlyFolders, done, nil, transfers)
+	// partly received files are thrown away
+	transfers.abort()
 }
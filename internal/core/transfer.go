@@ -0,0 +1,161 @@
+package core
+
+import (
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// state of one file in flight
+// every package belonging to the same file carries the same transfer id
+type transfer struct {
+	id      uint32
+	absPath string
+
+	// incoming direct data
+	stagingFile  fsops.File
+	expectedHash []byte
+	received     int64
+
+	// outgoing direct data
+	sent int64
+
+	// incoming data of an op sent in pieces, see piecedOps
+	pieces []byte
+	// pieces outgrew the buffer and are dropped until the last one
+	overflow bool
+
+	// times the file has been transferred again after verification failed
+	retries int
+
+	// answer of peer to a request which is not a file transfer
+	reply []byte
+
+	// released with the result once the transfer is finished
+	done chan bool
+
+	// unix nano time of the last package sent or received
+	lastActive int64
+}
+
+// record progress of the transfer
+func (t *transfer) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// time since the last progress
+func (t *transfer) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&t.lastActive))
+}
+
+// transfers in flight on one connection keyed by transfer id
+// id 0 is reserved for packages not belonging to any transfer
+type transferTable struct {
+	fs        fsops.FS
+	lock      sync.Mutex
+	transfers map[uint32]*transfer
+	nextID    uint32
+	// connection is gone, no more transfers are accepted
+	aborted bool
+
+	// delta settings of this connection, those of the client on both sides
+	// other connections may use others, so config globals are never changed
+	blockSize int
+	deltaMode string
+}
+
+// delta settings are those of the local config until changed
+// @fsys: where staging files of incoming transfers live
+func newTransferTable(fsys fsops.FS) *transferTable {
+	return &transferTable{fs: fsys, transfers: make(map[uint32]*transfer),
+		blockSize: config.TruncateBlockSize, deltaMode: config.DeltaMode}
+}
+
+// start a new transfer on the initiating side
+func (tt *transferTable) start(absPath string) *transfer {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.nextID++
+	if tt.nextID == 0 {
+		tt.nextID++
+	}
+	t := &transfer{id: tt.nextID, absPath: absPath, done: make(chan bool, 1)}
+	t.touch()
+	if tt.aborted {
+		t.done <- false
+		return t
+	}
+	tt.transfers[t.id] = t
+	return t
+}
+
+// get transfer by id, create one if the peer started it
+func (tt *transferTable) get(id uint32) *transfer {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	t, ok := tt.transfers[id]
+	if !ok {
+		t = &transfer{id: id}
+		tt.transfers[id] = t
+	}
+	t.touch()
+	return t
+}
+
+// get transfer by id only if it is in flight
+func (tt *transferTable) find(id uint32) (*transfer, bool) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	t, ok := tt.transfers[id]
+	return t, ok
+}
+
+// record progress of a transfer in flight, if any
+func (tt *transferTable) touch(id uint32) {
+	tt.lock.Lock()
+	t, ok := tt.transfers[id]
+	tt.lock.Unlock()
+
+	if ok {
+		t.touch()
+	}
+}
+
+// remove transfer from table and report result to whoever waits for it
+// @return: the finished transfer, nil if it is not in flight
+func (tt *transferTable) finish(id uint32, ok bool) *transfer {
+	tt.lock.Lock()
+	t, exist := tt.transfers[id]
+	delete(tt.transfers, id)
+	tt.lock.Unlock()
+
+	if !exist {
+		return nil
+	}
+	fsops.DiscardStagingFile(tt.fs, t.stagingFile)
+	t.stagingFile = nil
+	if t.done != nil {
+		t.done <- ok
+	}
+	return t
+}
+
+// connection is gone, every transfer in flight fails
+func (tt *transferTable) abort() {
+	tt.lock.Lock()
+	tt.aborted = true
+	ids := make([]uint32, 0, len(tt.transfers))
+	for id := range tt.transfers {
+		ids = append(ids, id)
+	}
+	tt.lock.Unlock()
+
+	for _, id := range ids {
+		tt.finish(id, false)
+	}
+}
@@ -0,0 +1,243 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"gcloudsync/internal/cdc"
+	"io"
+	"sort"
+)
+
+// encrypted file structured as below
+// +----------+----------+-----+----------+---------+
+// | record 0 | record 1 | ... | record n | trailer |
+// +----------+----------+-----+----------+---------+
+// |                                      |   32    |
+// +----------+----------+-----+----------+---------+
+// plaintext is cut into content defined chunks and each is sealed into one
+// record, so an edit only changes the records around it and delta sync
+// still finds the rest on peer. trailer is a mac over the nonces of all
+// records and keeps them from being dropped or reordered.
+//
+// one record:
+// +--------+-------+-----------------------+
+// | length | nonce | sealed chunk with tag |
+// +--------+-------+-----------------------+
+// |   4    |  12   |        length         |
+// +--------+-------+-----------------------+
+// nonce is a mac of the chunk, equal chunks give equal records
+
+const (
+	nonceSize      = 12
+	tagSize        = 16
+	recordOverhead = 4 + nonceSize + tagSize
+	trailerSize    = sha256.Size
+	// average plaintext per record, fixed since all clients must agree
+	chunkAvg = 16 * 1024
+)
+
+var ErrCorrupted = errors.New("encrypted content corrupted")
+
+var chunker = cdc.NewChunker(chunkAvg)
+
+// where the records of a plaintext lie in its encrypted form
+type layout struct {
+	segments []segment
+	trailer  []byte
+	// size of the encrypted form
+	size int64
+}
+
+type segment struct {
+	plainOff  int64
+	plainLen  int
+	cipherOff int64
+	nonce     []byte
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (k *keys) nonce(chunk []byte) []byte {
+	return mac(k.contentNonce, chunk)[:nonceSize]
+}
+
+// cut plaintext of r into records, reading it once
+func (k *keys) layout(r io.ReaderAt, plainSize int64) (*layout, error) {
+	l := &layout{}
+	trailer := hmac.New(sha256.New, k.contentMac)
+
+	// chunker needs Max bytes ahead to cut where it would on the whole data
+	buf := make([]byte, 0, chunker.Max*2)
+	var readOff, plainOff, cipherOff int64
+	for readOff < plainSize || len(buf) > 0 {
+		if len(buf) < chunker.Max && readOff < plainSize {
+			n := cap(buf) - len(buf)
+			if int64(n) > plainSize-readOff {
+				n = int(plainSize - readOff)
+			}
+			got, err := r.ReadAt(buf[len(buf):len(buf)+n], readOff)
+			if got < n {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			buf = buf[:len(buf)+n]
+			readOff = readOff + int64(n)
+			continue
+		}
+
+		n := chunker.Next(buf)
+		s := segment{plainOff: plainOff, plainLen: n, cipherOff: cipherOff, nonce: k.nonce(buf[:n])}
+		l.segments = append(l.segments, s)
+		trailer.Write(s.nonce)
+		plainOff = plainOff + int64(n)
+		cipherOff = cipherOff + int64(n+recordOverhead)
+		buf = buf[:copy(buf, buf[n:])]
+	}
+	l.trailer = trailer.Sum(nil)
+	l.size = cipherOff + trailerSize
+	return l, nil
+}
+
+func (k *keys) seal(nonce []byte, chunk []byte) []byte {
+	record := make([]byte, 4+nonceSize, len(chunk)+recordOverhead)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(chunk)+tagSize))
+	copy(record[4:], nonce)
+	return k.content.Seal(record, nonce, chunk, nil)
+}
+
+// encrypt whole plaintext
+func (k *keys) encrypt(plain []byte) ([]byte, error) {
+	l, err := k.layout(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, l.size)
+	for _, s := range l.segments {
+		out = append(out, k.seal(s.nonce, plain[s.plainOff:s.plainOff+int64(s.plainLen)])...)
+	}
+	return append(out, l.trailer...), nil
+}
+
+// decrypt and verify whole encrypted form
+// nothing at all is an empty file, which is how files begin on peer
+func (k *keys) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return []byte{}, nil
+	}
+	var plain []byte
+	trailer := hmac.New(sha256.New, k.contentMac)
+	pos := 0
+	for len(data)-pos > trailerSize {
+		if len(data)-pos < 4+nonceSize+trailerSize {
+			return nil, ErrCorrupted
+		}
+		n := int64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if n <= tagSize || n > int64(len(data)-pos-4-nonceSize-trailerSize) {
+			return nil, ErrCorrupted
+		}
+		nonce := data[pos+4 : pos+4+nonceSize]
+		sealed := data[pos+4+nonceSize : pos+4+nonceSize+int(n)]
+		start := len(plain)
+		var err error
+		plain, err = k.content.Open(plain, nonce, sealed, nil)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+		// nonce must be the one this chunk is always sealed with
+		if !hmac.Equal(nonce, k.nonce(plain[start:])) {
+			return nil, ErrCorrupted
+		}
+		trailer.Write(nonce)
+		pos = pos + 4 + nonceSize + int(n)
+	}
+	if len(data)-pos != trailerSize || !hmac.Equal(trailer.Sum(nil), data[pos:]) {
+		return nil, ErrCorrupted
+	}
+	if plain == nil {
+		plain = []byte{}
+	}
+	return plain, nil
+}
+
+// encrypted form of a plaintext, built record by record on read
+type encReader struct {
+	plain io.ReaderAt
+	k     *keys
+	l     *layout
+	// last record built
+	cached    int
+	cachedOff int64
+	record    []byte
+}
+
+func newEncReader(k *keys, plain io.ReaderAt, plainSize int64) (*encReader, error) {
+	l, err := k.layout(plain, plainSize)
+	if err != nil {
+		return nil, err
+	}
+	return &encReader{plain: plain, k: k, l: l, cached: -1}, nil
+}
+
+func (r *encReader) Size() int64 {
+	return r.l.size
+}
+
+// record containing offset off of the encrypted form and where it starts
+func (r *encReader) recordAt(off int64) ([]byte, int64, error) {
+	trailerOff := r.l.size - trailerSize
+	if off >= trailerOff {
+		return r.l.trailer, trailerOff, nil
+	}
+	i := sort.Search(len(r.l.segments), func(i int) bool {
+		return r.l.segments[i].cipherOff > off
+	}) - 1
+	if i == r.cached {
+		return r.record, r.cachedOff, nil
+	}
+
+	s := r.l.segments[i]
+	chunk := make([]byte, s.plainLen)
+	if n, err := r.plain.ReadAt(chunk, s.plainOff); n < len(chunk) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	// never seal different data under the same nonce
+	if !hmac.Equal(s.nonce, r.k.nonce(chunk)) {
+		return nil, 0, errors.New("file changed while reading")
+	}
+	r.cached = i
+	r.cachedOff = s.cipherOff
+	r.record = r.k.seal(s.nonce, chunk)
+	return r.record, r.cachedOff, nil
+}
+
+func (r *encReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(b) && off < r.l.size {
+		record, start, err := r.recordAt(off)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(b[n:], record[off-start:])
+		n = n + copied
+		off = off + int64(copied)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
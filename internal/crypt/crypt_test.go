@@ -0,0 +1,224 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"gcloudsync/internal/fsops"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// RFC 7914 section 11
+func TestPBKDF2(t *testing.T) {
+	cases := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, c := range cases {
+		got := hex.EncodeToString(PBKDF2([]byte(c.password), []byte(c.salt), c.iterations, 64))
+		if got != c.want {
+			t.Errorf("PBKDF2(%q, %q, %d) = %s", c.password, c.salt, c.iterations, got)
+		}
+	}
+}
+
+func testKeys(t *testing.T, passphrase string) (*keys, []byte) {
+	check, k, err := newKeyCheck([]byte(passphrase), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, check
+}
+
+func TestKeyCheck(t *testing.T) {
+	k, check := testKeys(t, "secret")
+	opened, err := openKeyCheck([]byte("secret"), check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.encryptName("a") != k.encryptName("a") {
+		t.Fatal("same passphrase and salt give different keys")
+	}
+	if _, err := openKeyCheck([]byte("guess"), check); err != ErrWrongPassphrase {
+		t.Fatalf("wrong passphrase gave %v", err)
+	}
+	if _, err := openKeyCheck([]byte("secret"), check[1:]); err != ErrInvalidKeyCheck {
+		t.Fatalf("damaged key check gave %v", err)
+	}
+}
+
+func TestContent(t *testing.T) {
+	k, _ := testKeys(t, "secret")
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, size := range []int{0, 1, 5000, len(data)} {
+		plain := data[:size]
+		encrypted, err := k.encrypt(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := k.decrypt(encrypted)
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Fatalf("size %d: round trip failed: %v", size, err)
+		}
+
+		// read record by record in odd pieces
+		r, err := newEncReader(k, bytes.NewReader(plain), int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read []byte
+		buf := make([]byte, 777)
+		for off := int64(0); off < r.Size(); off = off + int64(len(buf)) {
+			n, _ := r.ReadAt(buf, off)
+			read = append(read, buf[:n]...)
+		}
+		if !bytes.Equal(read, encrypted) {
+			t.Fatalf("size %d: reader differs from encrypt", size)
+		}
+	}
+
+	encrypted, _ := k.encrypt(data)
+	for _, damaged := range [][]byte{
+		encrypted[:len(encrypted)-1],
+		encrypted[recordOverhead+100:],
+		append(append([]byte{}, encrypted[:100]...), append([]byte{encrypted[100] ^ 1}, encrypted[101:]...)...),
+	} {
+		if _, err := k.decrypt(damaged); err != ErrCorrupted {
+			t.Fatalf("damaged content gave %v", err)
+		}
+	}
+}
+
+// sealed records of a file
+func records(t *testing.T, k *keys, plain []byte) map[string]bool {
+	l, err := k.layout(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]bool)
+	for _, s := range l.segments {
+		result[string(k.seal(s.nonce, plain[s.plainOff:s.plainOff+int64(s.plainLen)]))] = true
+	}
+	return result
+}
+
+// an insertion changes only the records around it
+func TestContentLocality(t *testing.T) {
+	k, _ := testKeys(t, "secret")
+	data := make([]byte, 500000)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte{}, data[:250000]...), "inserted"...), data[250000:]...)
+
+	before := records(t, k, data)
+	after := records(t, k, edited)
+	changed := 0
+	for record := range after {
+		if !before[record] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Fatalf("%d of %d records changed", changed, len(after))
+	}
+}
+
+func TestNames(t *testing.T) {
+	k, _ := testKeys(t, "secret")
+	other, _ := testKeys(t, "secret")
+	for _, name := range []string{"a", "report.pdf", strings.Repeat("x", 120), "日本語"} {
+		encrypted := k.encryptName(name)
+		if encrypted != k.encryptName(name) {
+			t.Fatalf("%q encrypted differently twice", name)
+		}
+		if strings.HasPrefix(encrypted, ".") || strings.ToLower(encrypted) != encrypted || len(encrypted) > 255 {
+			t.Fatalf("%q encrypted to unusable name %q", name, encrypted)
+		}
+		if got, err := k.decryptName(encrypted); err != nil || got != name {
+			t.Fatalf("%q decrypted to %q, %v", name, got, err)
+		}
+		// another salt gives other keys
+		if _, err := other.decryptName(encrypted); err != ErrInvalidName {
+			t.Fatalf("%q decrypted with other keys: %v", name, err)
+		}
+	}
+}
+
+func TestView(t *testing.T) {
+	Iterations = 1000
+	disk := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(disk, root+"/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(disk, root+"/docs/a.txt", []byte("plain text")); err != nil {
+		t.Fatal(err)
+	}
+	v := NewView(disk, root, "secret")
+	if _, err := v.ReadDir(root); err == nil {
+		t.Fatal("view readable before key is set")
+	}
+	if _, err := v.KeyCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only encrypted names are seen
+	files := fsops.GetAllFile(v, root)
+	if len(files) != 3 {
+		t.Fatalf("files in view: %v", files)
+	}
+	file := files[2]
+	if strings.Contains(file, "docs") || strings.Contains(file, "a.txt") {
+		t.Fatalf("plain name in view: %s", file)
+	}
+	if v.ToView(root+"/docs/a.txt") != file {
+		t.Fatalf("disk path mapped to %s, want %s", v.ToView(root+"/docs/a.txt"), file)
+	}
+	encrypted, err := fsops.ReadAll(v, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := fsops.GetFileSize(v, file); size != int64(len(encrypted)) || bytes.Contains(encrypted, []byte("plain")) {
+		t.Fatalf("encrypted content of size %d: %q", size, encrypted)
+	}
+
+	// received file is decrypted on commit
+	next, _ := v.keys.encrypt([]byte("new text"))
+	staging, err := fsops.CreateStagingFile(v, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging.WriteAt(next, 0)
+	if err := fsops.CommitStagingFile(v, staging, file, fsops.GetFileMd5(v, staging.Name())); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fsops.ReadAll(disk, root+"/docs/a.txt"); string(got) != "new text" {
+		t.Fatalf("disk holds %q after commit", got)
+	}
+
+	// damaged one leaves the file as it is
+	staging, _ = fsops.CreateStagingFile(v, root)
+	staging.WriteAt(next[1:], 0)
+	if err := fsops.CommitStagingFile(v, staging, file, nil); err == nil {
+		t.Fatal("damaged content committed")
+	}
+	if got, _ := fsops.ReadAll(disk, root+"/docs/a.txt"); string(got) != "new text" {
+		t.Fatalf("disk holds %q after failed commit", got)
+	}
+
+	// written through the view
+	if err := fsops.WriteAll(v, v.ToView(root+"/b.txt"), next); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fsops.ReadAll(disk, root+"/b.txt"); string(got) != "new text" {
+		t.Fatalf("disk holds %q after write", got)
+	}
+}
@@ -0,0 +1,147 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// client side end to end encryption
+// a passphrase is stretched by PBKDF2 into a master key, separate keys for
+// contents and names are derived from it. the salt and a value proving
+// knowledge of the master key are kept on server in a key check file, so
+// every client with the same passphrase derives the same keys and a wrong
+// passphrase is found before anything is synced.
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrInvalidKeyCheck = errors.New("invalid key check file")
+	ErrNoPassphrase    = errors.New("no passphrase, set PassphraseFile or " + PassphraseEnv)
+)
+
+// environment variable passphrase is read from when no file is configured
+const PassphraseEnv = "GCS_PASSPHRASE"
+
+// PBKDF2 rounds for new key check files
+// existing ones keep the count they were created with
+var Iterations int = 200000
+
+// counts a server may ask for, more would let it stall clients
+const maxIterations = 1 << 24
+
+const saltSize = 16
+
+// key check file structured as below
+// +-------+---------+------------+------+--------------+
+// | magic | version | iterations | salt | check value  |
+// +-------+---------+------------+------+--------------+
+// |   4   |    1    |     4      |  16  |      32      |
+// +-------+---------+------------+------+--------------+
+const (
+	checkMagic   = "GCSK"
+	checkVersion = 1
+	checkSize    = 4 + 1 + 4 + saltSize + sha256.Size
+)
+
+type keys struct {
+	content cipher.AEAD
+	name    cipher.AEAD
+	// nonces are derived from plaintext, so the same input always
+	// gives the same output and unchanged chunks stay unchanged
+	contentNonce []byte
+	nameNonce    []byte
+	// binds the chunks of a file together
+	contentMac []byte
+	check      []byte
+}
+
+func subkey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// key is always 32 bytes
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func deriveKeys(passphrase []byte, salt []byte, iterations int) *keys {
+	master := PBKDF2(passphrase, salt, iterations, 32)
+	return &keys{
+		content:      newAEAD(subkey(master, "gcloudsync content")),
+		name:         newAEAD(subkey(master, "gcloudsync name")),
+		contentNonce: subkey(master, "gcloudsync content nonce"),
+		nameNonce:    subkey(master, "gcloudsync name nonce"),
+		contentMac:   subkey(master, "gcloudsync content mac"),
+		check:        subkey(master, "gcloudsync key check"),
+	}
+}
+
+// create a key check file with a new salt
+func newKeyCheck(passphrase []byte, iterations int) (check []byte, k *keys, err error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	k = deriveKeys(passphrase, salt, iterations)
+
+	check = make([]byte, 0, checkSize)
+	check = append(check, checkMagic...)
+	check = append(check, checkVersion)
+	b4 := make([]byte, 4)
+	binary.BigEndian.PutUint32(b4, uint32(iterations))
+	check = append(check, b4...)
+	check = append(check, salt...)
+	check = append(check, k.check...)
+	return check, k, nil
+}
+
+// derive keys with salt of key check file and verify them
+func openKeyCheck(passphrase []byte, check []byte) (*keys, error) {
+	if len(check) != checkSize || string(check[0:4]) != checkMagic || check[4] != checkVersion {
+		return nil, ErrInvalidKeyCheck
+	}
+	iterations := binary.BigEndian.Uint32(check[5:9])
+	if iterations == 0 || iterations > maxIterations {
+		return nil, ErrInvalidKeyCheck
+	}
+	salt := check[9 : 9+saltSize]
+	k := deriveKeys(passphrase, salt, int(iterations))
+	if !hmac.Equal(k.check, check[9+saltSize:]) {
+		return nil, ErrWrongPassphrase
+	}
+	return k, nil
+}
+
+// passphrase from first line of file, or from environment if file is empty
+func ReadPassphrase(file string) (string, error) {
+	passphrase := os.Getenv(PassphraseEnv)
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.SplitN(string(data), "\n", 2)[0]
+		passphrase = strings.TrimSuffix(passphrase, "\r")
+	}
+	if passphrase == "" {
+		return "", ErrNoPassphrase
+	}
+	return passphrase, nil
+}
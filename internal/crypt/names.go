@@ -0,0 +1,36 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"encoding/base32"
+	"errors"
+)
+
+// every path component is encrypted on its own, the same name always gives
+// the same result so paths can be looked up without a directory listing.
+// encoded by lower case base32, servers with case insensitive disks keep
+// names apart and an encrypted name never starts with a dot.
+// names up to about 130 bytes fit in the usual limit of 255.
+
+var ErrInvalidName = errors.New("invalid encrypted name")
+
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func (k *keys) encryptName(name string) string {
+	nonce := mac(k.nameNonce, []byte(name))[:nonceSize]
+	sealed := k.name.Seal(append([]byte{}, nonce...), nonce, []byte(name), nil)
+	return nameEncoding.EncodeToString(sealed)
+}
+
+func (k *keys) decryptName(encrypted string) (string, error) {
+	data, err := nameEncoding.DecodeString(encrypted)
+	if err != nil || len(data) <= nonceSize+tagSize {
+		return "", ErrInvalidName
+	}
+	nonce := data[:nonceSize]
+	name, err := k.name.Open(nil, nonce, data[nonceSize:], nil)
+	if err != nil || !hmac.Equal(nonce, mac(k.nameNonce, name)[:nonceSize]) {
+		return "", ErrInvalidName
+	}
+	return string(name), nil
+}
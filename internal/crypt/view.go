@@ -0,0 +1,514 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// encrypted view of a plaintext folder
+// sync logic working on the view only ever sees encrypted names and
+// contents, which is all that gets to server. the folder on disk stays
+// plaintext. reserved folders are passed through as they are, staging
+// files hold what peer sent, so a staging file renamed into the folder
+// is decrypted and verified on the way.
+type View struct {
+	disk       fsops.FS
+	root       string
+	passphrase []byte
+
+	lock sync.Mutex
+	// nil until a key check file is created or opened
+	keys  *keys
+	check []byte
+	// encrypted sizes by disk path, a Stat should not read the whole file
+	sizes map[string]cachedSize
+}
+
+type cachedSize struct {
+	plainSize int64
+	modTime   time.Time
+	size      int64
+}
+
+var logtag string = "[Crypt]"
+
+var errLocked = errors.New("encryption key not set")
+
+var _ fsops.View = (*View)(nil)
+
+// @disk: filesystem the plaintext folder lives on
+// @root: root path of the folder, paths below it are encrypted
+func NewView(disk fsops.FS, root string, passphrase string) *View {
+	return &View{disk: disk, root: root, passphrase: []byte(passphrase),
+		sizes: make(map[string]cachedSize)}
+}
+
+// key check file to offer server for a folder it has none for
+// keys derived from it are used until Unlock is called with another one
+func (v *View) KeyCheck() ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.check != nil {
+		return v.check, nil
+	}
+	check, k, err := newKeyCheck(v.passphrase, Iterations)
+	if err != nil {
+		return nil, err
+	}
+	v.check = check
+	v.keys = k
+	return check, nil
+}
+
+// use keys of the key check file kept by server
+func (v *View) Unlock(check []byte) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.keys != nil && bytes.Equal(check, v.check) {
+		return nil
+	}
+	k, err := openKeyCheck(v.passphrase, check)
+	if err != nil {
+		v.keys = nil
+		v.check = nil
+		return err
+	}
+	v.keys = k
+	v.check = append([]byte{}, check...)
+	v.sizes = make(map[string]cachedSize)
+	return nil
+}
+
+func (v *View) currentKeys() *keys {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.keys
+}
+
+func (v *View) Disk() fsops.FS {
+	return v.disk
+}
+
+// path in view of a path on disk, unchanged if it can not be mapped
+func (v *View) ToView(path string) string {
+	result, _, err := v.translate(path, true)
+	if err != nil {
+		return path
+	}
+	return result
+}
+
+// path on disk of a path in view, unchanged if it can not be mapped
+func (v *View) ToDisk(path string) string {
+	result, _, err := v.toDisk(path)
+	if err != nil {
+		return path
+	}
+	return result
+}
+
+// path on disk of a path in view
+// @raw: path lies in a reserved folder and is not encrypted
+func (v *View) toDisk(path string) (result string, raw bool, err error) {
+	return v.translate(path, false)
+}
+
+// encrypt or decrypt every component of path below root
+func (v *View) translate(path string, encrypt bool) (result string, raw bool, err error) {
+	if !strings.HasPrefix(path, v.root) {
+		return path, true, nil
+	}
+	rel := path[len(v.root):]
+	if rel != "" && rel[0] != '/' && !strings.HasSuffix(v.root, "/") {
+		return path, true, nil
+	}
+
+	parts := strings.Split(rel, "/")
+	var k *keys
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if fsops.IsInternalPath(part) {
+			raw = true
+			break
+		}
+		if k == nil {
+			if k = v.currentKeys(); k == nil {
+				return "", false, errLocked
+			}
+		}
+		if encrypt {
+			parts[i] = k.encryptName(part)
+		} else if parts[i], err = k.decryptName(part); err != nil {
+			return "", false, err
+		}
+	}
+	return v.root + strings.Join(parts, "/"), raw, nil
+}
+
+// staging files hold encrypted content as peer sent it
+func (v *View) isStaging(path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(v.root, "/")+"/"+common.StagingDir+"/")
+}
+
+func pathError(op string, path string, err error) error {
+	if errors.Is(err, ErrInvalidName) {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// size of the encrypted form of a file on disk
+func (v *View) encryptedSize(diskPath string, info os.FileInfo) (int64, error) {
+	v.lock.Lock()
+	cached, ok := v.sizes[diskPath]
+	k := v.keys
+	v.lock.Unlock()
+	if ok && cached.plainSize == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.size, nil
+	}
+	if k == nil {
+		return 0, errLocked
+	}
+
+	file, err := v.disk.Open(diskPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	l, err := k.layout(file, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	v.lock.Lock()
+	v.sizes[diskPath] = cachedSize{plainSize: info.Size(), modTime: info.ModTime(), size: l.size}
+	v.lock.Unlock()
+	return l.size, nil
+}
+
+// file info under encrypted name, size is found when asked for
+type viewInfo struct {
+	os.FileInfo
+	name     string
+	v        *View
+	diskPath string
+}
+
+func (i *viewInfo) Name() string {
+	return i.name
+}
+
+func (i *viewInfo) Size() int64 {
+	if i.FileInfo.IsDir() {
+		return i.FileInfo.Size()
+	}
+	size, err := i.v.encryptedSize(i.diskPath, i.FileInfo)
+	common.ErrorHandleDebug(logtag, err)
+	return size
+}
+
+func (v *View) Stat(path string) (os.FileInfo, error) {
+	diskPath, raw, err := v.toDisk(path)
+	if err != nil {
+		return nil, pathError("stat", path, err)
+	}
+	info, err := v.disk.Stat(diskPath)
+	if err != nil || raw {
+		return info, err
+	}
+	return &viewInfo{FileInfo: info, name: filepath.Base(path), v: v, diskPath: diskPath}, nil
+}
+
+func (v *View) ReadDir(path string) ([]os.FileInfo, error) {
+	diskPath, raw, err := v.toDisk(path)
+	if err != nil {
+		return nil, pathError("readdir", path, err)
+	}
+	infos, err := v.disk.ReadDir(diskPath)
+	if err != nil || raw {
+		return infos, err
+	}
+	k := v.currentKeys()
+	if k == nil {
+		return nil, pathError("readdir", path, errLocked)
+	}
+	for i, info := range infos {
+		if fsops.IsInternalPath(info.Name()) {
+			continue
+		}
+		infos[i] = &viewInfo{FileInfo: info, name: k.encryptName(info.Name()), v: v,
+			diskPath: diskPath + "/" + info.Name()}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (v *View) Walk(root string, fn filepath.WalkFunc) error {
+	return fsops.Walk(v, root, fn)
+}
+
+func (v *View) Open(path string) (fsops.File, error) {
+	return v.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (v *View) OpenFile(path string, flag int, perm os.FileMode) (fsops.File, error) {
+	diskPath, raw, err := v.toDisk(path)
+	if err != nil {
+		return nil, pathError("open", path, err)
+	}
+	if raw {
+		file, err := v.disk.OpenFile(diskPath, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &namedFile{File: file, name: path}, nil
+	}
+	k := v.currentKeys()
+	if k == nil {
+		return nil, pathError("open", path, errLocked)
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return v.openWrite(k, path, diskPath, flag, perm)
+	}
+	file, err := v.disk.OpenFile(diskPath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := v.disk.Stat(diskPath)
+	if err != nil || info.IsDir() {
+		// folders are only opened to be synced
+		return &namedFile{File: file, name: path}, err
+	}
+	r, err := newEncReader(k, file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readFile{namedFile: namedFile{File: file, name: path}, r: r}, nil
+}
+
+// file on disk under its name in view
+type namedFile struct {
+	fsops.File
+	name string
+}
+
+func (f *namedFile) Name() string {
+	return f.name
+}
+
+// plaintext file read in encrypted form
+type readFile struct {
+	namedFile
+	r   *encReader
+	pos int64
+}
+
+func (f *readFile) Read(b []byte) (int, error) {
+	n, err := f.r.ReadAt(b, f.pos)
+	f.pos = f.pos + int64(n)
+	return n, err
+}
+
+func (f *readFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.r.ReadAt(b, off)
+}
+
+func (f *readFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, pathError("write", f.name, os.ErrPermission)
+}
+
+// encrypted content written to a plaintext file is kept in memory
+// and decrypted to disk once the file is synced or closed
+type writeFile struct {
+	name     string
+	diskPath string
+	v        *View
+	k        *keys
+	data     []byte
+	pos      int64
+	dirty    bool
+}
+
+func (v *View) openWrite(k *keys, path string, diskPath string, flag int, perm os.FileMode) (fsops.File, error) {
+	// create on disk with the flags given, content is written later
+	file, err := v.disk.OpenFile(diskPath, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	f := &writeFile{name: path, diskPath: diskPath, v: v, k: k, data: []byte{}}
+	if flag&os.O_TRUNC != 0 {
+		f.dirty = true
+		return f, nil
+	}
+	info, err := v.disk.Stat(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newEncReader(k, file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	f.data = make([]byte, r.Size())
+	if _, err := r.ReadAt(f.data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *writeFile) Name() string {
+	return f.name
+}
+
+func (f *writeFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.pos)
+	f.pos = f.pos + int64(n)
+	return n, err
+}
+
+func (f *writeFile) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *writeFile) WriteAt(b []byte, off int64) (int, error) {
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], b)
+	f.dirty = true
+	return len(b), nil
+}
+
+func (f *writeFile) Sync() error {
+	if !f.dirty {
+		return nil
+	}
+	plain, err := f.k.decrypt(f.data)
+	if err != nil {
+		return pathError("write", f.name, err)
+	}
+	if err := fsops.WriteAll(f.v.disk, f.diskPath, plain); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *writeFile) Close() error {
+	return f.Sync()
+}
+
+func (v *View) Rename(oldpath string, newpath string) error {
+	oldDisk, oldRaw, err := v.toDisk(oldpath)
+	if err != nil {
+		return pathError("rename", oldpath, err)
+	}
+	newDisk, newRaw, err := v.toDisk(newpath)
+	if err != nil {
+		return pathError("rename", newpath, err)
+	}
+	if !oldRaw || newRaw || !v.isStaging(oldpath) {
+		return v.disk.Rename(oldDisk, newDisk)
+	}
+	return v.commitStaging(oldDisk, newDisk)
+}
+
+// decrypt received file into place, nothing is changed if it does not verify
+func (v *View) commitStaging(stagingPath string, dest string) error {
+	k := v.currentKeys()
+	if k == nil {
+		return pathError("rename", stagingPath, errLocked)
+	}
+	data, err := fsops.ReadAll(v.disk, stagingPath)
+	if err != nil {
+		return err
+	}
+	plain, err := k.decrypt(data)
+	if err != nil {
+		return pathError("rename", stagingPath, err)
+	}
+
+	file, err := fsops.CreateStagingFile(v.disk, strings.TrimSuffix(v.root, "/"))
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(plain, 0); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		if info, err := v.disk.Stat(stagingPath); err == nil {
+			v.disk.Chmod(file.Name(), info.Mode())
+		}
+		err = v.disk.Rename(file.Name(), dest)
+	}
+	if err != nil {
+		v.disk.Remove(file.Name())
+		return err
+	}
+	return v.disk.Remove(stagingPath)
+}
+
+func (v *View) Remove(path string) error {
+	diskPath, _, err := v.toDisk(path)
+	if err != nil {
+		return pathError("remove", path, err)
+	}
+	return v.disk.Remove(diskPath)
+}
+
+func (v *View) RemoveAll(path string) error {
+	diskPath, _, err := v.toDisk(path)
+	if err != nil {
+		return pathError("remove", path, err)
+	}
+	return v.disk.RemoveAll(diskPath)
+}
+
+func (v *View) Mkdir(path string, perm os.FileMode) error {
+	diskPath, _, err := v.toDisk(path)
+	if err != nil {
+		return pathError("mkdir", path, err)
+	}
+	return v.disk.Mkdir(diskPath, perm)
+}
+
+func (v *View) MkdirAll(path string, perm os.FileMode) error {
+	diskPath, _, err := v.toDisk(path)
+	if err != nil {
+		return pathError("mkdir", path, err)
+	}
+	return v.disk.MkdirAll(diskPath, perm)
+}
+
+func (v *View) Chmod(path string, mode os.FileMode) error {
+	diskPath, _, err := v.toDisk(path)
+	if err != nil {
+		return pathError("chmod", path, err)
+	}
+	return v.disk.Chmod(diskPath, mode)
+}
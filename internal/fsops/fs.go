@@ -0,0 +1,151 @@
+package fsops
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// filesystem the sync logic works on
+// paths are absolute, separated by "/"
+type FS interface {
+	Stat(path string) (os.FileInfo, error)
+	// entries of a folder sorted by name
+	ReadDir(path string) ([]os.FileInfo, error)
+	// same as filepath.Walk
+	Walk(root string, fn filepath.WalkFunc) error
+	// open file for reading
+	Open(path string) (File, error)
+	// same flags as os.OpenFile
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath string, newpath string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Mkdir(path string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Chmod(path string, mode os.FileMode) error
+}
+
+// opened file, satisfied by *os.File
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Sync() error
+}
+
+// filesystem presenting a folder on disk in another form, such as encrypted
+// changes can only be watched on the disk and are mapped into the view
+type View interface {
+	FS
+	// filesystem the folder really lives on
+	Disk() FS
+	// path in the view of a path on disk
+	ToView(path string) string
+	// path on disk of a path in the view
+	ToDisk(path string) string
+}
+
+// the real disk
+type OSFS struct{}
+
+var OS FS = OSFS{}
+
+func (OSFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OSFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path)
+}
+
+func (OSFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (OSFS) Open(path string) (File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFS) Mkdir(path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+// filepath.Walk on top of any FS
+func Walk(fsys FS, root string, fn filepath.WalkFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkHelper(fsys, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkHelper(fsys FS, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	entries, err := fsys.ReadDir(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	sortInfos(entries)
+	for _, entry := range entries {
+		err = walkHelper(fsys, path+"/"+entry.Name(), entry, fn)
+		if err != nil {
+			if !entry.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+}
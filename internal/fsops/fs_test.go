@@ -0,0 +1,132 @@
+package fsops
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// run the same operations on the real disk and in memory
+// both must end up with the same tree
+func TestMemFSMatchesOS(t *testing.T) {
+	osRoot := t.TempDir()
+	mem := NewMemFS()
+	if err := mem.MkdirAll("/tmp/root", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		fsys FS
+		root string
+	}{{OS, osRoot}, {mem, "/tmp/root"}} {
+		fsys, root := c.fsys, c.root
+		steps := []error{
+			Makedir(fsys, root+"/a"),
+			MakedirAll(fsys, root+"/a/b/c"),
+			WriteAll(fsys, root+"/a/f.txt", []byte("hello")),
+			Create(fsys, root+"/a/b/empty"),
+			fsys.Chmod(root+"/a/f.txt", 0600),
+			Rename(fsys, root+"/a/b", root+"/moved"),
+			WriteAll(fsys, root+"/moved/c/g.txt", []byte("world")),
+			Delete(fsys, root+"/moved/c"),
+		}
+		for i, err := range steps {
+			if err != nil {
+				t.Fatalf("step %d on %T: %v", i, fsys, err)
+			}
+		}
+		if _, err := WriteOnce(fsys, root+"/a/f.txt", []byte("J"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.Mkdir(root+"/a", 0777); !os.IsExist(err) {
+			t.Fatalf("mkdir existing folder on %T: %v", fsys, err)
+		}
+		if _, err := fsys.Stat(root + "/missing"); !os.IsNotExist(err) {
+			t.Fatalf("stat missing file on %T: %v", fsys, err)
+		}
+	}
+
+	if got, want := tree(t, mem, "/tmp/root"), tree(t, OS, osRoot); !reflect.DeepEqual(got, want) {
+		t.Fatalf("memory tree %v, want %v", got, want)
+	}
+	data, err := ReadAll(mem, "/tmp/root/a/f.txt")
+	if err != nil || string(data) != "Jello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	info, err := mem.Stat("/tmp/root/a/f.txt")
+	if err != nil || info.Mode().Perm() != 0600 || info.Size() != 5 {
+		t.Fatalf("stat %v, %v", info, err)
+	}
+}
+
+// relative path to size, -1 for folders
+func tree(t *testing.T, fsys FS, root string) map[string]int64 {
+	result := make(map[string]int64)
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			result[rel] = -1
+		} else {
+			result[rel] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMemFSStaging(t *testing.T) {
+	fsys := NewMemFS()
+	if err := MakedirAll(fsys, "/root"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := CreateStagingFile(fsys, "/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitStagingFile(fsys, file, "/root/dest", GetFileMd5(fsys, file.Name())); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadAll(fsys, "/root/dest"); err != nil || string(data) != "content" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	file, err = CreateStagingFile(fsys, "/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitStagingFile(fsys, file, "/root/dest", []byte("bad checksum")); err == nil {
+		t.Fatal("commit with wrong checksum succeeded")
+	}
+	if IsFileExist(fsys, file.Name()) {
+		t.Fatal("staging file left after failed commit")
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	patterns := []string{"*.log", "node_modules", "/build/tmp"}
+	for path, want := range map[string]bool{
+		"/a.log":                 true,
+		"/src/debug.log":         true,
+		"/src/node_modules/x.js": true,
+		"/build/tmp":             true,
+		"/build/tmp/out.o":       true,
+		"/build/out.o":           false,
+		"/src/build/tmp":         false,
+		"/log.txt":               false,
+		"/":                      false,
+	} {
+		if got := IsIgnored(patterns, path); got != want {
+			t.Errorf("%s ignored %v, want %v", path, got, want)
+		}
+	}
+}
@@ -1,46 +1,42 @@
 package fsops
 
 import (
+	"crypto/md5"
 	"errors"
 	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
 
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
 
-var currentFile *os.File
-var isOpened bool = false
 var logtag string = "[FsOps]"
 
-func IsFileExist(path string) bool {
-	file, err := os.Open(path)
-	result := true
-	if err != nil {
-		// log.Println(filename + " not exist")
-		result = false
-	}
-	defer file.Close()
-	return result
+func IsFileExist(fsys FS, path string) bool {
+	_, err := fsys.Stat(path)
+	// log.Println(filename + " not exist")
+	return err == nil
 }
 
-func IsFolder(path string) (bool, error) {
-	fileinfo, err := os.Stat(path)
+func IsFolder(fsys FS, path string) (bool, error) {
+	fileinfo, err := fsys.Stat(path)
 	if err != nil {
 		return false, err
 	}
 	return fileinfo.IsDir(), err
 }
 
-func GetFileList(path string) (flist []string, err error) {
-	if ok, _ := IsFolder(path); !ok {
+func GetFileList(fsys FS, path string) (flist []string, err error) {
+	if ok, _ := IsFolder(fsys, path); !ok {
 		return flist, errors.New("not a folder")
 	}
 
-	filist, err := ioutil.ReadDir(path)
+	filist, err := fsys.ReadDir(path)
 	common.ErrorHandleDebug(logtag, err)
 
 	for _, f := range filist {
@@ -51,18 +47,18 @@ func GetFileList(path string) (flist []string, err error) {
 	return
 }
 
-func GetSubDirs(path string) (dirlist []string, err error) {
-	if ok, _ := IsFolder(path); !ok {
+func GetSubDirs(fsys FS, path string) (dirlist []string, err error) {
+	if ok, _ := IsFolder(fsys, path); !ok {
 		return dirlist, errors.New("not a folder")
 	}
 
-	filist, err := ioutil.ReadDir(path)
+	filist, err := fsys.ReadDir(path)
 	if err != nil {
 		log.Println(logtag, "read dir error")
 	}
 
 	for _, f := range filist {
-		if f.IsDir() {
+		if f.IsDir() && !IsInternalPath(f.Name()) {
 			fname := path + "/" + f.Name()
 			dirlist = append(dirlist, fname)
 		}
@@ -71,33 +67,39 @@ func GetSubDirs(path string) (dirlist []string, err error) {
 	return
 }
 
-func Makedir(path string) (err error) {
-	if !IsFileExist(path) {
+func Makedir(fsys FS, path string) (err error) {
+	if !IsFileExist(fsys, path) {
 		log.Println(logtag, "mkdir:", path)
-		return os.Mkdir(path, 0777)
+		return fsys.Mkdir(path, 0777)
 	}
 	return nil
 }
 
-func Delete(path string) (err error) {
-	return os.RemoveAll(path)
+func MakedirAll(fsys FS, path string) (err error) {
+	return fsys.MkdirAll(path, 0777)
 }
 
-func Create(path string) (err error) {
-	if !IsFileExist(path) {
-		file, err := os.Create(path)
-		file.Close()
-		return err
+func Delete(fsys FS, path string) (err error) {
+	return fsys.RemoveAll(path)
+}
+
+func Create(fsys FS, path string) (err error) {
+	if !IsFileExist(fsys, path) {
+		file, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		return file.Close()
 	}
 	return nil
 }
 
-func Rename(old string, new string) (err error) {
-	return os.Rename(old, new)
+func Rename(fsys FS, old string, new string) (err error) {
+	return fsys.Rename(old, new)
 }
 
-func WriteOnce(path string, b []byte, off int64) (n int, err error) {
-	file, err := os.OpenFile(path, os.O_WRONLY, 0777)
+func WriteOnce(fsys FS, path string, b []byte, off int64) (n int, err error) {
+	file, err := fsys.OpenFile(path, os.O_WRONLY, 0777)
 	if err != nil {
 		return -1, err
 	}
@@ -105,8 +107,8 @@ func WriteOnce(path string, b []byte, off int64) (n int, err error) {
 	return file.WriteAt(b, off)
 }
 
-func ReadOnce(path string, b []byte, off int64) (n int, err error) {
-	file, err := os.Open(path)
+func ReadOnce(fsys FS, path string, b []byte, off int64) (n int, err error) {
+	file, err := fsys.Open(path)
 	if err != nil {
 		return -1, err
 	}
@@ -114,123 +116,77 @@ func ReadOnce(path string, b []byte, off int64) (n int, err error) {
 	return file.ReadAt(b, off)
 }
 
-func Write(path string, b []byte, off int64) (n int, err error) {
-	if !IsFileExist(path) {
-		Create(path)
-	}
-	if !isOpened {
-		currentFile, err = os.OpenFile(path, os.O_WRONLY, 0777)
-		if err != nil {
-			return -1, err
-		}
-		isOpened = true
-	}
-	return currentFile.WriteAt(b, off)
+func OpenRead(fsys FS, path string) (file File, err error) {
+	return fsys.Open(path)
 }
 
-func Read(path string, b []byte, off int64) (n int, err error) {
-	if !isOpened {
-		currentFile, err = os.Open(path)
-		if err != nil {
-			return -1, err
-		}
-		isOpened = true
+func ReadAll(fsys FS, path string) (b []byte, err error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	return currentFile.ReadAt(b, off)
+	defer file.Close()
+	return ioutil.ReadAll(file)
 }
 
-func ReadAll(path string) (b []byte, err error) {
-	filesize, err := GetFileSize(path)
-	common.ErrorHandleDebug(logtag, err)
-	databuff := make([]byte, filesize)
-
-	offset := 0
-	for {
-		n, err := Read(path, databuff[offset:], int64(offset))
-		common.ErrorHandleDebug(logtag, err)
-		if n > 0 {
-			offset = offset + n
-		} else {
-			break
-		}
+// write the whole file, replacing its content
+func WriteAll(fsys FS, path string, b []byte) (err error) {
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
 	}
-	CloseCurrentFile()
-	return databuff, err
-}
-
-func WriteAll(path string, b []byte) (err error) {
-	offset := 0
-	for {
-		n, err := Write(path, b[offset:], int64(offset))
-		common.ErrorHandleDebug(logtag, err)
-		if n < len(b)-offset {
-			offset = offset + n
-		} else {
-			break
-		}
+	if _, err = file.WriteAt(b, 0); err != nil {
+		file.Close()
+		return err
 	}
-	CloseCurrentFile()
-	return err
+	return file.Close()
 }
-func WriteAllAt(path string, b []byte, offset int) (err error) {
-	count := 0
-	for {
-		n, err := Write(path, b[count:], int64(offset))
+
+// @return: nil if file cannot be read
+func GetFileMd5(fsys FS, path string) []byte {
+	file, err := fsys.Open(path)
+	if err != nil {
 		common.ErrorHandleDebug(logtag, err)
-		if n < len(b)-offset {
-			offset = offset + n
-			count = count + n
-		} else {
-			break
-		}
+		return nil
 	}
-	CloseCurrentFile()
-	return err
-}
-
-// do not forget to call it after read or write
-func CloseCurrentFile() {
-	currentFile.Close()
-	isOpened = false
+	defer file.Close()
+	md5h := md5.New()
+	io.Copy(md5h, file)
+	return md5h.Sum([]byte{})
 }
 
-func GetAllFile(path string) (result []string) {
-	return getAllFileHelper(path, result)
+func GetAllFile(fsys FS, path string) (result []string) {
+	return getAllFileHelper(fsys, path, result)
 }
 
-func getAllFileHelper(path string, result []string) []string {
+func getAllFileHelper(fsys FS, path string, result []string) []string {
 	if FileHasSuffix(path, ".DS_Store") ||
 		FileHasSuffix(path, ".swp") ||
-		FileHasSuffix(path, "~") {
+		FileHasSuffix(path, "~") ||
+		IsInternalPath(path) {
 		return result
 	}
 	result = append(result, path)
-	if ok, _ := IsFolder(path); !ok {
+	if ok, _ := IsFolder(fsys, path); !ok {
 		return result
 	}
 
-	filist, err := ioutil.ReadDir(path)
+	filist, err := fsys.ReadDir(path)
 	common.ErrorHandleDebug(logtag, err)
 
 	for _, file := range filist {
-		result = getAllFileHelper(path+"/"+file.Name(), result)
+		result = getAllFileHelper(fsys, path+"/"+file.Name(), result)
 	}
 	return result
 }
 
-func RemoveRootPrefix(path string, isClient bool) (result string) {
+func RemoveRootPrefix(path string, root string) (result string) {
 	// assume all input include root path
-	b := []byte(path)
-	if isClient {
-		b = b[len(config.ClientRootPath):]
-	} else {
-		b = b[len(config.ServerRootPath):]
-	}
-	return string(b)
+	return path[len(root):]
 }
 
-func GetFileSize(path string) (size int64, err error) {
-	fileinfo, err := os.Stat(path)
+func GetFileSize(fsys FS, path string) (size int64, err error) {
+	fileinfo, err := fsys.Stat(path)
 	if err != nil {
 		return 0, err
 	}
@@ -248,10 +204,55 @@ func GetFolder(path string) (folder string) {
 	return
 }
 
-func FileHasSuffix(path string, suffix string) bool {
-	if strings.Compare(path[len(path)-len(suffix):], suffix) == 0 {
-		return true
-	} else {
-		return false
+// whether the path lies in one of the reserved folders
+// which should never be synced or watched
+func IsInternalPath(path string) bool {
+	for _, token := range strings.Split(filepath.ToSlash(path), "/") {
+		if token == common.TrashDir || token == common.StagingDir || token == common.ChunkDir ||
+			token == common.KeyCheckFile {
+			return true
+		}
+	}
+	return false
+}
+
+// whether one of the ignore patterns matches the path
+// a pattern without "/" such as "*.log" matches any name on the path,
+// one with "/" such as "build/tmp" matches from root on, including everything below
+// @rel: path relative to root
+func IsIgnored(patterns []string, rel string) bool {
+	names := strings.Split(strings.Trim(filepath.ToSlash(rel), "/"), "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, "/") {
+			for _, name := range names {
+				if ok, _ := path.Match(pattern, name); ok {
+					return true
+				}
+			}
+			continue
+		}
+		parts := strings.Split(pattern, "/")
+		if len(parts) > len(names) {
+			continue
+		}
+		matched := true
+		for i, part := range parts {
+			if ok, _ := path.Match(part, names[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
 	}
+	return false
+}
+
+func FileHasSuffix(path string, suffix string) bool {
+	return strings.HasSuffix(path, suffix)
 }
@@ -0,0 +1,346 @@
+package fsops
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filesystem kept in memory, for tests and as a scratch storage
+// opened files keep working on their content after rename or remove,
+// like inodes do on unix
+type MemFS struct {
+	lock  sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func NewMemFS() *MemFS {
+	m := &MemFS{nodes: make(map[string]*memNode)}
+	m.nodes["/"] = &memNode{dir: true, mode: os.ModeDir | 0777, modTime: time.Now()}
+	return m
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+func pathError(op string, p string, err error) error {
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// must be called with lock held
+func (m *MemFS) parentIsDir(p string) bool {
+	parent, ok := m.nodes[path.Dir(p)]
+	return ok && parent.dir
+}
+
+func (m *MemFS) Stat(p string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return nil, pathError("stat", p, os.ErrNotExist)
+	}
+	return node.info(path.Base(p)), nil
+}
+
+func (m *MemFS) ReadDir(p string) ([]os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return nil, pathError("readdir", p, os.ErrNotExist)
+	}
+	if !node.dir {
+		return nil, pathError("readdir", p, errors.New("not a directory"))
+	}
+
+	var entries []os.FileInfo
+	for name, child := range m.nodes {
+		if name != p && path.Dir(name) == p {
+			entries = append(entries, child.info(path.Base(name)))
+		}
+	}
+	sortInfos(entries)
+	return entries, nil
+}
+
+func (m *MemFS) Walk(root string, fn filepath.WalkFunc) error {
+	return Walk(m, root, fn)
+}
+
+func (m *MemFS) Open(p string) (File, error) {
+	return m.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(p string, flag int, perm os.FileMode) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name := p
+	p = cleanPath(p)
+	node, ok := m.nodes[p]
+	if ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, pathError("open", p, os.ErrExist)
+	}
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, pathError("open", p, os.ErrNotExist)
+		}
+		if !m.parentIsDir(p) {
+			return nil, pathError("open", p, os.ErrNotExist)
+		}
+		node = &memNode{mode: perm, modTime: time.Now()}
+		m.nodes[p] = node
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && node.dir {
+		return nil, pathError("open", p, errors.New("is a directory"))
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+}
+
+func (m *MemFS) Rename(oldpath string, newpath string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	oldpath = cleanPath(oldpath)
+	newpath = cleanPath(newpath)
+	node, ok := m.nodes[oldpath]
+	if !ok {
+		return pathError("rename", oldpath, os.ErrNotExist)
+	}
+	if !m.parentIsDir(newpath) {
+		return pathError("rename", newpath, os.ErrNotExist)
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	if node.dir && strings.HasPrefix(newpath, oldpath+"/") {
+		return pathError("rename", newpath, errors.New("invalid argument"))
+	}
+	if dest, ok := m.nodes[newpath]; ok {
+		if dest.dir != node.dir || (dest.dir && m.hasChildren(newpath)) {
+			return pathError("rename", newpath, os.ErrExist)
+		}
+	}
+
+	for name, child := range m.nodes {
+		if strings.HasPrefix(name, oldpath+"/") {
+			delete(m.nodes, name)
+			m.nodes[newpath+name[len(oldpath):]] = child
+		}
+	}
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = node
+	return nil
+}
+
+// must be called with lock held
+func (m *MemFS) hasChildren(p string) bool {
+	for name := range m.nodes {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFS) Remove(p string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	if _, ok := m.nodes[p]; !ok {
+		return pathError("remove", p, os.ErrNotExist)
+	}
+	if m.hasChildren(p) {
+		return pathError("remove", p, errors.New("directory not empty"))
+	}
+	delete(m.nodes, p)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(p string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	if p == "/" {
+		return pathError("removeall", p, errors.New("invalid argument"))
+	}
+	for name := range m.nodes {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			delete(m.nodes, name)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Mkdir(p string, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	if _, ok := m.nodes[p]; ok {
+		return pathError("mkdir", p, os.ErrExist)
+	}
+	if !m.parentIsDir(p) {
+		return pathError("mkdir", p, os.ErrNotExist)
+	}
+	m.nodes[p] = &memNode{dir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(p string, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	var missing []string
+	for cur := p; ; cur = path.Dir(cur) {
+		node, ok := m.nodes[cur]
+		if ok {
+			if !node.dir {
+				return pathError("mkdir", cur, errors.New("not a directory"))
+			}
+			break
+		}
+		missing = append(missing, cur)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		m.nodes[missing[i]] = &memNode{dir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFS) Chmod(p string, mode os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p = cleanPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return pathError("chmod", p, os.ErrNotExist)
+	}
+	node.mode = node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime, dir: n.dir}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() os.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset = f.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.node.dir {
+		return 0, pathError("read", f.name, errors.New("is a directory"))
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathError("write", f.name, errors.New("bad file descriptor"))
+	}
+	if off < 0 {
+		return 0, pathError("write", f.name, errors.New("negative offset"))
+	}
+	end := off + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[off:], b)
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
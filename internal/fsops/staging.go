@@ -0,0 +1,106 @@
+package fsops
+
+import (
+	"bytes"
+	"errors"
+	"gcloudsync/internal/common"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// incoming content is written into a private staging folder first,
+// then moved into place by an atomic rename once it is complete.
+// a crash in between leaves the destination untouched.
+
+// makes staging file names unique within the process
+var stagingCount uint64
+
+func stagingPath(root string) string {
+	return root + "/" + common.StagingDir
+}
+
+// create an empty staging file under root
+func CreateStagingFile(fsys FS, root string) (file File, err error) {
+	err = MakedirAll(fsys, stagingPath(root))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 10000; i++ {
+		name := stagingPath(root) + "/incoming-" + strconv.FormatInt(time.Now().UnixNano(), 36) +
+			"-" + strconv.FormatUint(atomic.AddUint64(&stagingCount, 1), 36)
+		file, err = fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+	return nil, err
+}
+
+// flush staging file to disk, verify it against checksum and
+// move it to dest atomically. staging file is removed on failure.
+// @checksum: expected md5 of the whole file, nil to skip verification
+func CommitStagingFile(fsys FS, file File, dest string, checksum []byte) (err error) {
+	tmpPath := file.Name()
+	defer func() {
+		if err != nil {
+			fsys.Remove(tmpPath)
+		}
+	}()
+
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if checksum != nil {
+		md5 := GetFileMd5(fsys, tmpPath)
+		if !bytes.Equal(md5, checksum) {
+			return errors.New("checksum mismatch")
+		}
+	}
+
+	// keep permission of the file to be replaced
+	if fileinfo, err := fsys.Stat(dest); err == nil {
+		fsys.Chmod(tmpPath, fileinfo.Mode())
+	}
+
+	if err = fsys.Rename(tmpPath, dest); err != nil {
+		return err
+	}
+	syncFolder(fsys, filepath.Dir(dest))
+	return nil
+}
+
+// drop an unfinished staging file
+func DiscardStagingFile(fsys FS, file File) {
+	if file == nil {
+		return
+	}
+	file.Close()
+	fsys.Remove(file.Name())
+}
+
+// remove staging files left by an interrupted run
+func CleanStagingDir(fsys FS, root string) error {
+	return fsys.RemoveAll(stagingPath(root))
+}
+
+// make the rename durable, not supported on windows
+func syncFolder(fsys FS, path string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	folder, err := fsys.Open(path)
+	if err != nil {
+		return
+	}
+	defer folder.Close()
+	folder.Sync()
+}
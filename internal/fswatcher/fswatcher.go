@@ -4,6 +4,7 @@ import (
 	"errors"
 	"gcloudsync/internal/common"
 	"gcloudsync/internal/fsops"
+	"path/filepath"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -11,20 +12,22 @@ import (
 var logtag string = "[FsWatcher]"
 
 type FsWatcher struct {
+	fs      fsops.FS
 	path    string
 	fileMap map[string]int
 	fschan  chan common.FsEvent
 	watcher *fsnotify.Watcher
 }
 
-func NewFsWatcher(path string) *FsWatcher {
-	f := new(FsWatcher)
+// events come from the os, so fsys should be backed by the real disk
+func NewFsWatcher(fsys fsops.FS, path string) *FsWatcher {
+	f := &FsWatcher{fs: fsys}
 	// set monitor path
 	err := f.setPath(path)
 	common.ErrorHandleFatal(logtag, err)
 	// add all file to map
 	f.fileMap = make(map[string]int)
-	flist := fsops.GetAllFile(path)
+	flist := fsops.GetAllFile(f.fs, path)
 
 	for _, file := range flist {
 		f.fileMap[file] = 1
@@ -36,12 +39,16 @@ func NewFsWatcher(path string) *FsWatcher {
 	// make a channal for communication
 	ch := make(chan common.FsEvent)
 	f.fschan = ch
+
+	// changes are recorded from now on
+	err = f.addAll()
+	common.ErrorHandleFatal(logtag, err)
 	return f
 }
 
 func (f *FsWatcher) setPath(path string) (err error) {
 	// check path availibitiy
-	ok := fsops.IsFileExist(path)
+	ok := fsops.IsFileExist(f.fs, path)
 	if !ok {
 		return errors.New("file not exist")
 	}
@@ -58,7 +65,7 @@ func (f *FsWatcher) GetChan() chan common.FsEvent {
 func (f *FsWatcher) toFsEvent(event fsnotify.Event) (common.FsEvent, error) {
 	var op common.FsOp
 	var isdir bool
-	if ok, _ := fsops.IsFolder(event.Name); ok {
+	if ok, _ := fsops.IsFolder(f.fs, event.Name); ok {
 		isdir = true
 	} else {
 		isdir = false
@@ -92,12 +99,12 @@ func (f *FsWatcher) addAll() (err error) {
 
 // add all subdir recursively
 func (f *FsWatcher) addDir(path string) (err error) {
-	if ok, _ := fsops.IsFolder(path); !ok {
+	if ok, _ := fsops.IsFolder(f.fs, path); !ok {
 		return errors.New("not a folder")
 	}
 	f.watcher.Add(path)
 
-	flist, err := fsops.GetSubDirs(path)
+	flist, err := fsops.GetSubDirs(f.fs, path)
 	common.ErrorHandleDebug(logtag, err)
 
 	for _, folder := range flist {
@@ -107,7 +114,7 @@ func (f *FsWatcher) addDir(path string) (err error) {
 }
 
 func (f *FsWatcher) getEvent(fsevent common.FsEvent) (common.FsEvent, error) {
-	flist := fsops.GetAllFile(f.path)
+	flist := fsops.GetAllFile(f.fs, f.path)
 
 	if len(f.fileMap) == len(flist) {
 		// rename or modify
@@ -128,7 +135,7 @@ func (f *FsWatcher) getEvent(fsevent common.FsEvent) (common.FsEvent, error) {
 		}
 	} else if len(f.fileMap) < len(flist) {
 		// create
-		if ok, _ := fsops.IsFolder(fsevent.FileName); ok {
+		if ok, _ := fsops.IsFolder(f.fs, fsevent.FileName); ok {
 			fsevent.Op = common.OpMkdir
 		}
 		return fsevent, nil
@@ -143,18 +150,53 @@ func (f *FsWatcher) getEvent(fsevent common.FsEvent) (common.FsEvent, error) {
 
 func (f *FsWatcher) updateFileMap() {
 	f.fileMap = make(map[string]int)
-	flist := fsops.GetAllFile(f.path)
+	flist := fsops.GetAllFile(f.fs, f.path)
 
 	for _, file := range flist {
 		f.fileMap[file] = 1
 	}
 }
 
+// content created in a new folder before it was watched has no event of its own
+func (f *FsWatcher) emitDirContent(path string) {
+	flist := fsops.GetAllFile(f.fs, path)
+	for _, file := range flist {
+		if file == path || f.fileMap[file] != 0 {
+			continue
+		}
+		event := common.FsEvent{Op: common.OpCreate, FileName: file}
+		if ok, _ := fsops.IsFolder(f.fs, file); ok {
+			event.Op = common.OpMkdir
+		}
+		f.fschan <- event
+	}
+}
+
+// a folder removed recursively gives one event per entry, but the map
+// is updated after the first one already, so report everything gone at once
+// only the topmost of the removed paths are reported
+// the map is updated from the same listing, since more may vanish while
+// events are sent and the later events of it must not find the map current
+func (f *FsWatcher) emitRemoved() {
+	exist := make(map[string]int)
+	for _, file := range fsops.GetAllFile(f.fs, f.path) {
+		exist[file] = 1
+	}
+	for file := range f.fileMap {
+		if exist[file] != 0 || f.fileMap[filepath.Dir(file)] != 0 && exist[filepath.Dir(file)] == 0 {
+			continue
+		}
+		f.fschan <- common.FsEvent{Op: common.OpRemove, FileName: file}
+	}
+	f.fileMap = exist
+}
+
 func (f *FsWatcher) StartWatching() {
 	defer f.watcher.Close()
 
 	done := make(chan bool)
 	go func() {
+		defer close(done)
 		for {
 			select {
 			case event, ok := <-f.watcher.Events:
@@ -165,7 +207,14 @@ func (f *FsWatcher) StartWatching() {
 				common.ErrorHandleDebug(logtag, err)
 
 				if fseventNew, err := f.getEvent(fsevent); err == nil {
+					if fseventNew.Op == common.OpRemove {
+						f.emitRemoved()
+						continue
+					}
 					f.fschan <- fseventNew
+					if fseventNew.Op == common.OpMkdir {
+						f.emitDirContent(fseventNew.FileName)
+					}
 					f.updateFileMap()
 				}
 
@@ -178,7 +227,10 @@ func (f *FsWatcher) StartWatching() {
 		}
 	}()
 
-	err := f.addAll()
-	common.ErrorHandleFatal(logtag, err)
 	<-done
 }
+
+// stop watching, StartWatching will return
+func (f *FsWatcher) Close() error {
+	return f.watcher.Close()
+}
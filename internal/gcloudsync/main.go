@@ -0,0 +1,10 @@
+package main
+
+import (
+	"gcloudsync/internal/cli"
+	"os"
+)
+
+func main() {
+	os.Exit(cli.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,170 @@
+package harness
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// what goes wrong on a faulty connection
+// every write of the framing layer carries exactly one frame,
+// so faults are applied frame by frame in the writing direction
+type Faults struct {
+	// probability of a frame being lost
+	Drop float64
+	// every frame is held back for a random time up to Delay
+	Delay time.Duration
+	// probability of a frame being overtaken by the next frame of another stream
+	Reorder float64
+	// probability of only a part of a frame being written
+	Truncate float64
+	// probability of one byte of a frame being flipped
+	Corrupt float64
+	// connection is closed once this many bytes are written, 0 means never
+	CutAt int64
+}
+
+// offsets in a frame header, see network/frame.go
+const (
+	frameStreamOffset = 3
+	frameHeaderSize   = 15
+)
+
+// makes connections misbehave, use Wrap as the Wrap hook of a transport
+type Injector struct {
+	faults Faults
+	// only the first limit connections are faulty, 0 means all
+	limit int
+
+	lock  sync.Mutex
+	count int
+	rand  *rand.Rand
+}
+
+// @limit: number of connections to be faulty, 0 means all
+// note that MemListener wraps both ends of a connection
+func NewInjector(faults Faults, limit int, seed int64) *Injector {
+	return &Injector{faults: faults, limit: limit, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (in *Injector) Wrap(conn net.Conn) net.Conn {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	in.count++
+	if in.limit > 0 && in.count > in.limit {
+		return conn
+	}
+	return &faultConn{Conn: conn, in: in}
+}
+
+// random number in [0, 1)
+func (in *Injector) float() float64 {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.rand.Float64()
+}
+
+func (in *Injector) intn(n int) int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.rand.Intn(n)
+}
+
+type faultConn struct {
+	net.Conn
+	in *Injector
+
+	lock    sync.Mutex
+	written int64
+	cut     bool
+	// frame held back to be reordered
+	held      []byte
+	heldTimer *time.Timer
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	f := c.in.faults
+	if f.Delay > 0 {
+		time.Sleep(time.Duration(c.in.intn(int(f.Delay))))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cut {
+		return 0, net.ErrClosed
+	}
+	if c.in.float() < f.Drop {
+		return len(b), nil
+	}
+
+	frame := append([]byte{}, b...)
+	if c.in.float() < f.Corrupt {
+		frame[c.in.intn(len(frame))] ^= 0xff
+	}
+	if c.in.float() < f.Truncate {
+		frame = frame[:c.in.intn(len(frame))]
+	}
+
+	if c.held != nil {
+		held := c.held
+		c.held = nil
+		c.heldTimer.Stop()
+		if stream(held) != stream(frame) {
+			// next frame of another stream overtakes the held one
+			if err := c.write(frame); err != nil {
+				return 0, err
+			}
+			return len(b), c.write(held)
+		}
+		if err := c.write(held); err != nil {
+			return 0, err
+		}
+	} else if stream(frame) != 0 && c.in.float() < f.Reorder {
+		// hold back until next frame comes, or for a while
+		c.held = frame
+		c.heldTimer = time.AfterFunc(20*time.Millisecond, c.flush)
+		return len(b), nil
+	}
+	return len(b), c.write(frame)
+}
+
+func (c *faultConn) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.held != nil {
+		c.write(c.held)
+		c.held = nil
+	}
+}
+
+// write through, cut connection once limit is reached
+// must be called with lock held
+func (c *faultConn) write(b []byte) error {
+	if c.cut {
+		return net.ErrClosed
+	}
+	limit := c.in.faults.CutAt
+	if limit > 0 && c.written+int64(len(b)) >= limit {
+		c.Conn.Write(b[:limit-c.written])
+		c.written = limit
+		c.cut = true
+		c.Conn.Close()
+		return net.ErrClosed
+	}
+	n, err := c.Conn.Write(b)
+	c.written = c.written + int64(n)
+	return err
+}
+
+// stream of a frame, -1 if frame is too short to tell
+func stream(frame []byte) int64 {
+	if len(frame) < frameHeaderSize {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint32(frame[frameStreamOffset:]))
+}
@@ -0,0 +1,103 @@
+package harness
+
+import (
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	cases := []struct {
+		name   string
+		faults Faults
+	}{
+		{"drop", Faults{Drop: 0.05}},
+		{"delay", Faults{Delay: 2 * time.Millisecond}},
+		{"reorder", Faults{Reorder: 0.3}},
+		{"truncate", Faults{Truncate: 0.05}},
+		{"corrupt", Faults{Corrupt: 0.05}},
+		{"cut early", Faults{CutAt: 100}},
+		{"cut late", Faults{CutAt: 50000}},
+		{"mixed", Faults{Drop: 0.02, Reorder: 0.2, Truncate: 0.02, Corrupt: 0.02}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCluster(t, 1)
+			// the first connection misbehaves, including both of its ends
+			c.Inject(NewInjector(tc.faults, 2, 1))
+
+			mkdir(t, c.ServerRoot+"/remote")
+			writeFile(t, c.ServerRoot+"/remote/a.txt", strings.Repeat("server ", 20000))
+			writeFile(t, c.ServerRoot+"/shared.txt", strings.Repeat("old ", 30000))
+			mkdir(t, c.ClientRoots[0]+"/local")
+			writeFile(t, c.ClientRoots[0]+"/local/b.txt", strings.Repeat("client ", 40000))
+			writeFile(t, c.ClientRoots[0]+"/shared.txt", strings.Repeat("new ", 30000))
+			for i := 0; i < 10; i++ {
+				writeFile(t, c.ClientRoots[0]+"/local/small"+string(rune('a'+i)), strings.Repeat("s", i*100))
+			}
+
+			c.StartServer()
+			if err := c.StartClient(0, 3*timeout); err != nil {
+				t.Fatal(err)
+			}
+			waitConverged(t, c, 0)
+
+			// changes after recovery are synced as usual
+			writeFile(t, c.ClientRoots[0]+"/local/late.txt", "after faults")
+			waitConverged(t, c, 0)
+		})
+	}
+}
+
+// connection dies while live changes are being synced
+func TestResumeAfterCut(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Inject(NewInjector(Faults{CutAt: 400000}, 2, 1))
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.ClientRoots[0]
+	for i := 0; i < 20; i++ {
+		writeFile(t, root+"/file"+string(rune('a'+i)), strings.Repeat(string(rune('a'+i)), 50000))
+	}
+	waitConverged(t, c, 0)
+}
+
+// opens the armed file slower than the stall timeout
+type slowFS struct {
+	fsops.FS
+	name  string
+	armed int32
+}
+
+func (fsys *slowFS) Open(path string) (fsops.File, error) {
+	if atomic.LoadInt32(&fsys.armed) == 1 && strings.HasSuffix(path, fsys.name) {
+		time.Sleep(2 * config.TransferIdleTimeout)
+	}
+	return fsys.FS.Open(path)
+}
+
+// checksum, diff and reform taking longer than the idle timeout are not a stall
+func TestSlowDelta(t *testing.T) {
+	c := newCluster(t, 1)
+	fsys := &slowFS{FS: fsops.OS, name: "/big.txt"}
+	c.ServerFS = fsys
+	writeFile(t, c.ClientRoots[0]+"/big.txt", strings.Repeat("old ", 50000))
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	// compare on disk, reads through the slow filesystem take as long as the sync
+	c.ServerFS = fsops.OS
+	waitConverged(t, c, 0)
+
+	atomic.StoreInt32(&fsys.armed, 1)
+	writeFile(t, c.ClientRoots[0]+"/big.txt", strings.Repeat("new ", 50000))
+	waitConverged(t, c, 0)
+}
@@ -0,0 +1,193 @@
+package harness
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gcloudsync/internal/core"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/network"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// run one server and several clients in the same process,
+// each on its own folder, connected through in-memory transport
+type Cluster struct {
+	ServerRoot  string
+	ClientRoots []string
+	// filesystem of server, the real disk unless changed before starting
+	ServerFS fsops.FS
+	// filesystem of each client, the real disk unless changed before starting
+	ClientFS []fsops.FS
+	// called on each client before it is used, to set remote folder, ignore patterns or direction
+	Configure func(i int, cc *core.ClientCore)
+	// folders below ServerRoot no client may write to
+	ReadOnlyFolders []string
+
+	listener *network.MemListener
+	server   *core.ServerCore
+	clients  []*core.ClientCore
+	// closed once StartClient of each client returns
+	exited []chan bool
+}
+
+// prepare folders under base for a server and n clients
+func NewCluster(base string, n int) (*Cluster, error) {
+	c := &Cluster{ServerRoot: base + "/server", ServerFS: fsops.OS, listener: network.NewMemListener()}
+	if err := fsops.MakedirAll(c.ServerFS, c.ServerRoot); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		root := base + "/client" + strconv.Itoa(i)
+		if err := fsops.MakedirAll(fsops.OS, root); err != nil {
+			return nil, err
+		}
+		c.ClientRoots = append(c.ClientRoots, root)
+		c.ClientFS = append(c.ClientFS, fsops.OS)
+	}
+	c.clients = make([]*core.ClientCore, n)
+	c.exited = make([]chan bool, n)
+	return c, nil
+}
+
+func (c *Cluster) StartServer() {
+	fsops.MakedirAll(c.ServerFS, c.ServerRoot)
+	sc := core.NewServerCore(c.ServerFS, c.ServerRoot, c.listener)
+	sc.ReadOnlyFolders = c.ReadOnlyFolders
+	c.server = &sc
+	go c.server.StartServer()
+}
+
+// make connections misbehave, must be called before anything is started
+func (c *Cluster) Inject(in *Injector) {
+	c.listener.Wrap = in.Wrap
+}
+
+// start client i and wait until its init is finished
+func (c *Cluster) StartClient(i int, timeout time.Duration) error {
+	cc := c.Client(i)
+	c.clients[i] = cc
+	exited := make(chan bool)
+	c.exited[i] = exited
+	go func() {
+		cc.StartClient()
+		close(exited)
+	}()
+
+	select {
+	case <-cc.Ready():
+		return nil
+	case <-exited:
+		return cc.Err()
+	case <-time.After(timeout):
+		return errors.New("client " + strconv.Itoa(i) + " not ready in time")
+	}
+}
+
+// client i for commands which connect once, nothing is started
+func (c *Cluster) Client(i int) *core.ClientCore {
+	cc := core.NewClientCore(c.ClientFS[i], c.ClientRoots[i], c.listener)
+	if c.Configure != nil {
+		c.Configure(i, &cc)
+	}
+	return &cc
+}
+
+func (c *Cluster) StopClient(i int) {
+	if c.clients[i] != nil {
+		c.clients[i].Stop()
+		c.clients[i] = nil
+		<-c.exited[i]
+	}
+}
+
+// stop all clients and the server, and wait until connections are handled
+func (c *Cluster) Close() {
+	for i := range c.clients {
+		c.StopClient(i)
+	}
+	c.listener.Close()
+	if c.server != nil {
+		c.server.Wait()
+	}
+}
+
+// wait until folder of client i is identical to server's
+// as seen through the filesystem of the client
+// a client started on a remote folder is compared with that folder
+func (c *Cluster) WaitConverged(i int, timeout time.Duration) error {
+	serverRoot := c.ServerRoot
+	if c.clients[i] != nil && c.clients[i].Remote != "" {
+		serverRoot = serverRoot + "/" + c.clients[i].Remote
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		diff, err := Compare(c.ServerFS, serverRoot, c.ClientFS[i], c.ClientRoots[i])
+		if err == nil && len(diff) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("client %d not converged: %v", i, diff)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// content of a folder, relative path to md5 of file or "dir"
+// reserved folders are left out
+func Snapshot(fsys fsops.FS, root string) (map[string]string, error) {
+	result := make(map[string]string)
+	err := fsys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if fsops.IsInternalPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel := filepath.ToSlash(path[len(root):])
+		if info.IsDir() {
+			result[rel] = "dir"
+		} else {
+			result[rel] = hex.EncodeToString(fsops.GetFileMd5(fsys, path))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// paths which differ between two folders
+func Compare(fsA fsops.FS, a string, fsB fsops.FS, b string) (diff []string, err error) {
+	sa, err := Snapshot(fsA, a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := Snapshot(fsB, b)
+	if err != nil {
+		return nil, err
+	}
+	for path, sum := range sa {
+		if sb[path] != sum {
+			diff = append(diff, path)
+		}
+	}
+	for path := range sb {
+		if _, ok := sa[path]; !ok {
+			diff = append(diff, path)
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
@@ -0,0 +1,870 @@
+package harness
+
+import (
+	"bytes"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/core"
+	"gcloudsync/internal/crypt"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/metadata"
+	"gcloudsync/internal/network"
+	"gcloudsync/internal/storage"
+	"gcloudsync/internal/trash"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const timeout = 10 * time.Second * raceSlowdown
+
+func TestMain(m *testing.M) {
+	if os.Getenv("GCS_VERBOSE") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+	// recover from faults quickly
+	config.TransferIdleTimeout = 500 * time.Millisecond
+	config.ReconnectInterval = 50 * time.Millisecond
+	config.RevertDelay = 50 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func newCluster(t *testing.T, n int) *Cluster {
+	c, err := NewCluster(t.TempDir(), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mkdir(t *testing.T, path string) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitConverged(t *testing.T, c *Cluster, i int) {
+	t.Helper()
+	if err := c.WaitConverged(i, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitialSync(t *testing.T) {
+	c := newCluster(t, 1)
+	mkdir(t, c.ServerRoot+"/docs")
+	writeFile(t, c.ServerRoot+"/docs/server.txt", "from server")
+	mkdir(t, c.ClientRoots[0]+"/src")
+	writeFile(t, c.ClientRoots[0]+"/src/client.txt", "from client")
+	writeFile(t, c.ClientRoots[0]+"/top.txt", strings.Repeat("x", 100000))
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	snap, err := Snapshot(c.ServerFS, c.ServerRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/docs/server.txt", "/src/client.txt", "/top.txt"} {
+		if _, ok := snap[path]; !ok {
+			t.Errorf("%s missing after initial sync", path)
+		}
+	}
+}
+
+func TestLiveChanges(t *testing.T) {
+	c := newCluster(t, 1)
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	root := c.ClientRoots[0]
+
+	steps := []struct {
+		name string
+		op   func()
+	}{
+		{"create", func() { writeFile(t, root+"/a.txt", "hello") }},
+		{"modify", func() { writeFile(t, root+"/a.txt", "hello world, again") }},
+		{"mkdir", func() { mkdir(t, root+"/dir") }},
+		{"create in dir", func() { writeFile(t, root+"/dir/b.txt", strings.Repeat("b", 50000)) }},
+		{"rename", func() {
+			if err := os.Rename(root+"/a.txt", root+"/dir/c.txt"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"delete", func() {
+			if err := os.Remove(root + "/dir/b.txt"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, step := range steps {
+		step.op()
+		if err := c.WaitConverged(0, timeout); err != nil {
+			t.Fatalf("after %s: %v", step.name, err)
+		}
+	}
+}
+
+func TestSecondClient(t *testing.T) {
+	c := newCluster(t, 2)
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	mkdir(t, c.ClientRoots[0]+"/shared")
+	writeFile(t, c.ClientRoots[0]+"/shared/note.txt", "written by first client")
+	waitConverged(t, c, 0)
+
+	if err := c.StartClient(1, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 1)
+}
+
+// server keeps its folder in memory
+func TestMemServer(t *testing.T) {
+	c := newCluster(t, 1)
+	c.ServerFS = fsops.NewMemFS()
+	c.ServerRoot = "/srv"
+	if err := fsops.MakedirAll(c.ServerFS, c.ServerRoot+"/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(c.ServerFS, c.ServerRoot+"/docs/server.txt", []byte("from server")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, c.ClientRoots[0]+"/client.txt", strings.Repeat("c", 70000))
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/client.txt", strings.Repeat("c", 30000)+"changed")
+	waitConverged(t, c, 0)
+	if err := os.Rename(root+"/client.txt", root+"/docs/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+	if err := os.RemoveAll(root + "/docs"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+}
+
+// server keeps its folder in an S3 bucket
+func TestS3Server(t *testing.T) {
+	s3 := NewFakeS3()
+	defer s3.Close()
+	// exercise paged listings
+	s3.PageSize = 2
+	fsys, err := storage.Open(s3.Config(), "/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCluster(t, 1)
+	c.ServerFS = fsys
+	c.ServerRoot = "/srv"
+	if err := fsops.MakedirAll(c.ServerFS, c.ServerRoot+"/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(c.ServerFS, c.ServerRoot+"/docs/server.txt", []byte("from server")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, c.ClientRoots[0]+"/client.txt", strings.Repeat("c", 70000))
+	mkdir(t, c.ClientRoots[0]+"/a/b")
+	writeFile(t, c.ClientRoots[0]+"/a/b/deep.txt", "deep")
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/client.txt", strings.Repeat("c", 30000)+"changed")
+	waitConverged(t, c, 0)
+	if err := os.Rename(root+"/a", root+"/docs/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+	if err := os.RemoveAll(root + "/docs"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	found := false
+	for _, key := range s3.Keys() {
+		if strings.HasPrefix(key, "srv/docs") {
+			t.Fatalf("deleted folder left in bucket: %s", key)
+		}
+		found = found || key == "srv/client.txt"
+	}
+	if !found {
+		t.Fatalf("client.txt missing in bucket: %v", s3.Keys())
+	}
+}
+
+// server keeps content deduplicated in a chunk store
+func TestDedupServer(t *testing.T) {
+	c := newCluster(t, 1)
+	fsys, err := storage.NewChunkFS(fsops.OS, c.ServerRoot, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServerFS = fsys
+	content := strings.Repeat("0123456789", 5000)
+	writeFile(t, c.ClientRoots[0]+"/one.txt", content)
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/two.txt", content)
+	waitConverged(t, c, 0)
+	writeFile(t, root+"/one.txt", content+"changed")
+	waitConverged(t, c, 0)
+	if err := os.Remove(root + "/two.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	// everything but the changed tail of one.txt is stored once
+	stats, err := fsys.GC(c.ServerRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 {
+		t.Fatalf("gc removed %d chunks, references were not kept up to date", stats.Removed)
+	}
+	if want := len(content)/4096 + 1; stats.Chunks > want+2 {
+		t.Fatalf("%d chunks in use, want about %d", stats.Chunks, want)
+	}
+}
+
+// modified files are synced by content defined chunks
+func TestCDCMode(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Configure = func(i int, cc *core.ClientCore) {
+		cg := config.DefaultConfig()
+		cg.DeltaMode = config.DeltaCDC
+		cc.Config = &cg
+	}
+	// repeating content has no boundaries, so chunks would not survive a shift
+	data := make([]byte, 320000)
+	rand.New(rand.NewSource(1)).Read(data)
+	content := string(data)
+	writeFile(t, c.ServerRoot+"/big.txt", content)
+	writeFile(t, c.ClientRoots[0]+"/big.txt", "x"+content[:100000]+content[120000:])
+
+	// init finds the file differing on both sides
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/big.txt", "inserted"+content)
+	waitConverged(t, c, 0)
+	writeFile(t, root+"/big.txt", "")
+	waitConverged(t, c, 0)
+}
+
+// diffs larger than a package are sent in pieces
+func TestLargeDiff(t *testing.T) {
+	maxBuffer, maxPackage := config.MaxBufferSize, config.MaxPackageSize
+	config.MaxBufferSize, config.MaxPackageSize = 64*1024, 4*1024
+	// cleanups run last first, the cluster is closed before limits are restored
+	t.Cleanup(func() { config.MaxBufferSize, config.MaxPackageSize = maxBuffer, maxPackage })
+
+	c := newCluster(t, 1)
+	old := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(old)
+	writeFile(t, c.ServerRoot+"/big.txt", string(old))
+	writeFile(t, c.ClientRoots[0]+"/big.txt", string(old))
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	// nothing in common, the diff is as large as the file
+	data := make([]byte, 40000)
+	rand.New(rand.NewSource(2)).Read(data)
+	writeFile(t, c.ClientRoots[0]+"/big.txt", string(data))
+	waitConverged(t, c, 0)
+
+	// diff does not fit the buffer of the receiver, whole file is sent instead
+	data = make([]byte, 100000)
+	rand.New(rand.NewSource(3)).Read(data)
+	writeFile(t, c.ClientRoots[0]+"/big.txt", string(data))
+	waitConverged(t, c, 0)
+}
+
+// clients with different delta settings sync at the same time, each
+// connection keeps to those of its own client
+func TestMixedDeltaSettings(t *testing.T) {
+	c := newCluster(t, 2)
+	c.Configure = func(i int, cc *core.ClientCore) {
+		cg := config.DefaultConfig()
+		if i == 1 {
+			cg.DeltaMode = config.DeltaCDC
+			cg.TruncateBlockSize = 4096
+		} else {
+			cg.TruncateBlockSize = 512
+		}
+		cc.Config = &cg
+		cc.Remote = []string{"zero", "one"}[i]
+	}
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	content := string(data)
+	for _, remote := range []string{"zero", "one"} {
+		mkdir(t, c.ServerRoot+"/"+remote)
+		writeFile(t, c.ServerRoot+"/"+remote+"/big.txt", content)
+	}
+
+	c.StartServer()
+	for i := range c.ClientRoots {
+		if err := c.StartClient(i, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitConverged(t, c, 0)
+	waitConverged(t, c, 1)
+
+	writeFile(t, c.ClientRoots[0]+"/big.txt", content[:50000]+"zero"+content[60000:])
+	writeFile(t, c.ClientRoots[1]+"/big.txt", "one"+content)
+	waitConverged(t, c, 0)
+	waitConverged(t, c, 1)
+}
+
+// clients encrypt everything, server only sees ciphertext
+func TestEncryptedClients(t *testing.T) {
+	iterations := crypt.Iterations
+	crypt.Iterations = 1000
+	defer func() { crypt.Iterations = iterations }()
+
+	c := newCluster(t, 3)
+	for i := range c.ClientFS {
+		c.ClientFS[i] = crypt.NewView(fsops.OS, c.ClientRoots[i], "secret")
+	}
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	content := string(data)
+	mkdir(t, c.ClientRoots[0]+"/docs")
+	writeFile(t, c.ClientRoots[0]+"/docs/plain.txt", content)
+	writeFile(t, c.ClientRoots[0]+"/empty.txt", "")
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/docs/plain.txt", content[:100000]+"changed"+content[100000:])
+	waitConverged(t, c, 0)
+	if err := os.Rename(root+"/docs/plain.txt", root+"/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	err := filepath.Walk(c.ServerRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.Contains(path, "docs") || strings.Contains(path, ".txt") {
+			t.Errorf("plain name on server: %s", path)
+		}
+		if stored, _ := ioutil.ReadFile(path); !info.IsDir() && bytes.Contains(stored, data[:64]) {
+			t.Errorf("plain content on server: %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same passphrase reads what the first client wrote
+	if err := c.StartClient(1, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 1)
+	if diff, err := Compare(fsops.OS, c.ClientRoots[0], fsops.OS, c.ClientRoots[1]); err != nil || len(diff) != 0 {
+		t.Fatalf("clients differ: %v, %v", diff, err)
+	}
+
+	c.ClientFS[2] = crypt.NewView(fsops.OS, c.ClientRoots[2], "guess")
+	if err := c.StartClient(2, timeout); err != crypt.ErrWrongPassphrase {
+		t.Fatalf("wrong passphrase gave %v", err)
+	}
+	c.ClientFS[2] = fsops.OS
+	if err := c.StartClient(2, time.Second); err == nil {
+		t.Fatal("client without encryption accepted")
+	}
+}
+
+// server keeps contents encrypted with a master key
+func TestEncryptedServer(t *testing.T) {
+	c := newCluster(t, 1)
+	keyFile := t.TempDir() + "/key"
+	key, err := storage.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile, key+"\n")
+	fsys, err := storage.Open(config.StorageConfig{Encrypt: true, KeyFile: keyFile, Dedup: true}, c.ServerRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServerFS = fsys
+	content := strings.Repeat("0123456789", 20000)
+	writeFile(t, c.ClientRoots[0]+"/one.txt", content)
+
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+
+	root := c.ClientRoots[0]
+	writeFile(t, root+"/one.txt", content[:100000]+"changed"+content[100000:])
+	waitConverged(t, c, 0)
+	mkdir(t, root+"/docs")
+	writeFile(t, root+"/docs/two.txt", "small")
+	waitConverged(t, c, 0)
+
+	err = filepath.Walk(c.ServerRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stored, _ := ioutil.ReadFile(path); !info.IsDir() &&
+			(bytes.Contains(stored, []byte("0123456789")) || bytes.Contains(stored, []byte("small"))) {
+			t.Errorf("plain content on server: %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullPush(t *testing.T) {
+	c := newCluster(t, 1)
+	mkdir(t, c.ServerRoot+"/docs")
+	writeFile(t, c.ServerRoot+"/docs/server.txt", "from server")
+	writeFile(t, c.ServerRoot+"/both.txt", "server version")
+	mkdir(t, c.ClientRoots[0]+"/src")
+	writeFile(t, c.ClientRoots[0]+"/src/client.txt", "from client")
+	writeFile(t, c.ClientRoots[0]+"/both.txt", "client version")
+	c.StartServer()
+	cc := c.Client(0)
+
+	actions, err := cc.Plan(core.SyncBoth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the version on server wins as in init
+	want := map[string]bool{"/docs": false, "/docs/server.txt": false, "/both.txt": false,
+		"/src": true, "/src/client.txt": true}
+	if len(actions) != len(want) {
+		t.Fatalf("planned %+v", actions)
+	}
+	for _, a := range actions {
+		if upload, ok := want[a.Path]; !ok || upload != a.Upload {
+			t.Fatalf("planned %+v", a)
+		}
+	}
+
+	// local version of both.txt is sent, nothing is received
+	if _, err := cc.SyncOnce(core.SyncUpload); err != nil {
+		t.Fatal(err)
+	}
+	if fsops.IsFileExist(fsops.OS, c.ClientRoots[0]+"/docs") {
+		t.Fatal("push changed the local folder")
+	}
+	if got, _ := ioutil.ReadFile(c.ServerRoot + "/both.txt"); string(got) != "client version" {
+		t.Fatalf("server holds %q after push", got)
+	}
+
+	writeFile(t, c.ServerRoot+"/both.txt", "server again")
+	if _, err := cc.SyncOnce(core.SyncDownload); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 0)
+	if actions, err := cc.Plan(core.SyncBoth); err != nil || len(actions) != 0 {
+		t.Fatalf("planned %+v after pull, %v", actions, err)
+	}
+}
+
+func TestSyncOnce(t *testing.T) {
+	c := newCluster(t, 1)
+	mkdir(t, c.ServerRoot+"/docs")
+	writeFile(t, c.ServerRoot+"/docs/server.txt", "from server")
+	writeFile(t, c.ServerRoot+"/both.txt", "server version")
+	writeFile(t, c.ClientRoots[0]+"/both.txt", "client version")
+	writeFile(t, c.ClientRoots[0]+"/client.txt", strings.Repeat("x", 100000))
+	c.StartServer()
+
+	summary, err := c.Client(0).SyncOnce(core.SyncBoth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count(common.OpMkdir) != 1 || summary.Count(common.OpCreate) != 2 ||
+		summary.Count(common.OpModify) != 1 || len(summary.Failed) != 0 {
+		t.Fatalf("summary %+v", summary)
+	}
+	if summary.BytesSent < 100000 {
+		t.Fatalf("%d bytes sent", summary.BytesSent)
+	}
+	waitConverged(t, c, 0)
+
+	// nothing left to do
+	summary, err = c.Client(0).SyncOnce(core.SyncBoth)
+	if err != nil || len(summary.Done) != 0 {
+		t.Fatalf("second run %+v, %v", summary, err)
+	}
+
+	c.Close()
+	if _, err := c.Client(0).SyncOnce(core.SyncBoth); err == nil {
+		t.Fatal("sync without server succeeded")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	iterations := crypt.Iterations
+	crypt.Iterations = 1000
+	defer func() { crypt.Iterations = iterations }()
+
+	c := newCluster(t, 2)
+	c.ClientFS[1] = crypt.NewView(fsops.OS, c.ClientRoots[1], "secret")
+	writeFile(t, c.ServerRoot+"/server.txt", "from server")
+	writeFile(t, c.ClientRoots[0]+"/server.txt", "changed")
+	mkdir(t, c.ClientRoots[0]+"/src")
+	writeFile(t, c.ClientRoots[0]+"/src/client.txt", "from client")
+	writeFile(t, c.ClientRoots[1]+"/secret.txt", "encrypted")
+	c.StartServer()
+
+	snapshot := func() []map[string]string {
+		var result []map[string]string
+		for _, root := range append([]string{c.ServerRoot}, c.ClientRoots...) {
+			snap, err := Snapshot(fsops.OS, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, snap)
+		}
+		return result
+	}
+	before := snapshot()
+
+	actions, err := c.Client(0).Plan(core.SyncUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 3 || actions[0].Op != common.OpModify || actions[0].Size != int64(len("changed")) {
+		t.Fatalf("planned %+v", actions)
+	}
+	// first encrypting client would be refused by a folder holding plain files
+	if _, err := c.Client(1).Plan(core.SyncBoth); err == nil {
+		t.Fatal("encrypted plan against plain folder succeeded")
+	}
+	if !reflect.DeepEqual(before, snapshot()) {
+		t.Fatal("folders changed by planning")
+	}
+
+	os.Remove(c.ServerRoot + "/server.txt")
+	actions, err = c.Client(1).Plan(core.SyncBoth)
+	if err != nil || len(actions) != 1 || !actions[0].Upload {
+		t.Fatalf("planned %+v, %v", actions, err)
+	}
+	if fsops.IsFileExist(fsops.OS, c.ServerRoot+"/"+common.KeyCheckFile) {
+		t.Fatal("key check stored by planning")
+	}
+}
+
+func TestFolderPairs(t *testing.T) {
+	c := newCluster(t, 3)
+	c.Configure = func(i int, cc *core.ClientCore) {
+		switch i {
+		case 0:
+			cc.Remote = "photos"
+			cc.Ignore = []string{"*.tmp", "/cache"}
+		case 1:
+			cc.Remote = "work/notes"
+		case 2:
+			cc.Remote = "work/notes"
+			cc.Direction = core.SyncDownload
+		}
+	}
+	writeFile(t, c.ClientRoots[0]+"/a.jpg", "photo")
+	writeFile(t, c.ClientRoots[0]+"/partial.tmp", "ignored")
+	mkdir(t, c.ClientRoots[0]+"/cache")
+	writeFile(t, c.ClientRoots[0]+"/cache/thumb", "ignored")
+	writeFile(t, c.ClientRoots[1]+"/todo.txt", "notes")
+	writeFile(t, c.ClientRoots[2]+"/local.txt", "not uploaded")
+	c.StartServer()
+
+	for i := 0; i < 3; i++ {
+		if err := c.StartClient(i, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, c.ClientRoots[0]+"/b.jpg", "live")
+	writeFile(t, c.ClientRoots[0]+"/b.tmp", "ignored")
+	writeFile(t, c.ClientRoots[2]+"/live.txt", "not uploaded")
+
+	want := []string{"/a.jpg", "/b.jpg"}
+	deadline := time.Now().Add(timeout)
+	for {
+		snap, err := Snapshot(c.ServerFS, c.ServerRoot+"/photos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for path := range snap {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		if reflect.DeepEqual(paths, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("photos on server %v", paths)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	waitConverged(t, c, 1)
+	if got, _ := ioutil.ReadFile(c.ClientRoots[2] + "/todo.txt"); string(got) != "notes" {
+		t.Fatalf("download only client holds %q", got)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, name := range []string{"/local.txt", "/live.txt"} {
+		if fsops.IsFileExist(c.ServerFS, c.ServerRoot+"/work/notes"+name) {
+			t.Fatalf("%s uploaded by download only client", name)
+		}
+	}
+
+	c.Configure = func(i int, cc *core.ClientCore) { cc.Remote = "../outside" }
+	if _, err := c.Client(0).Plan(core.SyncBoth); err == nil {
+		t.Fatal("folder outside of server root accepted")
+	}
+}
+
+func TestBackupMirror(t *testing.T) {
+	c := newCluster(t, 2)
+	c.Configure = func(i int, cc *core.ClientCore) {
+		cc.Remote = "shared"
+		cc.Direction = []core.Direction{core.SyncUpload, core.SyncDownload}[i]
+	}
+	backup, mirror := c.ClientRoots[0], c.ClientRoots[1]
+	mkdir(t, c.ServerRoot+"/shared/old")
+	writeFile(t, c.ServerRoot+"/shared/old/server.txt", "only on server")
+	writeFile(t, c.ServerRoot+"/shared/both.txt", "server version")
+	writeFile(t, backup+"/both.txt", "backup version")
+	writeFile(t, backup+"/photo.jpg", "photo")
+	mkdir(t, mirror+"/local")
+	writeFile(t, mirror+"/local/draft.txt", "reverted")
+	writeFile(t, mirror+"/both.txt", "reverted")
+	c.StartServer()
+
+	before, err := Snapshot(fsops.OS, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	// local version wins and nothing comes back
+	if got, _ := ioutil.ReadFile(c.ServerRoot + "/shared/both.txt"); string(got) != "backup version" {
+		t.Fatalf("server holds %q after backup", got)
+	}
+	if after, _ := Snapshot(fsops.OS, backup); !reflect.DeepEqual(before, after) {
+		t.Fatalf("backup changed local folder to %v", after)
+	}
+	if _, err := c.Client(0).SyncOnce(core.SyncDownload); err == nil {
+		t.Fatal("pull into backup folder succeeded")
+	}
+
+	if err := c.StartClient(1, timeout); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(t, c, 1)
+	items, err := trash.List(fsops.OS, mirror)
+	if err != nil || len(items) != 1 || items[0].OriginalPath != "/local" {
+		t.Fatalf("mirror trash %+v, %v", items, err)
+	}
+
+	// live changes on the mirror are reverted to what server holds by then
+	writeFile(t, mirror+"/both.txt", "changed again")
+	writeFile(t, mirror+"/new.txt", "reverted")
+	os.Remove(mirror + "/photo.jpg")
+	writeFile(t, backup+"/live.txt", "live")
+	deadline := time.Now().Add(timeout)
+	for {
+		got, _ := ioutil.ReadFile(mirror + "/live.txt")
+		if string(got) == "live" && !fsops.IsFileExist(fsops.OS, mirror+"/new.txt") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mirror not reverted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitConverged(t, c, 1)
+	if fsops.IsFileExist(fsops.OS, c.ServerRoot+"/shared/new.txt") {
+		t.Fatal("mirror uploaded a local change")
+	}
+}
+
+// read only folders of server refuse writes of clients which do not declare themselves read only
+func TestServerReadOnly(t *testing.T) {
+	c := newCluster(t, 1)
+	c.ReadOnlyFolders = []string{"public"}
+	c.Configure = func(i int, cc *core.ClientCore) {
+		cc.Remote = "public"
+	}
+	mkdir(t, c.ServerRoot+"/public")
+	writeFile(t, c.ServerRoot+"/public/a.txt", "server")
+	writeFile(t, c.ClientRoots[0]+"/b.txt", "client")
+	c.StartServer()
+	if err := c.StartClient(0, timeout); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(timeout)
+	for !fsops.IsFileExist(fsops.OS, c.ClientRoots[0]+"/a.txt") {
+		if time.Now().After(deadline) {
+			t.Fatal("read only folder not downloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	writeFile(t, c.ClientRoots[0]+"/a.txt", "changed")
+	time.Sleep(500 * time.Millisecond)
+	if got, _ := ioutil.ReadFile(c.ServerRoot + "/public/a.txt"); string(got) != "server" {
+		t.Fatalf("server holds %q", got)
+	}
+	if fsops.IsFileExist(fsops.OS, c.ServerRoot+"/public/b.txt") {
+		t.Fatal("client uploaded into read only folder")
+	}
+
+	// nothing is created below a read only folder, nor written into it
+	conn, err := c.listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if op := rawRequest(t, conn, 1, common.SysSelectFolder, []byte("public/sub")); op != common.SysSelectFolder {
+		t.Fatalf("select folder answered with %d", op)
+	}
+	if fsops.IsFileExist(fsops.OS, c.ServerRoot+"/public/sub") {
+		t.Fatal("folder created below read only folder")
+	}
+	if op := rawRequest(t, conn, 2, common.SysSelectFolder, []byte("public")); op != common.SysSelectFolder {
+		t.Fatalf("select folder answered with %d", op)
+	}
+	if op := rawRequest(t, conn, 3, common.SysOpMkdir, []byte("/new")); op != common.SysSyncFailed {
+		t.Fatalf("mkdir answered with %d", op)
+	}
+	if fsops.IsFileExist(fsops.OS, c.ServerRoot+"/public/new") {
+		t.Fatal("folder created in read only folder")
+	}
+}
+
+// send one request the way a client does and wait for the answer on its transfer
+func rawRequest(t *testing.T, conn network.Conn, tid uint32, op common.SysOp, data []byte) common.SysOp {
+	t.Helper()
+	if err := core.WrappAndSend(conn, tid, op, data, common.IsLastPackage); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case frame, ok := <-conn.Frames():
+			if !ok {
+				t.Fatal("connection closed by server")
+			}
+			// replies are small, each frame carries a whole package
+			header, err := metadata.GetHeaderFromData(frame.Data)
+			conn.Consumed(len(frame.Data))
+			conn.Release(frame)
+			if err == nil && header.Transfer == tid {
+				return header.Tag
+			}
+		case <-deadline:
+			t.Fatalf("no answer to op %d", op)
+		}
+	}
+}
+
+// paths sent by a client stay inside the folder it selected
+func TestEscapingPaths(t *testing.T) {
+	c := newCluster(t, 0)
+	mkdir(t, c.ServerRoot+"/shared")
+	mkdir(t, c.ServerRoot+"/other")
+	writeFile(t, c.ServerRoot+"/other/secret.txt", "secret")
+	c.StartServer()
+	before, err := Snapshot(fsops.OS, filepath.Dir(c.ServerRoot))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := c.listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if op := rawRequest(t, conn, 1, common.SysSelectFolder, []byte("shared")); op != common.SysSelectFolder {
+		t.Fatalf("select folder answered with %d", op)
+	}
+	rename := core.RenameEventToBytes(common.FsEvent{Op: common.OpRename,
+		FileName: "/../other/moved.txt", OriginFile: "/../other/secret.txt"}, "")
+	for i, req := range []struct {
+		op   common.SysOp
+		data []byte
+	}{
+		{common.SysOpMkdir, []byte("/../escaped")},
+		{common.SysOpMkdir, []byte("/../../escaped")},
+		{common.SysOpRemove, []byte("/../other/secret.txt")},
+		{common.SysOpCreate, []byte("/../other/secret.txt")},
+		{common.SysOpModify, []byte("/sub/../../other/secret.txt")},
+		{common.SysSyncFileEmpty, []byte("/../other/secret.txt")},
+		{common.SysSyncFileNotEmpty, append(make([]byte, 16), "/../other/secret.txt"...)},
+		{common.SysOpRename, rename},
+	} {
+		if op := rawRequest(t, conn, uint32(i+2), req.op, req.data); op != common.SysSyncFailed {
+			t.Errorf("op %d on %q answered with %d", req.op, req.data, op)
+		}
+	}
+
+	if after, _ := Snapshot(fsops.OS, filepath.Dir(c.ServerRoot)); !reflect.DeepEqual(before, after) {
+		t.Fatalf("files outside of selected folder changed to %v", after)
+	}
+}
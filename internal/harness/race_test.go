@@ -0,0 +1,6 @@
+//go:build race
+
+package harness
+
+// everything runs several times slower with the race detector
+const raceSlowdown = 5
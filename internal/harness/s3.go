@@ -0,0 +1,225 @@
+package harness
+
+import (
+	"encoding/xml"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// in-memory stand-in for an S3 compatible service, one bucket,
+// checks request signatures and pages listings like the real one
+type FakeS3 struct {
+	Bucket string
+	// most keys returned in one listing page
+	PageSize int
+
+	signer  storage.Signer
+	server  *httptest.Server
+	lock    sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewFakeS3() *FakeS3 {
+	s := &FakeS3{
+		Bucket:   "gcloudsync",
+		PageSize: 1000,
+		signer:   storage.Signer{AccessKey: "fake-access", SecretKey: "fake-secret", Region: "us-east-1", Service: "s3"},
+		objects:  make(map[string]fakeObject),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// storage settings that reach this server
+func (s *FakeS3) Config() config.StorageConfig {
+	return config.StorageConfig{
+		Type:      "s3",
+		Endpoint:  s.server.URL,
+		Bucket:    s.Bucket,
+		Region:    s.signer.Region,
+		AccessKey: s.signer.AccessKey,
+		SecretKey: s.signer.SecretKey,
+	}
+}
+
+func (s *FakeS3) Close() {
+	s.server.Close()
+}
+
+// sorted keys currently stored
+func (s *FakeS3) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sortedKeys()
+}
+
+// must be called with lock held
+func (s *FakeS3) sortedKeys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *FakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	if err := s.signer.Verify(r); err != nil {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != storage.UnsignedPayload && hash != storage.PayloadHash(body) {
+		writeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash mismatch")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.Bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", parts[0])
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case key == "":
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj, ok := s.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src = strings.TrimPrefix(src, "/"+s.Bucket+"/")
+		obj, ok := s.objects[src]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", src)
+			return
+		}
+		obj.modTime = time.Now()
+		s.objects[key] = obj
+		writeXML(w, http.StatusOK, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified time.Time
+		}{LastModified: obj.modTime})
+	case r.Method == http.MethodPut:
+		s.objects[key] = fakeObject{data: body, modTime: time.Now()}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+type fakeContent struct {
+	Key          string
+	Size         int
+	LastModified time.Time
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+// ListObjectsV2, the continuation token is the last key of previous page
+func (s *FakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "only list-type 2 is supported")
+		return
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("continuation-token")
+
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Contents              []fakeContent
+		CommonPrefixes        []fakePrefix
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	result.Name = s.Bucket
+	result.Prefix = prefix
+
+	count := 0
+	last := ""
+	for _, key := range s.sortedKeys() {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry = key[:len(prefix)+i+len(delimiter)]
+		}
+		if entry == last || (entry != key && entry <= after) {
+			continue
+		}
+		if count == s.PageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if entry == key {
+			obj := s.objects[key]
+			result.Contents = append(result.Contents, fakeContent{Key: key, Size: len(obj.data), LastModified: obj.modTime})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakePrefix{Prefix: entry})
+		}
+		count++
+		last = entry
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string, message string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
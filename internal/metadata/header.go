@@ -5,22 +5,50 @@ import (
 	"encoding/binary"
 	"errors"
 	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"hash/crc32"
 )
 
 var Sig = [14]byte{103, 67, 108, 111, 117, 100, 83, 121, 110, 99, 50, 48, 50, 50}
 var logtag string = "[Header]"
 
+// header version 2 carries a crc32c checksum of header and payload
+// header version 3 carries the id of the transfer a package belongs to
+const (
+	Version    uint16 = 3
+	HeaderSize int    = 34
+)
+
+var (
+	ErrShortBuffer = errors.New("expect more data")
+	ErrSignature   = errors.New("invalid signature")
+	ErrVersion     = errors.New("unsupported header version")
+	ErrLength      = errors.New("invalid payload length")
+	ErrChecksum    = errors.New("checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type Header struct {
 	// header to specify data package
+	// +-----------+---------+-----+--------+------+----------+----------+
+	// | signature | version | tag | length | last | transfer | checksum |
+	// +-----------+---------+-----+--------+------+----------+----------+
+	// |    14     |    2    |  2  |   4    |  4   |    4     |    4     |
+	// +-----------+---------+-----+--------+------+----------+----------+
 	Signature [14]byte
+	Version   uint16
 	Tag       common.SysOp
 	Length    uint32
 	Last      uint32
+	Transfer  uint32
+	Checksum  uint32
 }
 
-func NewHeader(len uint32, tag common.SysOp, last uint32) Header {
+func NewHeader(len uint32, tag common.SysOp, last uint32, transfer uint32) Header {
 	// signature is "gCloudSync2022"
-	return Header{Signature: Sig, Tag: tag, Length: len, Last: last}
+	return Header{Signature: Sig, Version: Version, Tag: tag, Length: len,
+		Last: last, Transfer: transfer}
 }
 
 func (h Header) ToByteArray() (b []byte, err error) {
@@ -33,23 +61,68 @@ func (h Header) ToByteArray() (b []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+// crc32c over header with zero checksum field and payload
+func (h Header) computeChecksum(payload []byte) uint32 {
+	h.Checksum = 0
+	b, _ := h.ToByteArray()
+	crc := crc32.Update(0, castagnoli, b)
+	return crc32.Update(crc, castagnoli, payload)
+}
+
+// fill in checksum, should be called before ToByteArray
+func (h *Header) SetChecksum(payload []byte) {
+	h.Checksum = h.computeChecksum(payload)
+}
+
+func (h Header) Verify(payload []byte) error {
+	if int(h.Length) != len(payload) {
+		return ErrLength
+	}
+	if h.computeChecksum(payload) != h.Checksum {
+		return ErrChecksum
+	}
+	return nil
+}
+
 func GetHeaderFromData(b []byte) (header Header, err error) {
 	var tempHeader Header
 	// log.Println(logtag, "buffer len:", len(b))
-	if len(b) < 24 {
+	if len(b) < HeaderSize {
 		// invalid length for header
-		return tempHeader, errors.New("invalid length")
+		return tempHeader, ErrShortBuffer
 	}
 
-	buf := bytes.NewReader(b[0:24])
+	buf := bytes.NewReader(b[0:HeaderSize])
 	if err := binary.Read(buf, binary.BigEndian, &tempHeader); err != nil {
 		return tempHeader, err
 	}
 
-	if bytes.Equal(tempHeader.Signature[:], Sig[:]) {
-		// valid
-		return tempHeader, nil
-	} else {
-		return tempHeader, errors.New("invalid signature")
+	if !bytes.Equal(tempHeader.Signature[:], Sig[:]) {
+		return tempHeader, ErrSignature
+	}
+	if tempHeader.Version != Version {
+		return tempHeader, ErrVersion
+	}
+	if int64(tempHeader.Length) > int64(config.MaxPackageSize)+int64(HeaderSize) {
+		return tempHeader, ErrLength
+	}
+	return tempHeader, nil
+}
+
+// find where the next header may start after a damaged frame
+// @return: offset of next signature, or offset from which a
+// partial signature may still be completed by upcoming data
+func NextHeaderOffset(b []byte) int {
+	if len(b) <= 1 {
+		return len(b)
+	}
+	if i := bytes.Index(b[1:], Sig[:]); i >= 0 {
+		return i + 1
+	}
+	// keep a possible signature prefix at the end
+	keep := len(Sig) - 1
+	if len(b)-1 < keep {
+		keep = len(b) - 1
 	}
+	return len(b) - keep
 }
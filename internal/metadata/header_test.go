@@ -0,0 +1,43 @@
+package metadata
+
+import (
+	"bytes"
+	"gcloudsync/internal/common"
+	"testing"
+)
+
+func frame(tag common.SysOp, last uint32, transfer uint32, payload []byte) []byte {
+	h := NewHeader(uint32(len(payload)), tag, last, transfer)
+	h.SetChecksum(payload)
+	b, _ := h.ToByteArray()
+	return append(b, payload...)
+}
+
+func FuzzGetHeaderFromData(f *testing.F) {
+	f.Add(frame(common.SysInit, common.IsLastPackage, 0, []byte{}))
+	f.Add(frame(common.SysOpCreate, common.IsLastPackage, 1, []byte("/dir/file.txt")))
+	f.Add(frame(common.SysSyncFileDirect, common.IsNotLastPacage, 7, bytes.Repeat([]byte{0xab}, 100)))
+	f.Add(append(frame(common.SysDone, common.IsLastPackage, 0, nil), Sig[:5]...))
+	f.Add([]byte{})
+	f.Add(Sig[:])
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, err := GetHeaderFromData(b)
+		if next := NextHeaderOffset(b); next < 0 || next > len(b) || (len(b) > 1 && next == 0) {
+			t.Fatalf("next header offset %d out of range for %d bytes", next, len(b))
+		}
+		if err != nil {
+			return
+		}
+		encoded, err := header.ToByteArray()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, b[:HeaderSize]) {
+			t.Fatalf("header does not encode back to input")
+		}
+		if end := HeaderSize + int(header.Length); end <= len(b) {
+			header.Verify(b[HeaderSize:end])
+		}
+	})
+}
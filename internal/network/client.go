@@ -1,88 +1,53 @@
 package network
 
 import (
-	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
 	"net"
+	"strings"
+	"time"
 )
 
 var logtag string = "[Network]"
 
-type ITCPClient interface {
-	Connect() error
-	Send(b []byte) error
-	Receive() []byte
-	ReadFromServer()
-	GetBuffChan() chan []byte
-	Close()
-}
+// give up connecting to an unreachable server after this long
+var DialTimeout = 10 * time.Second
 
 type TCPClient struct {
 	destAddr string
 	port     string
-	buffchan chan []byte
-	conn     *net.TCPConn
-}
-
-func NewClient(ip string, port string) ITCPClient {
-	buffchan := make(chan []byte, config.BuffChanSize)
-	return &TCPClient{destAddr: ip, port: port, buffchan: buffchan}
+	// optional, applied to every raw connection before framing
+	Wrap func(net.Conn) net.Conn
 }
 
-func (c *TCPClient) Connect() error {
-	// connect to server
-	addr, err := net.ResolveTCPAddr("tcp4", config.ServerIP+":"+config.Port)
-	common.ErrorHandleFatal(logtag, err)
-
-	c.conn, err = net.DialTCP("tcp4", nil, addr)
-	common.ErrorHandleFatal(logtag, err)
-
-	return err
+// @address: host name or IP address of server,
+// may carry its own port as in "example.com:9000" or "[::1]:9000"
+// @port: port of server if address has none
+func NewClient(address string, port string) *TCPClient {
+	return &TCPClient{destAddr: address, port: port}
 }
 
-func (c *TCPClient) Send(b []byte) (err error) {
-	if len(b) <= config.TransferBlockSize {
-		_, err = c.conn.Write(b)
-		common.ErrorHandleDebug(logtag, err)
-	} else {
-		i := 0
-		for ; i+config.TransferBlockSize <= len(b); i = i + config.TransferBlockSize {
-			_, err = c.conn.Write(b[i : i+config.TransferBlockSize])
-			common.ErrorHandleDebug(logtag, err)
-		}
-		_, err = c.conn.Write(b[i:])
+// connect to server, every address a host name resolves to is tried
+func (c *TCPClient) Dial() (Conn, error) {
+	host, port := SplitAddress(c.destAddr, c.port)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), DialTimeout)
+	if err != nil {
+		return nil, err
 	}
-	return
+	return NewConn(wrap(c.Wrap, conn)), nil
 }
 
-func (c *TCPClient) GetBuffChan() chan []byte {
-	return c.buffchan
-}
-
-func (c *TCPClient) Receive() []byte {
-	buffer := make([]byte, config.MaxBufferSize)
-	c.conn.Read(buffer)
-	return buffer
-}
-
-func (c *TCPClient) Close() {
-	c.conn.Close()
+// host and port of an address such as "example.com", "10.0.0.1:9000",
+// "::1" or "[::1]:9000"
+// @defaultPort: port to use if address has none
+func SplitAddress(address string, defaultPort string) (host string, port string) {
+	if host, port, err := net.SplitHostPort(address); err == nil && port != "" {
+		return host, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), defaultPort
 }
 
-func (c *TCPClient) ReadFromServer() {
-	for {
-		buffer := make([]byte, config.MaxBufferSize)
-		n, err := c.conn.Read(buffer)
-		if err != nil {
-			// client send done
-			common.ErrorHandleDebug(logtag, err)
-			return
-		}
-
-		buff := buffer[0:n]
-		if len(buff) != 0 {
-			// log.Println(logtag, "receive: "+string(buff))
-			c.buffchan <- buff
-		}
+func wrap(w func(net.Conn) net.Conn, conn net.Conn) net.Conn {
+	if w == nil {
+		return conn
 	}
+	return w(conn)
 }
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"net"
+)
+
+// connection to a peer carrying packages on logical streams
+type Conn interface {
+	// queue one package on a stream, packages of different
+	// streams are interleaved frame by frame
+	Send(stream uint32, b []byte) error
+	// block until no more than limit bytes wait to be sent on stream
+	WaitQueued(stream uint32, limit int) error
+	// incoming frames, closed when connection is closed
+	Frames() chan Frame
+	// data of frame from Frames is no longer used
+	Release(f Frame)
+	// n bytes of packages from Frames have been handled,
+	// peer may send as many again
+	Consumed(n int)
+	Close() error
+	RemoteAddr() string
+}
+
+// client side transport
+type Dialer interface {
+	Dial() (Conn, error)
+}
+
+// server side transport
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+}
+
+// Conn over any reliable byte stream
+type streamConn struct {
+	conn   net.Conn
+	frames chan Frame
+	writer *frameWriter
+}
+
+// wrap a net.Conn, such as a tcp connection or one end of net.Pipe
+func NewConn(conn net.Conn) Conn {
+	c := &streamConn{conn: conn, frames: make(chan Frame, config.BuffChanSize),
+		writer: newFrameWriter(conn, config.TransferBlockSize)}
+	go c.read()
+	return c
+}
+
+func (c *streamConn) read() {
+	err := readFrames(c.conn, c.frames, c.writer)
+	// peer send done, or broke the protocol
+	common.ErrorHandleDebug(logtag, err)
+	c.writer.close()
+	c.conn.Close()
+	close(c.frames)
+}
+
+func (c *streamConn) Send(stream uint32, b []byte) (err error) {
+	err = c.writer.send(stream, b)
+	common.ErrorHandleDebug(logtag, err)
+	return
+}
+
+func (c *streamConn) WaitQueued(stream uint32, limit int) error {
+	return c.writer.waitQueued(stream, limit)
+}
+
+func (c *streamConn) Frames() chan Frame {
+	return c.frames
+}
+
+func (c *streamConn) Release(f Frame) {
+	releaseFrame(f)
+}
+
+func (c *streamConn) Consumed(n int) {
+	c.writer.release(n)
+}
+
+func (c *streamConn) Close() error {
+	c.writer.close()
+	return c.conn.Close()
+}
+
+func (c *streamConn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
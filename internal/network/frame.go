@@ -0,0 +1,397 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+)
+
+// packages are cut into frames before being written to the connection
+// so that several logical streams can share a single connection.
+// frame structured as below
+// +-------+------+--------+--------+----------+---------+
+// | magic | type | stream | length | checksum | payload |
+// +-------+------+--------+--------+----------+---------+
+// |   2   |  1   |   4    |   4    |    4     | length  |
+// +-------+------+--------+--------+----------+---------+
+// checksum: crc32c of magic, type, stream and length
+// stream 0 is the control stream and always has priority,
+// other streams take turns to send one frame each.
+//
+// flow control: on all streams together, the sender may have at most
+// config.ReceiveWindowSize bytes of packages unconsumed by receiver.
+// a package is only started once the window holds all of it, so that
+// packages interleaved on different streams can always be completed.
+// receiver grants consumed bytes back with a window update frame,
+// whose payload is the 4 bytes increment, and drops a peer sending more.
+const (
+	frameHeaderSize = 15
+	maxFrameSize    = 1024 * 1024
+	ControlStream   = 0
+)
+
+const (
+	frameData byte = iota
+	frameWindowUpdate
+)
+
+var frameMagic = [2]byte{'g', 'S'}
+var frameTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frame payloads are reused once the receiver has consumed them
+// pools keep buffers of 4 KiB, 8 KiB and so on up to maxFrameSize,
+// a frame takes the smallest one it fits in
+const (
+	minBufferSize = 4 * 1024
+	bufferBuckets = 9
+)
+
+var framePools [bufferBuckets]sync.Pool
+
+// index of the pool for buffers of n bytes and their size
+func bucket(n int) (int, int) {
+	i, size := 0, minBufferSize
+	for size < n {
+		i++
+		size = size * 2
+	}
+	return i, size
+}
+
+func getBuffer(n int) []byte {
+	i, size := bucket(n)
+	if b, ok := framePools[i].Get().([]byte); ok {
+		return b[:n]
+	}
+	return make([]byte, n, size)
+}
+
+func putBuffer(b []byte) {
+	i, size := bucket(cap(b))
+	if size == cap(b) && i < bufferBuckets {
+		framePools[i].Put(b[:size])
+	}
+}
+
+type Frame struct {
+	Stream uint32
+	Data   []byte
+}
+
+// interleave packages of different streams on one connection
+type frameWriter struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	w         io.Writer
+	frameSize int
+	queues    map[uint32][][]byte
+	queued    map[uint32]int  // bytes waiting to be written on each stream
+	started   map[uint32]bool // first package of stream is partly written
+	order     []uint32        // round robin order of non-control streams
+	closed    bool
+	err       error
+
+	// window of both sides, fixed for the connection
+	windowSize int
+	// bytes peer is still willing to receive
+	window int64
+	// bytes received from peer and not yet consumed locally
+	unconsumed int64
+	// bytes consumed locally but not yet granted back to peer
+	consumed int64
+}
+
+func newFrameWriter(w io.Writer, frameSize int) *frameWriter {
+	if frameSize <= 0 || frameSize > maxFrameSize {
+		frameSize = maxFrameSize
+	}
+	size := receiveWindowSize()
+	fw := &frameWriter{w: w, frameSize: frameSize,
+		queues: make(map[uint32][][]byte), queued: make(map[uint32]int), started: make(map[uint32]bool),
+		windowSize: size, window: int64(size)}
+	fw.cond = sync.NewCond(&fw.lock)
+	go fw.loop()
+	return fw
+}
+
+// window must be able to hold at least one frame, and
+// packages of config.MaxPackageSize and their header must be sendable
+func receiveWindowSize() int {
+	min := maxFrameSize
+	if 4*config.MaxPackageSize > min {
+		min = 4 * config.MaxPackageSize
+	}
+	if config.ReceiveWindowSize < min {
+		return min
+	}
+	return config.ReceiveWindowSize
+}
+
+// queue a package on a stream, never blocks
+func (fw *frameWriter) send(stream uint32, b []byte) error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	if fw.closed {
+		return fw.err
+	}
+	// what is not granted back yet may hold the window up to a quarter
+	if len(b) > fw.maxPackage() {
+		return errors.New("package larger than half of receive window")
+	}
+	if len(fw.queues[stream]) == 0 && stream != ControlStream {
+		fw.order = append(fw.order, stream)
+	}
+	fw.queues[stream] = append(fw.queues[stream], b)
+	fw.queued[stream] = fw.queued[stream] + len(b)
+	fw.cond.Broadcast()
+	return nil
+}
+
+// block until no more than limit bytes wait to be written on stream
+func (fw *frameWriter) waitQueued(stream uint32, limit int) error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	for fw.queued[stream] > limit && !fw.closed {
+		fw.cond.Wait()
+	}
+	return fw.err
+}
+
+// peer consumed n bytes
+func (fw *frameWriter) credit(n uint32) {
+	fw.lock.Lock()
+	fw.window = fw.window + int64(n)
+	fw.cond.Broadcast()
+	fw.lock.Unlock()
+}
+
+// n bytes have been received from peer
+// more than the window means peer ignores flow control
+func (fw *frameWriter) receive(n int) error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	fw.unconsumed = fw.unconsumed + int64(n)
+	if fw.unconsumed > int64(fw.windowSize) {
+		return errors.New("peer exceeded receive window")
+	}
+	return nil
+}
+
+// n bytes received from peer have been consumed locally
+// grant them back in batches to save window update frames
+func (fw *frameWriter) release(n int) {
+	fw.lock.Lock()
+	fw.unconsumed = fw.unconsumed - int64(n)
+	fw.consumed = fw.consumed + int64(n)
+	if fw.updateDue() {
+		fw.cond.Broadcast()
+	}
+	fw.lock.Unlock()
+}
+
+// largest package which can be sent
+func (fw *frameWriter) maxPackage() int {
+	return fw.windowSize / 2
+}
+
+func (fw *frameWriter) close() {
+	fw.lock.Lock()
+	fw.closed = true
+	if fw.err == nil {
+		fw.err = errors.New("connection closed")
+	}
+	fw.cond.Broadcast()
+	fw.lock.Unlock()
+}
+
+func (fw *frameWriter) updateDue() bool {
+	return fw.consumed >= int64(fw.windowSize/4)
+}
+
+// whether next frame of stream may be written, must be called with lock held
+// a package already started is always finished
+func (fw *frameWriter) writable(stream uint32) bool {
+	queue := fw.queues[stream]
+	return len(queue) > 0 && (fw.started[stream] || int64(len(queue[0])) <= fw.window)
+}
+
+// position of next non-control stream to write in round robin order, -1 if none
+// must be called with lock held
+func (fw *frameWriter) nextInOrder() int {
+	// control stream waiting for window goes before new packages
+	waiting := len(fw.queues[ControlStream]) > 0
+	for i, stream := range fw.order {
+		if fw.started[stream] || (!waiting && fw.writable(stream)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// whether there is something allowed to be written, must be called with lock held
+func (fw *frameWriter) ready() bool {
+	return fw.updateDue() || fw.writable(ControlStream) || fw.nextInOrder() >= 0
+}
+
+// pick next data frame to write, must be called with lock held
+func (fw *frameWriter) next() (uint32, []byte) {
+	stream := uint32(ControlStream)
+	if !fw.writable(ControlStream) {
+		i := fw.nextInOrder()
+		stream = fw.order[i]
+		fw.order = append(fw.order[:i], fw.order[i+1:]...)
+	}
+
+	queue := fw.queues[stream]
+	if !fw.started[stream] {
+		// window taken by the whole package at once
+		fw.window = fw.window - int64(len(queue[0]))
+		fw.started[stream] = true
+	}
+	n := len(queue[0])
+	if n > fw.frameSize {
+		n = fw.frameSize
+	}
+	payload := queue[0][:n]
+	queue[0] = queue[0][n:]
+	fw.queued[stream] = fw.queued[stream] - n
+
+	if len(queue[0]) == 0 {
+		queue = queue[1:]
+		delete(fw.started, stream)
+	}
+	if len(queue) == 0 {
+		delete(fw.queues, stream)
+		delete(fw.queued, stream)
+	} else {
+		fw.queues[stream] = queue
+		if stream != ControlStream {
+			// take turn again later
+			fw.order = append(fw.order, stream)
+		}
+	}
+	return stream, payload
+}
+
+func (fw *frameWriter) loop() {
+	for {
+		var err error
+
+		fw.lock.Lock()
+		for !fw.ready() && !fw.closed {
+			fw.cond.Wait()
+		}
+		if fw.closed {
+			fw.lock.Unlock()
+			return
+		}
+		if fw.updateDue() {
+			// window update goes first
+			increment := make([]byte, 4)
+			binary.BigEndian.PutUint32(increment, uint32(fw.consumed))
+			fw.consumed = 0
+			fw.lock.Unlock()
+			err = writeFrame(fw.w, frameWindowUpdate, ControlStream, increment)
+		} else {
+			stream, payload := fw.next()
+			// wake up whoever waits for queued data being written
+			fw.cond.Broadcast()
+			fw.lock.Unlock()
+			err = writeFrame(fw.w, frameData, stream, payload)
+		}
+
+		if err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			fw.lock.Lock()
+			fw.closed = true
+			fw.err = err
+			fw.queues = make(map[uint32][][]byte)
+			fw.queued = make(map[uint32]int)
+			fw.started = make(map[uint32]bool)
+			fw.order = nil
+			fw.cond.Broadcast()
+			fw.lock.Unlock()
+			return
+		}
+	}
+}
+
+func writeFrame(w io.Writer, kind byte, stream uint32, payload []byte) error {
+	b := make([]byte, frameHeaderSize+len(payload))
+	copy(b[0:2], frameMagic[:])
+	b[2] = kind
+	binary.BigEndian.PutUint32(b[3:7], stream)
+	binary.BigEndian.PutUint32(b[7:11], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[11:15], crc32.Checksum(b[0:11], frameTable))
+	copy(b[frameHeaderSize:], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+// read frames from connection until it is closed
+// a damaged frame header is skipped byte by byte until a valid one shows up
+// @fw: writer of the same connection, credited by window updates
+func readFrames(r io.Reader, frames chan Frame, fw *frameWriter) error {
+	br := bufio.NewReader(r)
+	head := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return err
+	}
+	for {
+		if !validFrameHeader(head) {
+			log.Println(logtag, "protocol error: damaged frame")
+			for !validFrameHeader(head) {
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				copy(head, head[1:])
+				head[frameHeaderSize-1] = b
+			}
+		}
+
+		length := binary.BigEndian.Uint32(head[7:11])
+		payload := getBuffer(int(length))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+
+		if head[2] == frameWindowUpdate {
+			if length == 4 {
+				fw.credit(binary.BigEndian.Uint32(payload))
+			}
+			putBuffer(payload)
+		} else {
+			// frames waiting to be consumed are bounded by the window
+			if err := fw.receive(len(payload)); err != nil {
+				return err
+			}
+			frames <- Frame{Stream: binary.BigEndian.Uint32(head[3:7]), Data: payload}
+		}
+
+		if _, err := io.ReadFull(br, head); err != nil {
+			return err
+		}
+	}
+}
+
+// consumer is done with the data of the frame, its buffer is reused
+func releaseFrame(f Frame) {
+	putBuffer(f.Data)
+}
+
+func validFrameHeader(head []byte) bool {
+	return head[0] == frameMagic[0] && head[1] == frameMagic[1] &&
+		(head[2] == frameData || head[2] == frameWindowUpdate) &&
+		binary.BigEndian.Uint32(head[11:15]) == crc32.Checksum(head[0:11], frameTable) &&
+		binary.BigEndian.Uint32(head[7:11]) <= maxFrameSize
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameBuffers(t *testing.T) {
+	for _, c := range []struct{ n, size int }{
+		{0, 4096}, {15, 4096}, {4096, 4096}, {4097, 8192}, {maxFrameSize, maxFrameSize},
+	} {
+		b := getBuffer(c.n)
+		if len(b) != c.n || cap(b) != c.size {
+			t.Errorf("buffer for %d bytes has len %d cap %d", c.n, len(b), cap(b))
+		}
+		putBuffer(b)
+	}
+}
+
+// packages interleaved on more streams than the window holds are all
+// completed although peer only grants whole packages
+func TestWindowPerPackage(t *testing.T) {
+	a, b := net.Pipe()
+	sender, receiver := NewConn(a), NewConn(b)
+	defer sender.Close()
+	defer receiver.Close()
+
+	size := receiveWindowSize() / 3
+	streams := 10
+	for i := 1; i <= streams; i++ {
+		if err := sender.Send(uint32(i), bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sender.Send(ControlStream, make([]byte, receiveWindowSize()/2+1)); err == nil {
+		t.Fatal("package larger than window accepted")
+	}
+
+	received := make(map[uint32]int)
+	done := 0
+	deadline := time.After(10 * time.Second)
+	for done < streams {
+		select {
+		case f, ok := <-receiver.Frames():
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			received[f.Stream] = received[f.Stream] + len(f.Data)
+			receiver.Release(f)
+			if received[f.Stream] == size {
+				receiver.Consumed(size)
+				done++
+			}
+		case <-deadline:
+			t.Fatalf("stuck with %v of %d bytes each", received, size)
+		}
+	}
+}
+
+// a peer ignoring flow control is dropped
+func TestWindowExceeded(t *testing.T) {
+	a, b := net.Pipe()
+	receiver := NewConn(b)
+	defer a.Close()
+
+	go func() {
+		payload := make([]byte, maxFrameSize)
+		for {
+			if writeFrame(a, frameData, 1, payload) != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.After(10 * time.Second)
+	total := 0
+	for {
+		select {
+		case f, ok := <-receiver.Frames():
+			if !ok {
+				if total > receiveWindowSize() {
+					t.Fatalf("%d bytes accepted beyond window", total)
+				}
+				return
+			}
+			total = total + len(f.Data)
+			receiver.Release(f)
+		case <-deadline:
+			t.Fatal("peer exceeding window not dropped")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// in-process transport, every Dial is paired with an Accept through net.Pipe
+// serves as both Dialer and Listener, mainly for tests
+type MemListener struct {
+	conns  chan net.Conn
+	closed chan bool
+	once   sync.Once
+	// optional, applied to both ends of every connection before framing
+	Wrap func(net.Conn) net.Conn
+}
+
+func NewMemListener() *MemListener {
+	return &MemListener{conns: make(chan net.Conn), closed: make(chan bool)}
+}
+
+func (l *MemListener) Dial() (Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return NewConn(wrap(l.Wrap, client)), nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *MemListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return NewConn(wrap(l.Wrap, conn)), nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *MemListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
@@ -1,83 +1,51 @@
 package network
 
 import (
-	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
 	"log"
 	"net"
 )
 
-type ITCPServer interface {
-	Listen()
-	GetBuffChan() chan []byte
-	Send(b []byte) error
-	readFromClient()
-}
-
 type TCPServer struct {
-	port        string
-	buffchan    chan []byte
-	currentConn net.Conn
+	address  string
+	port     string
+	listener net.Listener
+	// optional, applied to every raw connection before framing
+	Wrap func(net.Conn) net.Conn
 }
 
-func NewServer(port string) ITCPServer {
-	buffchan := make(chan []byte, config.BuffChanSize)
-	return &TCPServer{port: port, buffchan: buffchan}
+// @address: host name or IP address to listen on, all interfaces if empty,
+// may carry its own port as in "10.8.0.1:9000" or "[::1]:9000"
+// @port: port to listen on if address has none
+func NewServer(address string, port string) *TCPServer {
+	return &TCPServer{address: address, port: port}
 }
 
-// when new connection arrive, create an goroutine to handle receiving data.
-// data from client will be writen to buffchan
-func (s *TCPServer) Listen() {
-	tcpServer, _ := net.ResolveTCPAddr("tcp4", ":"+config.Port)
-	listener, _ := net.ListenTCP("tcp", tcpServer)
-
-	for {
-		// new connection from client
-		conn, err := listener.Accept()
-		log.Println(logtag, "new connection from:", conn.RemoteAddr())
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		s.currentConn = conn
-		go s.readFromClient()
+func (s *TCPServer) Listen() error {
+	host, port := SplitAddress(s.address, s.port)
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
 	}
+	s.listener = listener
+	log.Println(logtag, "listening on:", listener.Addr())
+	return nil
 }
 
-func (s *TCPServer) GetBuffChan() chan []byte {
-	return s.buffchan
+// address the server is listening on
+func (s *TCPServer) Addr() string {
+	return s.listener.Addr().String()
 }
 
-func (s *TCPServer) Send(b []byte) (err error) {
-	if len(b) <= config.TransferBlockSize {
-		_, err = s.currentConn.Write(b)
-		common.ErrorHandleDebug(logtag, err)
-	} else {
-		i := 0
-		for ; i+config.TransferBlockSize <= len(b); i = i + config.TransferBlockSize {
-			_, err = s.currentConn.Write(b[i : i+config.TransferBlockSize])
-			common.ErrorHandleDebug(logtag, err)
-		}
-		_, err = s.currentConn.Write(b[i:])
+// wait for next connection from client
+func (s *TCPServer) Accept() (Conn, error) {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return nil, err
 	}
-
-	return
+	log.Println(logtag, "new connection from:", conn.RemoteAddr())
+	return NewConn(wrap(s.Wrap, conn)), nil
 }
 
-func (s *TCPServer) readFromClient() {
-	for {
-		buffer := make([]byte, config.MaxBufferSize)
-		n, err := s.currentConn.Read(buffer)
-		if err != nil {
-			// client send done
-			common.ErrorHandleDebug(logtag, err)
-			return
-		}
-
-		buff := buffer[0:n]
-		if len(buff) != 0 {
-			// log.Println(logtag, "receive len:", len(buff))
-			s.buffchan <- buff
-		}
-	}
+func (s *TCPServer) Close() error {
+	return s.listener.Close()
 }
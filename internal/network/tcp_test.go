@@ -0,0 +1,57 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestSplitAddress(t *testing.T) {
+	cases := []struct {
+		address, host, port string
+	}{
+		{"10.0.0.1", "10.0.0.1", "8909"},
+		{"10.0.0.1:9000", "10.0.0.1", "9000"},
+		{"example.com", "example.com", "8909"},
+		{"example.com:9000", "example.com", "9000"},
+		{"::1", "::1", "8909"},
+		{"[::1]", "::1", "8909"},
+		{"[fe80::1]:9000", "fe80::1", "9000"},
+		{"", "", "8909"},
+	}
+	for _, c := range cases {
+		host, port := SplitAddress(c.address, "8909")
+		if host != c.host || port != c.port {
+			t.Errorf("SplitAddress(%q) = %q, %q", c.address, host, port)
+		}
+	}
+}
+
+func TestListenDial(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "localhost", "::1"} {
+		srv := NewServer(address, "0")
+		if err := srv.Listen(); err != nil {
+			if address == "::1" {
+				t.Log("no IPv6 loopback:", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := srv.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}()
+
+		conn, err := NewClient(srv.Addr(), "").Dial()
+		if err != nil {
+			t.Fatalf("dial %s: %v", srv.Addr(), err)
+		}
+		conn.Close()
+		if err := <-accepted; err != nil {
+			t.Fatal(err)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package rsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"gcloudsync/internal/cdc"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+)
+
+// delta by content defined chunks, selected by DeltaMode "cdc"
+// both sides split their file the same way, receiver sends the list of
+// its chunks and sender answers with references to the chunks it also has
+// plus the data of the ones it has not. unlike fixed blocks, chunks after
+// an insertion keep their boundaries, so no byte by byte scan is needed.
+
+const chunkRowSize = 20
+
+// @blockSize: average chunk size agreed on with peer
+func chunker(blockSize int) cdc.Chunker {
+	return cdc.NewChunker(blockSize)
+}
+
+// chunk list of file structured as below
+// for one chunk:
+// +------+---------------------------+
+// |length|       md5 checksum        |
+// +------+---------------------------+
+// |  4   |             16            |
+// +------+---------------------------+
+// chunks are listed in file order, so offsets follow from lengths
+func GetChunkList(fsys fsops.FS, absPath string, blockSize int) (result []byte, err error) {
+	data, err := fsops.ReadAll(fsys, absPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	b4 := make([]byte, 4)
+	start := 0
+	for _, end := range chunker(blockSize).Split(data) {
+		binary.BigEndian.PutUint32(b4, uint32(end-start))
+		buf.Write(b4)
+		buf.Write(common.GetByteMd5(data[start:end]))
+		start = end
+	}
+	return buf.Bytes(), nil
+}
+
+type chunkLocation struct {
+	start  int
+	length int
+}
+
+// diff of file against chunk list of peer
+// new data records as in GetDiff, chunks peer has are referenced by
+// local range record structured as below
+// +-----+-------+----------------+--------+
+// | tag | start | original start | length |
+// +-----+-------+----------------+--------+
+// |  1  |   4   |       4        |   4    |
+// +-----+-------+----------------+--------+
+// where tag is OpLocalRange
+func GetChunkDiff(fsys fsops.FS, list []byte, absPath string, blockSize int) (diff []byte, err error) {
+	if len(list)%chunkRowSize != 0 {
+		return nil, errors.New("invalid chunk list len")
+	}
+	known := make(map[[16]byte]chunkLocation)
+	offset := 0
+	for pos := 0; pos < len(list); pos = pos + chunkRowSize {
+		length := int(binary.BigEndian.Uint32(list[pos : pos+4]))
+		var md5 [16]byte
+		copy(md5[:], list[pos+4:pos+chunkRowSize])
+		if _, ok := known[md5]; !ok {
+			known[md5] = chunkLocation{start: offset, length: length}
+		}
+		offset = offset + length
+	}
+
+	data, err := fsops.ReadAll(fsys, absPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	// start of data not found at peer yet
+	pending := 0
+	start := 0
+	for _, end := range chunker(blockSize).Split(data) {
+		var md5 [16]byte
+		copy(md5[:], common.GetByteMd5(data[start:end]))
+		if loc, ok := known[md5]; ok && loc.length == end-start {
+			if pending < start {
+				buf.Write(getDiffDataRecord(uint32(pending), uint32(start), data[pending:start]))
+			}
+			buf.Write(getLocalRangeRecord(uint32(start), uint32(loc.start), uint32(loc.length)))
+			pending = end
+		}
+		start = end
+	}
+	if pending < len(data) {
+		buf.Write(getDiffDataRecord(uint32(pending), uint32(len(data)), data[pending:]))
+	}
+	return buf.Bytes(), nil
+}
+
+func getLocalRangeRecord(start uint32, originalStart uint32, length uint32) []byte {
+	record := make([]byte, 13)
+	record[0] = OpLocalRange
+	binary.BigEndian.PutUint32(record[1:5], start)
+	binary.BigEndian.PutUint32(record[5:9], originalStart)
+	binary.BigEndian.PutUint32(record[9:13], length)
+	return record
+}
+
+// input does not contain tag
+func extractLocalRange(b []byte) (start int, originalStart int, length int, err error) {
+	if len(b) != 12 {
+		return 0, 0, 0, errors.New("invalid input length")
+	}
+	start = int(binary.BigEndian.Uint32(b[0:4]))
+	originalStart = int(binary.BigEndian.Uint32(b[4:8]))
+	length = int(binary.BigEndian.Uint32(b[8:12]))
+	return
+}
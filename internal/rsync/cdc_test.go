@@ -0,0 +1,43 @@
+package rsync
+
+import (
+	"bytes"
+	"gcloudsync/internal/fsops"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkDiff(t *testing.T) {
+	original := make([]byte, 300000)
+	rand.New(rand.NewSource(3)).Read(original)
+	modified := append(append([]byte("head"), original[:100000]...), original[150000:]...)
+
+	fsys := fsops.NewMemFS()
+	for _, c := range []struct {
+		name     string
+		original []byte
+	}{{"shifted", original}, {"empty", nil}} {
+		if err := fsops.WriteAll(fsys, "/original", c.original); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsops.WriteAll(fsys, "/modified", modified); err != nil {
+			t.Fatal(err)
+		}
+		list, err := GetChunkList(fsys, "/original", testBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, err := GetChunkDiff(fsys, list, "/modified", testBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &memWriter{limit: len(modified)}
+		if err := applyDiff(diff, c.original, w, testBlockSize); err != nil || !bytes.Equal(w.data, modified) {
+			t.Fatalf("%s: diff does not rebuild file: %v", c.name, err)
+		}
+		// only data around the edits is sent
+		if c.original != nil && len(diff) > len(modified)/10 {
+			t.Fatalf("%s: diff of %d bytes for %d byte file", c.name, len(diff), len(modified))
+		}
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
 	"gcloudsync/internal/fsops"
+	"io"
 
 	"log"
 )
@@ -16,6 +16,7 @@ var logtag string = "[Rsync]"
 const (
 	OpDiffData byte = 24 + iota
 	OpLocalData
+	OpLocalRange
 )
 
 type CheckSums struct {
@@ -37,21 +38,27 @@ type CheckSums struct {
 // chunk: related block index of this hash record
 // rolling checksum: 32 bit Adler-32 checksum
 // md5 checksum: 128 bit MD5 checksum
-func GetCheckSums(absPath string) (result []byte) {
+// @blockSize: TruncateBlockSize agreed on with peer
+func GetCheckSums(fsys fsops.FS, absPath string, blockSize int) (result []byte) {
 	var count int64
 	var buff []byte
-	data := make([]byte, config.TruncateBlockSize)
+	data := make([]byte, blockSize)
 	count = 0
+
+	file, err := fsops.OpenRead(fsys, absPath)
+	common.ErrorHandleDebug(logtag, err)
+	defer file.Close()
+
 	for {
-		n, err := fsops.Read(absPath, data, count)
+		n, err := file.ReadAt(data, count)
 
-		if n != config.TruncateBlockSize {
+		if n != blockSize {
 			buff = data
 		} else if n > 0 {
 			buff = data[0:n]
 		}
 		// calculate record
-		chunk := uint32(count / int64(config.TruncateBlockSize))
+		chunk := uint32(count / int64(blockSize))
 		rc := getRollingChecksum(buff)
 		md5 := common.GetByteMd5(buff)
 		key := getKey(rc)
@@ -67,7 +74,6 @@ func GetCheckSums(absPath string) (result []byte) {
 		count = count + int64(n)
 	}
 
-	fsops.CloseCurrentFile()
 	return
 }
 
@@ -189,7 +195,8 @@ func extractLocal(b []byte) (start int, chunk int, err error) {
 // |  1  |   4   |      4       |
 // +-----+-------+--------------+
 // where tag is OpLocalData
-func GetDiff(table []byte, absPath string) (diff []byte, err error) {
+// @blockSize: size of the blocks table was made of
+func GetDiff(fsys fsops.FS, table []byte, absPath string, blockSize int) (diff []byte, err error) {
 	if len(table)%26 != 0 || len(table) == 0 {
 		return nil, errors.New("invalid table len")
 	}
@@ -208,9 +215,8 @@ func GetDiff(table []byte, absPath string) (diff []byte, err error) {
 	}
 
 	// scan file
-	data, err := fsops.ReadAll(absPath)
+	data, err := fsops.ReadAll(fsys, absPath)
 	common.ErrorHandleDebug(logtag, err)
-	blockSize := config.TruncateBlockSize
 	diff = make([]byte, 0)
 	offset = 0
 	pos := 0
@@ -267,57 +273,98 @@ func GetDiff(table []byte, absPath string) (diff []byte, err error) {
 	return
 }
 
-func ReformFile(diff []byte, absPath string) (err error) {
-	// create a temp file with .tmp postfix
-	tmpPath := absPath + ".tmp"
-	err = fsops.Create(tmpPath)
+// rebuild file from diff and original file
+// new content is staged under root and renamed into place when done
+// @checksum: expected md5 of the rebuilt file
+// @blockSize: size of the blocks local data records refer to
+func ReformFile(fsys fsops.FS, diff []byte, absPath string, root string, checksum []byte, blockSize int) (err error) {
+	originalData, err := fsops.ReadAll(fsys, absPath)
 	common.ErrorHandleDebug(logtag, err)
 
-	pos := 0
-	for {
-		if pos == len(diff) {
-			// reform file finished
-			break
-		}
-		originalData, err := fsops.ReadAll(absPath)
-		common.ErrorHandleDebug(logtag, err)
+	tmpFile, err := fsops.CreateStagingFile(fsys, root)
+	if err != nil {
+		return err
+	}
+
+	if err := applyDiff(diff, originalData, tmpFile, blockSize); err != nil {
+		fsops.DiscardStagingFile(fsys, tmpFile)
+		return err
+	}
+	return fsops.CommitStagingFile(fsys, tmpFile, absPath, checksum)
+}
 
+// write the file described by diff to out
+// records must follow each other without gap or overlap
+func applyDiff(diff []byte, originalData []byte, out io.WriterAt, blockSize int) error {
+	pos := 0
+	written := 0
+	for pos < len(diff) {
 		// get tag
 		tag := diff[pos]
 		pos++
+		if len(diff)-pos < 8 {
+			return errors.New("truncated diff record")
+		}
 
 		if tag == OpDiffData {
 			start, end, err := extractDiff(diff[pos : pos+8])
-			common.ErrorHandleDebug(logtag, err)
+			if err != nil {
+				return err
+			}
 			pos = pos + 8
+			if start != written || end-start > len(diff)-pos {
+				return errors.New("diff data out of bound")
+			}
 			// write new data to temp file
 			newData := diff[pos : pos+end-start]
-			err = fsops.WriteAllAt(tmpPath, newData, start)
-			common.ErrorHandleDebug(logtag, err)
+			if _, err = out.WriteAt(newData, int64(start)); err != nil {
+				return err
+			}
 			pos = pos + end - start
+			written = end
 		} else if tag == OpLocalData {
 			start, trunk, err := extractLocal(diff[pos : pos+8])
-			common.ErrorHandleDebug(logtag, err)
+			if err != nil {
+				return err
+			}
 			pos = pos + 8
 
 			// get block from original file
-			begin := trunk * config.TruncateBlockSize
-			end := (trunk + 1) * config.TruncateBlockSize
-			if end > len(originalData) {
-				end = len(originalData)
+			begin := int64(trunk) * int64(blockSize)
+			end := begin + int64(blockSize)
+			if end > int64(len(originalData)) {
+				end = int64(len(originalData))
+			}
+			if start != written || begin >= end {
+				return errors.New("local data out of bound")
 			}
 			originalBlock := originalData[begin:end]
 
 			// write to temp file
-			err = fsops.WriteAllAt(tmpPath, originalBlock, start)
-			common.ErrorHandleDebug(logtag, err)
+			if _, err = out.WriteAt(originalBlock, int64(start)); err != nil {
+				return err
+			}
+			written = start + len(originalBlock)
+		} else if tag == OpLocalRange {
+			if len(diff)-pos < 12 {
+				return errors.New("truncated diff record")
+			}
+			start, begin, length, err := extractLocalRange(diff[pos : pos+12])
+			if err != nil {
+				return err
+			}
+			pos = pos + 12
+			if start != written || length == 0 || begin > len(originalData) || length > len(originalData)-begin {
+				return errors.New("local data out of bound")
+			}
+
+			if _, err = out.WriteAt(originalData[begin:begin+length], int64(start)); err != nil {
+				return err
+			}
+			written = start + length
 		} else {
-			log.Panicln(logtag, "invalid tag")
+			return errors.New("invalid diff tag")
 		}
 	}
-	fsops.CloseCurrentFile()
-	fsops.Delete(absPath)
-	fsops.Rename(tmpPath, absPath)
-	// log.Println(logtag, "reform file done.")
-	return
+	return nil
 }
@@ -0,0 +1,111 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"testing"
+)
+
+// TruncateBlockSize both sides agreed on
+const testBlockSize = 1024
+
+func FuzzExtractFromOneRow(f *testing.F) {
+	f.Add(getOneRow(0x1234, 7, 0x12345678, common.GetByteMd5([]byte("block"))))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cks, err := extractFromOneRow(b)
+		if err != nil {
+			return
+		}
+		if row := getOneRow(cks.key, cks.chunk, cks.rc, cks.md5[:]); !bytes.Equal(row, b) {
+			t.Fatalf("row does not encode back to input")
+		}
+	})
+}
+
+func FuzzExtractDiff(f *testing.F) {
+	f.Add(getDiffDataRecord(0, 3, []byte("abc"))[1:9])
+	f.Add([]byte{0, 0, 0, 9, 0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		start, end, err := extractDiff(b)
+		if err == nil && start > end {
+			t.Fatalf("accepted start %d after end %d", start, end)
+		}
+	})
+}
+
+func FuzzExtractLocal(f *testing.F) {
+	f.Add(getLocalDataRecord(1024, 1)[1:])
+	f.Add([]byte{0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		start, chunk, err := extractLocal(b)
+		if err != nil {
+			return
+		}
+		if record := getLocalDataRecord(uint32(start), uint32(chunk)); !bytes.Equal(record[1:], b) {
+			t.Fatalf("record does not encode back to input")
+		}
+	})
+}
+
+// collects written data, refusing to grow beyond limit
+type memWriter struct {
+	data  []byte
+	limit int
+}
+
+func (w *memWriter) WriteAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+	if end > int64(w.limit) {
+		return 0, errors.New("write beyond limit")
+	}
+	if end > int64(len(w.data)) {
+		w.data = append(w.data, make([]byte, int(end)-len(w.data))...)
+	}
+	copy(w.data[off:], b)
+	return len(b), nil
+}
+
+func FuzzApplyDiff(f *testing.F) {
+	original := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	modified := append(append([]byte("head"), original[:1500]...), original[2000:]...)
+
+	fsys := fsops.NewMemFS()
+	if err := fsops.WriteAll(fsys, "/original", original); err != nil {
+		f.Fatal(err)
+	}
+	if err := fsops.WriteAll(fsys, "/modified", modified); err != nil {
+		f.Fatal(err)
+	}
+	diff, err := GetDiff(fsys, GetCheckSums(fsys, "/original", testBlockSize), "/modified", testBlockSize)
+	if err != nil {
+		f.Fatal(err)
+	}
+	w := &memWriter{limit: len(modified)}
+	if err := applyDiff(diff, original, w, testBlockSize); err != nil || !bytes.Equal(w.data, modified) {
+		f.Fatalf("seed diff does not rebuild file: %v", err)
+	}
+	f.Add(diff, original)
+	list, err := GetChunkList(fsys, "/original", testBlockSize)
+	if err != nil {
+		f.Fatal(err)
+	}
+	if diff, err = GetChunkDiff(fsys, list, "/modified", testBlockSize); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(diff, original)
+	f.Add(getDiffDataRecord(0, 3, []byte("abc")), []byte{})
+	f.Add([]byte{OpLocalData, 0, 0, 0, 0, 0, 0, 0, 0}, []byte("x"))
+	f.Add([]byte{0xff}, []byte{})
+
+	f.Fuzz(func(t *testing.T, diff []byte, original []byte) {
+		// records never describe more data than they carry or reference
+		w := &memWriter{limit: len(diff) + len(diff)/9*len(original) + 1}
+		applyDiff(diff, original, w, testBlockSize)
+	})
+}
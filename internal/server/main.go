@@ -1,17 +1,19 @@
 package main
 
 import (
-	"gcloudsync/internal/common"
-	"gcloudsync/internal/config"
-	"gcloudsync/internal/core"
+	"gcloudsync/internal/cli"
+	"os"
 )
 
-var logtag string = "[Main]"
-
+// same as "gcloudsync serve", maintenance commands are passed through
 func main() {
-	common.PrintLogo()
-	err := config.ConfigServerRootPath("./config.json")
-	common.ErrorHandleFatal(logtag, err)
-	sc := core.NewServerCore(config.ServerRootPath)
-	sc.StartServer()
+	args := os.Args[1:]
+	switch {
+	case len(args) == 0:
+		args = []string{"serve"}
+	case args[0] == "trash" || args[0] == "gc" || args[0] == "keygen" || args[0] == "rotate-key" || args[0] == "help":
+	default:
+		args = append([]string{"serve"}, args...)
+	}
+	os.Exit(cli.Main(args, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,866 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// content addressed storage, every distinct chunk of content is kept once
+// <root>/.gcs-chunks/
+// +-- lock             names the process using the store, see lock.go
+// +-- refs             reference count of every chunk when last compacted
+// +-- refs-log-<id>    "+<sha256>" and "-<sha256>" lines, changes since
+// +-- <hh>/<sha256>    chunk content, hh are the first two hex digits
+// files in the tree are replaced by manifests listing their chunks,
+// so renames and trash moves stay plain renames of small files.
+// plain files written before dedup was turned on are read as they are.
+//
+// references are added before a manifest is written and dropped after it
+// is gone, a crash in between leaves counts too high but never too low.
+// the gc command recounts them from the manifests.
+// changes are appended to the log, which is folded into refs once it
+// grows longer than the counts, so a write costs its chunks only.
+
+const (
+	DefaultChunkSize = 1 << 20
+	manifestMagic    = "gcs-manifest 1\n"
+	refsFile         = "refs"
+	refsLogPrefix    = "refs-log-"
+	// log lines allowed beyond the number of counts before compacting
+	compactLines = 1024
+)
+
+// content of refs file
+type refsSnapshot struct {
+	// log of changes made after the snapshot
+	Log  string
+	Refs map[string]int
+}
+
+type chunkRef struct {
+	hash string
+	size int64
+}
+
+type manifest struct {
+	size   int64
+	chunks []chunkRef
+}
+
+type ChunkFS struct {
+	inner     fsops.FS
+	dir       string
+	chunkSize int
+
+	// guards refs and the manifests changed together with them
+	lock sync.Mutex
+	refs map[string]int
+
+	held     *storeLock
+	refLog   fsops.File
+	logSize  int64
+	logLines int
+}
+
+// makes temp names in chunk folder unique within the process
+var chunkTmpCount uint64
+
+// @root: synced folder, chunks are kept below it
+func NewChunkFS(inner fsops.FS, root string, chunkSize int) (*ChunkFS, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	c := &ChunkFS{inner: inner, dir: filepath.Clean(root + "/" + common.ChunkDir), chunkSize: chunkSize}
+	if err := fsops.MakedirAll(inner, c.dir); err != nil {
+		return nil, err
+	}
+	held, err := acquireLock(inner, c.dir+"/"+lockFile)
+	if err != nil {
+		return nil, err
+	}
+	c.held = held
+	if err := c.loadRefs(root); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// stop logging and give up the lock, the store can not be used afterwards
+func (c *ChunkFS) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	if c.refLog != nil {
+		err = c.refLog.Close()
+		c.refLog = nil
+	}
+	if c.held != nil {
+		if lerr := c.held.release(); err == nil {
+			err = lerr
+		}
+		c.held = nil
+	}
+	return err
+}
+
+// read counts and replay their log, then start a new log
+func (c *ChunkFS) loadRefs(root string) error {
+	data, err := fsops.ReadAll(c.inner, c.dir+"/"+refsFile)
+	if os.IsNotExist(err) {
+		// lost or never written, counting from scratch is always safe
+		if c.refs, err = c.count(root); err != nil {
+			return err
+		}
+		return c.compact()
+	}
+	if err != nil {
+		return err
+	}
+	var snap refsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Log == "" {
+		// plain counts, written before changes were logged
+		snap.Refs = nil
+		if err := json.Unmarshal(data, &snap.Refs); err != nil {
+			return err
+		}
+	}
+	c.refs = snap.Refs
+	if c.refs == nil {
+		c.refs = make(map[string]int)
+	}
+	if snap.Log != "" {
+		if err := c.replay(c.dir + "/" + filepath.Base(snap.Log)); err != nil {
+			return err
+		}
+	}
+	return c.compact()
+}
+
+// apply logged changes to counts, lines torn by a crash are skipped
+func (c *ChunkFS) replay(path string) error {
+	data, err := fsops.ReadAll(c.inner, path)
+	if os.IsNotExist(err) {
+		// nothing was logged
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) != 1+sha256.Size*2 {
+			continue
+		}
+		hash := line[1:]
+		switch line[0] {
+		case '+':
+			c.refs[hash]++
+		case '-':
+			if c.refs[hash] > 1 {
+				c.refs[hash]--
+			} else {
+				delete(c.refs, hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *ChunkFS) isChunkPath(p string) bool {
+	return strings.HasPrefix(filepath.Clean(p)+"/", c.dir+"/")
+}
+
+func (c *ChunkFS) chunkPath(hash string) string {
+	return c.dir + "/" + hash[:2] + "/" + hash
+}
+
+func (c *ChunkFS) tmpPath() string {
+	return c.dir + "/tmp-" + strconv.FormatUint(atomic.AddUint64(&chunkTmpCount, 1), 36)
+}
+
+func encodeManifest(m *manifest) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(manifestMagic)
+	for _, chunk := range m.chunks {
+		buf.WriteString(chunk.hash + " " + strconv.FormatInt(chunk.size, 10) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// nil manifest for a plain file
+func readManifest(file fsops.File) (*manifest, error) {
+	magic := make([]byte, len(manifestMagic))
+	n, err := file.ReadAt(magic, 0)
+	if n < len(magic) || string(magic) != manifestMagic {
+		if err == io.EOF {
+			err = nil
+		}
+		return nil, err
+	}
+
+	m := &manifest{}
+	scanner := bufio.NewScanner(io.NewSectionReader(file, int64(len(magic)), 1<<62))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, errors.New("corrupted manifest: " + file.Name())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.New("corrupted manifest: " + file.Name())
+		}
+		m.chunks = append(m.chunks, chunkRef{hash: fields[0], size: size})
+		m.size = m.size + size
+	}
+	return m, scanner.Err()
+}
+
+// manifest of the file at p, nil for plain files and folders
+func (c *ChunkFS) manifestAt(p string) (*manifest, error) {
+	info, err := c.inner.Stat(p)
+	if err != nil || info.IsDir() {
+		return nil, err
+	}
+	file, err := c.inner.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readManifest(file)
+}
+
+// save counts naming a new empty log, older logs are dropped
+// must be called with lock held
+func (c *ChunkFS) compact() error {
+	name := refsLogPrefix + strconv.FormatInt(time.Now().UnixNano(), 36) +
+		"-" + strconv.FormatUint(atomic.AddUint64(&chunkTmpCount, 1), 36)
+	file, err := c.inner.OpenFile(c.dir+"/"+name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(refsSnapshot{Log: name, Refs: c.refs})
+	tmp := c.tmpPath()
+	if err == nil {
+		err = fsops.WriteAll(c.inner, tmp, data)
+	}
+	if err == nil {
+		err = c.inner.Rename(tmp, c.dir+"/"+refsFile)
+	}
+	if err != nil {
+		file.Close()
+		c.inner.Remove(tmp)
+		c.inner.Remove(c.dir + "/" + name)
+		return err
+	}
+	if c.refLog != nil {
+		c.refLog.Close()
+	}
+	c.refLog, c.logSize, c.logLines = file, 0, 0
+
+	entries, err := c.inner.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), refsLogPrefix) && entry.Name() != name {
+			c.inner.Remove(c.dir + "/" + entry.Name())
+		}
+	}
+	return nil
+}
+
+// append changes of counts to the log
+// @op: '+' for references taken, '-' for references dropped
+// must be called with lock held
+func (c *ChunkFS) logRefs(op byte, chunks []chunkRef) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	if c.refLog == nil {
+		return errors.New("chunk store is closed")
+	}
+	buf := make([]byte, 0, len(chunks)*(sha256.Size*2+2))
+	for _, chunk := range chunks {
+		buf = append(buf, op)
+		buf = append(buf, chunk.hash...)
+		buf = append(buf, '\n')
+	}
+	if _, err := c.refLog.WriteAt(buf, c.logSize); err != nil {
+		return err
+	}
+	if err := c.refLog.Sync(); err != nil {
+		return err
+	}
+	c.logSize = c.logSize + int64(len(buf))
+	c.logLines = c.logLines + len(chunks)
+	if c.logLines > len(c.refs)+compactLines {
+		return c.compact()
+	}
+	return nil
+}
+
+// split content into chunks, store missing ones and take a reference on each
+// must be called with lock held
+func (c *ChunkFS) addChunks(content io.ReaderAt, size int64) (*manifest, error) {
+	m := &manifest{size: size}
+	buf := make([]byte, c.chunkSize)
+	for off := int64(0); off < size; {
+		n, err := content.ReadAt(buf, off)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		if off+int64(n) > size {
+			n = int(size - off)
+		}
+		sum := sha256.Sum256(buf[:n])
+		hash := hex.EncodeToString(sum[:])
+		if c.refs[hash] == 0 && !fsops.IsFileExist(c.inner, c.chunkPath(hash)) {
+			if err := c.writeChunk(hash, buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		c.refs[hash]++
+		m.chunks = append(m.chunks, chunkRef{hash: hash, size: int64(n)})
+		off = off + int64(n)
+	}
+	return m, nil
+}
+
+func (c *ChunkFS) writeChunk(hash string, data []byte) error {
+	if err := fsops.MakedirAll(c.inner, filepath.Dir(c.chunkPath(hash))); err != nil {
+		return err
+	}
+	tmp := c.tmpPath()
+	if err := fsops.WriteAll(c.inner, tmp, data); err != nil {
+		c.inner.Remove(tmp)
+		return err
+	}
+	return c.inner.Rename(tmp, c.chunkPath(hash))
+}
+
+// drop references, delete chunks nobody refers to any more
+// chunks missing in refs are left for gc
+// must be called with lock held
+func (c *ChunkFS) release(manifests ...*manifest) error {
+	var dropped []chunkRef
+	var unused []string
+	for _, m := range manifests {
+		if m == nil {
+			continue
+		}
+		for _, chunk := range m.chunks {
+			n, ok := c.refs[chunk.hash]
+			if !ok {
+				continue
+			}
+			dropped = append(dropped, chunk)
+			if n > 1 {
+				c.refs[chunk.hash] = n - 1
+				continue
+			}
+			delete(c.refs, chunk.hash)
+			unused = append(unused, chunk.hash)
+		}
+	}
+	// logged before chunks are deleted, unlogged they are left for gc
+	if err := c.logRefs('-', dropped); err != nil {
+		return err
+	}
+	for _, hash := range unused {
+		c.inner.Remove(c.chunkPath(hash))
+	}
+	return nil
+}
+
+// replace content of p with a manifest of content
+func (c *ChunkFS) store(p string, content io.ReaderAt, size int64, old *manifest) (*manifest, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m, err := c.addChunks(content, size)
+	if err == nil {
+		err = c.logRefs('+', m.chunks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := c.tmpPath()
+	err = fsops.WriteAll(c.inner, tmp, encodeManifest(m))
+	if err == nil {
+		if info, serr := c.inner.Stat(p); serr == nil {
+			c.inner.Chmod(tmp, info.Mode())
+		}
+		err = c.inner.Rename(tmp, p)
+	}
+	if err != nil {
+		c.inner.Remove(tmp)
+		c.release(m)
+		return nil, err
+	}
+	return m, c.release(old)
+}
+
+// manifests of every file below root, chunk folder left out
+func (c *ChunkFS) manifests(root string) (result []*manifest, err error) {
+	err = fsops.Walk(c.inner, root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if c.isChunkPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		m, err := c.manifestAt(path)
+		if m != nil {
+			result = append(result, m)
+		}
+		return err
+	})
+	return result, err
+}
+
+// reference counts found in manifests below root
+func (c *ChunkFS) count(root string) (map[string]int, error) {
+	manifests, err := c.manifests(root)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int)
+	for _, m := range manifests {
+		for _, chunk := range m.chunks {
+			refs[chunk.hash]++
+		}
+	}
+	return refs, nil
+}
+
+type GCStats struct {
+	Chunks  int   // chunks still referenced
+	Removed int   // chunks deleted
+	Freed   int64 // bytes deleted
+}
+
+// recount references from manifests and delete unreferenced chunks
+// and leftover temp files. a running server holds the lock of the store,
+// so gc can not be opened next to it.
+func (c *ChunkFS) GC(root string) (stats GCStats, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	refs, err := c.count(root)
+	if err != nil {
+		return stats, err
+	}
+	entries, err := c.inner.ReadDir(c.dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		path := c.dir + "/" + entry.Name()
+		if !entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), "tmp-") {
+				c.inner.Remove(path)
+			}
+			continue
+		}
+		chunks, err := c.inner.ReadDir(path)
+		if err != nil {
+			return stats, err
+		}
+		for _, chunk := range chunks {
+			if refs[chunk.Name()] > 0 {
+				stats.Chunks++
+				continue
+			}
+			if err := c.inner.Remove(path + "/" + chunk.Name()); err != nil {
+				return stats, err
+			}
+			stats.Removed++
+			stats.Freed = stats.Freed + chunk.Size()
+		}
+	}
+	c.refs = refs
+	return stats, c.compact()
+}
+
+// gc command of server binary
+func RunGC(fsys fsops.FS, root string) error {
+	c, ok := fsys.(*ChunkFS)
+	if !ok {
+		return errors.New("gc needs Dedup enabled in server storage config")
+	}
+	stats, err := c.GC(root)
+	if err != nil {
+		return err
+	}
+	fmt.Println("chunks in use:", stats.Chunks)
+	fmt.Println("removed", stats.Removed, "chunks,", stats.Freed, "bytes")
+	return nil
+}
+
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *sizedInfo) Size() int64 {
+	return i.size
+}
+
+// size of content instead of manifest
+func (c *ChunkFS) contentInfo(path string, info os.FileInfo) (os.FileInfo, error) {
+	if info.IsDir() || c.isChunkPath(path) {
+		return info, nil
+	}
+	m, err := c.manifestAt(path)
+	if err != nil || m == nil {
+		return info, err
+	}
+	return &sizedInfo{FileInfo: info, size: m.size}, nil
+}
+
+func (c *ChunkFS) Stat(p string) (os.FileInfo, error) {
+	info, err := c.inner.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return c.contentInfo(p, info)
+}
+
+func (c *ChunkFS) ReadDir(p string) ([]os.FileInfo, error) {
+	entries, err := c.inner.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = c.contentInfo(p+"/"+entry.Name(), entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (c *ChunkFS) Walk(root string, fn filepath.WalkFunc) error {
+	return fsops.Walk(c, root, fn)
+}
+
+func (c *ChunkFS) Open(p string) (fsops.File, error) {
+	return c.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (c *ChunkFS) OpenFile(p string, flag int, perm os.FileMode) (fsops.File, error) {
+	if c.isChunkPath(p) {
+		return c.inner.OpenFile(p, flag, perm)
+	}
+	// truncation drops references, done on first sync
+	file, err := c.inner.OpenFile(p, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// created as asked, manifest is read from here on
+		file.Close()
+		if file, err = c.inner.Open(p); err != nil {
+			return nil, err
+		}
+	}
+	info, err := c.inner.Stat(p)
+	if err != nil || info.IsDir() {
+		return file, err
+	}
+	m, err := readManifest(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if m == nil {
+			return file, nil
+		}
+		file.Close()
+		return newChunkReader(c, p, m), nil
+	}
+
+	defer file.Close()
+	cache, err := ioutil.TempFile("", "gcs-chunk-")
+	if err != nil {
+		return nil, err
+	}
+	w := &chunkWriter{fs: c, name: p, flag: flag, cache: cache, old: m}
+	var content io.Reader = io.NewSectionReader(file, 0, info.Size())
+	if m != nil {
+		content = io.NewSectionReader(newChunkReader(c, p, m), 0, m.size)
+	}
+	if flag&os.O_TRUNC != 0 {
+		w.dirty = info.Size() > 0
+	} else if _, err = io.Copy(cache, content); err != nil {
+		w.drop()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *ChunkFS) Rename(oldpath string, newpath string) error {
+	if c.isChunkPath(oldpath) || c.isChunkPath(newpath) {
+		return c.inner.Rename(oldpath, newpath)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// content of a replaced file is gone
+	replaced, _ := c.manifestAt(newpath)
+	if err := c.inner.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if replaced == nil {
+		return nil
+	}
+	return c.release(replaced)
+}
+
+func (c *ChunkFS) Remove(p string) error {
+	if c.isChunkPath(p) {
+		return c.inner.Remove(p)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m, err := c.manifestAt(p)
+	if err != nil {
+		return err
+	}
+	if err := c.inner.Remove(p); err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	return c.release(m)
+}
+
+func (c *ChunkFS) RemoveAll(p string) error {
+	if c.isChunkPath(p) {
+		return c.inner.RemoveAll(p)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	manifests, err := c.manifests(p)
+	if err != nil {
+		return err
+	}
+	if err := c.inner.RemoveAll(p); err != nil {
+		return err
+	}
+	return c.release(manifests...)
+}
+
+func (c *ChunkFS) Mkdir(p string, perm os.FileMode) error {
+	return c.inner.Mkdir(p, perm)
+}
+
+func (c *ChunkFS) MkdirAll(p string, perm os.FileMode) error {
+	return c.inner.MkdirAll(p, perm)
+}
+
+func (c *ChunkFS) Chmod(p string, mode os.FileMode) error {
+	return c.inner.Chmod(p, mode)
+}
+
+// reads content of a manifest, chunks are opened one at a time
+type chunkReader struct {
+	fs      *ChunkFS
+	name    string
+	m       *manifest
+	offsets []int64 // start of each chunk
+	offset  int64
+
+	current int
+	chunk   fsops.File
+	closed  bool
+}
+
+func newChunkReader(c *ChunkFS, name string, m *manifest) *chunkReader {
+	r := &chunkReader{fs: c, name: name, m: m, current: -1}
+	off := int64(0)
+	for _, chunk := range m.chunks {
+		r.offsets = append(r.offsets, off)
+		off = off + chunk.size
+	}
+	return r
+}
+
+func (r *chunkReader) Name() string {
+	return r.name
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	n, err := r.ReadAt(b, r.offset)
+	r.offset = r.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *chunkReader) ReadAt(b []byte, off int64) (n int, err error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= r.m.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > pos }) - 1
+		if i != r.current {
+			if r.chunk != nil {
+				r.chunk.Close()
+			}
+			r.chunk, err = r.fs.inner.Open(r.fs.chunkPath(r.m.chunks[i].hash))
+			if err != nil {
+				r.chunk, r.current = nil, -1
+				return n, err
+			}
+			r.current = i
+		}
+		want := b[n:]
+		if rest := r.m.chunks[i].size - (pos - r.offsets[i]); int64(len(want)) > rest {
+			want = want[:rest]
+		}
+		got, err := r.chunk.ReadAt(want, pos-r.offsets[i])
+		n = n + got
+		if got < len(want) {
+			if err == nil || err == io.EOF {
+				err = errors.New("chunk shorter than manifest: " + r.m.chunks[i].hash)
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *chunkReader) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.name, Err: errors.New("bad file descriptor")}
+}
+
+func (r *chunkReader) Sync() error {
+	return nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	if r.chunk != nil {
+		return r.chunk.Close()
+	}
+	return nil
+}
+
+// content is edited in a local temp file and stored as chunks on sync
+type chunkWriter struct {
+	fs     *ChunkFS
+	name   string
+	flag   int
+	cache  *os.File
+	old    *manifest
+	offset int64
+	dirty  bool
+	closed bool
+}
+
+func (w *chunkWriter) Name() string {
+	return w.name
+}
+
+func (w *chunkWriter) Read(b []byte) (int, error) {
+	n, err := w.ReadAt(b, w.offset)
+	w.offset = w.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (w *chunkWriter) ReadAt(b []byte, off int64) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: w.name, Err: errors.New("bad file descriptor")}
+	}
+	return w.cache.ReadAt(b, off)
+}
+
+func (w *chunkWriter) WriteAt(b []byte, off int64) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.dirty = true
+	return w.cache.WriteAt(b, off)
+}
+
+func (w *chunkWriter) Sync() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	if !w.dirty {
+		return nil
+	}
+	info, err := w.cache.Stat()
+	if err != nil {
+		return err
+	}
+	m, err := w.fs.store(w.name, w.cache, info.Size(), w.old)
+	if err != nil {
+		return err
+	}
+	w.old = m
+	w.dirty = false
+	return nil
+}
+
+func (w *chunkWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	err := w.Sync()
+	w.drop()
+	return err
+}
+
+func (w *chunkWriter) drop() {
+	w.closed = true
+	w.cache.Close()
+	os.Remove(w.cache.Name())
+}
@@ -0,0 +1,235 @@
+package storage_test
+
+import (
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/storage"
+	"os"
+	"strings"
+	"testing"
+)
+
+// chunk files stored below root
+func chunkCount(t *testing.T, fsys fsops.FS, root string) int {
+	count := 0
+	err := fsys.Walk(root+"/.gcs-chunks", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && len(info.Name()) == 64 {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func readFile(t *testing.T, fsys fsops.FS, path string) string {
+	t.Helper()
+	data, err := fsops.ReadAll(fsys, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestChunkFSDedup(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root+"/a"); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 distinct chunks: "aaaa", "bbbb", "cc"
+	content := "aaaabbbbaaaacc"
+	for _, name := range []string{"/one", "/two", "/a/three"} {
+		if err := fsops.WriteAll(fsys, root+name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := chunkCount(t, inner, root); n != 3 {
+		t.Fatalf("%d chunks stored, want 3", n)
+	}
+	if got := readFile(t, fsys, root+"/a/three"); got != content {
+		t.Fatalf("read %q", got)
+	}
+	if info, err := fsys.Stat(root + "/one"); err != nil || info.Size() != int64(len(content)) {
+		t.Fatalf("stat %v, %v", info, err)
+	}
+	if manifest := readFile(t, inner, root+"/one"); !strings.HasPrefix(manifest, "gcs-manifest") {
+		t.Fatalf("file not stored as manifest: %q", manifest)
+	}
+
+	// partial overwrite keeps the shared chunks
+	if _, err := fsops.WriteOnce(fsys, root+"/one", []byte("dd"), 12); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, root+"/one"); got != "aaaabbbbaaaadd" {
+		t.Fatalf("read after write %q", got)
+	}
+	if n := chunkCount(t, inner, root); n != 4 {
+		t.Fatalf("%d chunks stored, want 4", n)
+	}
+
+	// replacing a file by rename drops its references
+	if err := fsops.Rename(fsys, root+"/one", root+"/two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.Delete(fsys, root+"/a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, inner, root); n != 3 {
+		t.Fatalf("%d chunks left, want 3", n)
+	}
+	if err := fsops.Delete(fsys, root+"/two"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, inner, root); n != 0 {
+		t.Fatalf("%d chunks left after deleting everything, want 0", n)
+	}
+}
+
+func TestChunkFSGC(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root); err != nil {
+		t.Fatal(err)
+	}
+	// written before dedup was on
+	if err := fsops.WriteAll(inner, root+"/plain", []byte("plain content")); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, root+"/plain"); got != "plain content" {
+		t.Fatalf("read plain file %q", got)
+	}
+	if err := fsops.WriteAll(fsys, root+"/kept", []byte("keepkeep")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(fsys, root+"/lost", []byte("lostlost")); err != nil {
+		t.Fatal(err)
+	}
+	// manifest vanished behind the back of the store, chunk leaks
+	if err := inner.Remove(root + "/lost"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, inner, root); n != 2 {
+		t.Fatalf("%d chunks stored, want 2", n)
+	}
+
+	stats, err := fsys.GC(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks != 1 || stats.Removed != 1 || stats.Freed != 4 {
+		t.Fatalf("gc stats %+v", stats)
+	}
+	if got := readFile(t, fsys, root+"/kept"); got != "keepkeep" {
+		t.Fatalf("read after gc %q", got)
+	}
+
+	// counts are rebuilt when the refs file is lost
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Remove(root + "/.gcs-chunks/refs"); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err = storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.Delete(fsys, root+"/kept"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, inner, root); n != 0 {
+		t.Fatalf("%d chunks left, want 0", n)
+	}
+}
+
+func TestChunkFSLock(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gc run next to the server
+	if _, err := storage.NewChunkFS(inner, root, 4); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("second open gave %v", err)
+	}
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fsops.IsFileExist(inner, root+"/.gcs-chunks/lock") {
+		t.Fatal("lock left after close")
+	}
+	if err := fsops.WriteAll(fsys, root+"/closed", []byte("data")); err == nil {
+		t.Fatal("write to closed store succeeded")
+	}
+
+	// left over by a process which did not stop cleanly
+	if err := fsops.WriteAll(inner, root+"/.gcs-chunks/lock", []byte("1 otherhost 42 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err = storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	fsys.Close()
+}
+
+func TestChunkFSRefsLog(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := readFile(t, inner, root+"/.gcs-chunks/refs")
+	for _, name := range []string{"/one", "/two"} {
+		if err := fsops.WriteAll(fsys, root+name, []byte("aaaabbbb")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsops.Delete(fsys, root+"/one"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, inner, root+"/.gcs-chunks/refs"); got != refs {
+		t.Fatalf("refs rewritten on every change: %q", got)
+	}
+
+	// counts are replayed from the log when opened again
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err = storage.NewChunkFS(inner, root, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+	if n := chunkCount(t, inner, root); n != 2 {
+		t.Fatalf("%d chunks stored, want 2", n)
+	}
+	if err := fsops.Delete(fsys, root+"/two"); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, inner, root); n != 0 {
+		t.Fatalf("%d chunks left, want 0", n)
+	}
+}
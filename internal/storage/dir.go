@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"gcloudsync/internal/fsops"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// objects kept as files under a root folder, key is the relative path
+// storage type "dir" uses the folder directly, see openBackend, this one
+// lets NewFS be checked against a folder on disk
+type DirBackend struct {
+	root string
+}
+
+func NewDirBackend(root string) *DirBackend {
+	return &DirBackend{root: root}
+}
+
+func (d *DirBackend) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(strings.TrimSuffix(key, "/")))
+}
+
+func (d *DirBackend) Stat(key string) (Object, error) {
+	info, err := os.Stat(d.path(key))
+	if err != nil {
+		return Object{}, err
+	}
+	if info.IsDir() != strings.HasSuffix(key, "/") {
+		return Object{}, os.ErrNotExist
+	}
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (d *DirBackend) Get(key string, w io.Writer) error {
+	file, err := os.Open(d.path(key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func (d *DirBackend) Put(key string, r io.ReadSeeker, size int64) error {
+	dest := d.path(key)
+	if strings.HasSuffix(key, "/") {
+		return os.MkdirAll(dest, 0777)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+
+	// replace atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".put-")
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tmp, r, size)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d *DirBackend) Copy(src string, dst string) error {
+	file, err := os.Open(d.path(src))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return d.Put(dst, file, info.Size())
+}
+
+func (d *DirBackend) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirBackend) List(prefix string, recursive bool) (objects []Object, err error) {
+	base := d.path(prefix)
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		return nil, nil
+	}
+	if !recursive {
+		entries, err := ioutil.ReadDir(base)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range entries {
+			objects = append(objects, d.object(prefix+info.Name(), info))
+		}
+		return objects, nil
+	}
+
+	err = fsops.OS.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == base {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, d.object(prefix+filepath.ToSlash(rel), info))
+		return nil
+	})
+	return objects, err
+}
+
+func (d *DirBackend) object(key string, info os.FileInfo) Object {
+	if info.IsDir() {
+		key = key + "/"
+	}
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+}
@@ -0,0 +1,627 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encryption at rest, contents of every file are encrypted with a key
+// derived from the master key. names and folders are kept as they are.
+// files written before encryption was turned on are read as they are and
+// encrypted when written again.
+//
+// encrypted file structured as below
+// +--------+--------+-----------+-----------+-----+
+// | magic  | key id | segment 0 | segment 1 | ... |
+// +--------+--------+-----------+-----------+-----+
+// |   8    |   8    |                            |
+// +--------+--------+-----------+-----------+-----+
+// one segment holds 64 KiB of content, the last one less and at least
+// one segment is there even for empty files:
+// +-------+------------------------+
+// | nonce | sealed content and tag |
+// +-------+------------------------+
+// |  12   |                        |
+// +-------+------------------------+
+// key id, index of the segment and whether it is the last one are
+// authenticated too, so segments can not be moved, dropped or mixed
+// between keys without being noticed.
+
+const (
+	encMagic       = "GCSENC1\n"
+	encHeaderSize  = 16
+	encSegmentSize = 64 * 1024
+	encOverhead    = 12 + 16
+	// environment variable master key is read from when no file is configured
+	MasterKeyEnv = "GCS_MASTER_KEY"
+)
+
+var (
+	ErrNoMasterKey = errors.New("no master key, set KeyFile or " + MasterKeyEnv)
+	ErrWrongKey    = errors.New("file encrypted with another master key")
+	ErrCorrupted   = errors.New("encrypted file corrupted")
+)
+
+type EncryptedFS struct {
+	inner fsops.FS
+	aead  cipher.AEAD
+	id    []byte
+}
+
+// @key: master key of 32 bytes
+func NewEncryptedFS(inner fsops.FS, key []byte) (*EncryptedFS, error) {
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(derive(key, "gcloudsync at rest content"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFS{inner: inner, aead: aead, id: derive(key, "gcloudsync at rest key id")[:8]}, nil
+}
+
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// new random master key as written to key files
+func NewMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// master key as 64 hex digits from file, or from environment if file is empty
+func LoadMasterKey(file string) ([]byte, error) {
+	text := os.Getenv(MasterKeyEnv)
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, ErrNoMasterKey
+	}
+	key, err := hex.DecodeString(text)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 64 hex digits")
+	}
+	return key, nil
+}
+
+func (e *EncryptedFS) additionalData(index int64, last bool) []byte {
+	ad := make([]byte, 8+8+1)
+	copy(ad, e.id)
+	binary.BigEndian.PutUint64(ad[8:16], uint64(index))
+	if last {
+		ad[16] = 1
+	}
+	return ad
+}
+
+// key id of file, nil if it is not encrypted
+// empty files are files just created, not yet encrypted either
+func readEncHeader(file io.ReaderAt) ([]byte, error) {
+	header := make([]byte, encHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if n < len(header) || string(header[:8]) != encMagic {
+		if err == io.EOF {
+			err = nil
+		}
+		return nil, err
+	}
+	return header[8:], nil
+}
+
+// number of segments and content size of an encrypted file
+func encLayout(size int64) (segments int64, contentSize int64, err error) {
+	body := size - encHeaderSize
+	if body < encOverhead {
+		return 0, 0, ErrCorrupted
+	}
+	segments = (body + encSegmentSize + encOverhead - 1) / (encSegmentSize + encOverhead)
+	contentSize = body - segments*encOverhead
+	if contentSize < (segments-1)*encSegmentSize {
+		return 0, 0, ErrCorrupted
+	}
+	return segments, contentSize, nil
+}
+
+// write content encrypted to w
+func (e *EncryptedFS) encrypt(w io.WriterAt, content io.ReaderAt, size int64) error {
+	header := append([]byte(encMagic), e.id...)
+	if _, err := w.WriteAt(header, 0); err != nil {
+		return err
+	}
+	plain := make([]byte, encSegmentSize)
+	sealed := make([]byte, 0, encSegmentSize+encOverhead)
+	out := int64(encHeaderSize)
+	for index := int64(0); ; index++ {
+		n := int64(encSegmentSize)
+		if rest := size - index*encSegmentSize; rest < n {
+			n = rest
+		}
+		if got, err := content.ReadAt(plain[:n], index*encSegmentSize); int64(got) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		last := (index+1)*encSegmentSize >= size
+		sealed = sealed[:12]
+		if _, err := rand.Read(sealed); err != nil {
+			return err
+		}
+		sealed = e.aead.Seal(sealed, sealed[:12], plain[:n], e.additionalData(index, last))
+		if _, err := w.WriteAt(sealed, out); err != nil {
+			return err
+		}
+		out = out + int64(len(sealed))
+		if last {
+			return nil
+		}
+	}
+}
+
+// content size of the file at p as stored by inner
+func (e *EncryptedFS) contentInfo(p string, info os.FileInfo) (os.FileInfo, error) {
+	if info.IsDir() || info.Size() == 0 {
+		return info, nil
+	}
+	file, err := e.inner.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	id, err := readEncHeader(file)
+	if err != nil || id == nil {
+		return info, err
+	}
+	_, size, err := encLayout(info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &sizedInfo{FileInfo: info, size: size}, nil
+}
+
+func (e *EncryptedFS) Stat(p string) (os.FileInfo, error) {
+	info, err := e.inner.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return e.contentInfo(p, info)
+}
+
+func (e *EncryptedFS) ReadDir(p string) ([]os.FileInfo, error) {
+	entries, err := e.inner.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = e.contentInfo(p+"/"+entry.Name(), entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (e *EncryptedFS) Walk(root string, fn filepath.WalkFunc) error {
+	return fsops.Walk(e, root, fn)
+}
+
+func (e *EncryptedFS) Open(p string) (fsops.File, error) {
+	return e.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (e *EncryptedFS) OpenFile(p string, flag int, perm os.FileMode) (fsops.File, error) {
+	// content is replaced on first sync
+	file, err := e.inner.OpenFile(p, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// created as asked, present content is read from here on
+		file.Close()
+		if file, err = e.inner.Open(p); err != nil {
+			return nil, err
+		}
+	}
+	info, err := e.inner.Stat(p)
+	if err != nil || info.IsDir() {
+		return file, err
+	}
+	id, err := readEncHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if id != nil && !bytes.Equal(id, e.id) {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: p, Err: ErrWrongKey}
+	}
+
+	var r fsops.File = file
+	size := info.Size()
+	if id != nil {
+		if r, err = newEncReader(e, file, info.Size()); err != nil {
+			file.Close()
+			return nil, err
+		}
+		size = r.(*encReader).size
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return r, nil
+	}
+
+	defer r.Close()
+	cache, err := ioutil.TempFile("", "gcs-enc-")
+	if err != nil {
+		return nil, err
+	}
+	w := &encWriter{fs: e, name: p, flag: flag, cache: cache}
+	if flag&os.O_TRUNC != 0 || info.Size() == 0 {
+		// new files are encrypted even if nothing is written
+		w.dirty = true
+	} else if _, err = io.Copy(cache, io.NewSectionReader(r, 0, size)); err != nil {
+		w.drop()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (e *EncryptedFS) Rename(oldpath string, newpath string) error {
+	return e.inner.Rename(oldpath, newpath)
+}
+
+func (e *EncryptedFS) Remove(p string) error {
+	return e.inner.Remove(p)
+}
+
+func (e *EncryptedFS) RemoveAll(p string) error {
+	return e.inner.RemoveAll(p)
+}
+
+func (e *EncryptedFS) Mkdir(p string, perm os.FileMode) error {
+	return e.inner.Mkdir(p, perm)
+}
+
+func (e *EncryptedFS) MkdirAll(p string, perm os.FileMode) error {
+	return e.inner.MkdirAll(p, perm)
+}
+
+func (e *EncryptedFS) Chmod(p string, mode os.FileMode) error {
+	return e.inner.Chmod(p, mode)
+}
+
+type RotateStats struct {
+	Files   int // files encrypted with the new key
+	Skipped int // files already using it
+}
+
+// encrypt every file below root with newKey, reserved folders included
+// files already using newKey are skipped, so an interrupted rotation can
+// be run again. should run while server is stopped.
+// @base: filesystem as stored, without encryption
+// @oldKey: key files are encrypted with now, nil if they are plain
+func RotateKey(base fsops.FS, root string, oldKey []byte, newKey []byte) (stats RotateStats, err error) {
+	var old *EncryptedFS
+	if oldKey != nil {
+		if old, err = NewEncryptedFS(base, oldKey); err != nil {
+			return stats, err
+		}
+	}
+	next, err := NewEncryptedFS(base, newKey)
+	if err != nil {
+		return stats, err
+	}
+	staging := filepath.Clean(root + "/" + common.StagingDir)
+
+	err = fsops.Walk(base, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Clean(path) == staging {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return nil
+		}
+		skipped, err := rotateFile(base, root, path, old, next)
+		if skipped {
+			stats.Skipped++
+		} else if err == nil {
+			stats.Files++
+		}
+		return err
+	})
+	return stats, err
+}
+
+func rotateFile(base fsops.FS, root string, path string, old *EncryptedFS, next *EncryptedFS) (skipped bool, err error) {
+	file, err := base.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := base.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	id, err := readEncHeader(file)
+	if err != nil {
+		return false, err
+	}
+
+	var content io.ReaderAt = file
+	size := info.Size()
+	switch {
+	case bytes.Equal(id, next.id):
+		return true, nil
+	case id == nil:
+	case old != nil && bytes.Equal(id, old.id):
+		r, err := newEncReader(old, file, info.Size())
+		if err != nil {
+			return false, err
+		}
+		content, size = r, r.size
+	default:
+		return false, &os.PathError{Op: "rotate", Path: path, Err: ErrWrongKey}
+	}
+
+	tmp, err := fsops.CreateStagingFile(base, root)
+	if err != nil {
+		return false, err
+	}
+	if err = next.encrypt(tmp, content, size); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		base.Chmod(tmp.Name(), info.Mode())
+		err = base.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		base.Remove(tmp.Name())
+	}
+	return false, err
+}
+
+// rotate-key command of server binary
+// @args: file holding the new master key
+func RunRotateKey(cfg config.StorageConfig, root string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: rotate-key <new key file>")
+	}
+	newKey, err := LoadMasterKey(args[0])
+	if err != nil {
+		return err
+	}
+	var oldKey []byte
+	if cfg.Encrypt {
+		if oldKey, err = LoadMasterKey(cfg.KeyFile); err != nil {
+			return err
+		}
+	}
+	base, err := openBackend(cfg)
+	if err != nil {
+		return err
+	}
+	stats, err := RotateKey(base, root, oldKey, newKey)
+	fmt.Println("encrypted", stats.Files, "files with the new key,", stats.Skipped, "already were")
+	if err != nil {
+		return err
+	}
+	fmt.Println("set Encrypt and KeyFile in storage config to use", args[0])
+	return nil
+}
+
+// keygen command of server binary
+func RunKeygen() error {
+	key, err := NewMasterKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// decrypts an encrypted file one segment at a time
+type encReader struct {
+	fs       *EncryptedFS
+	file     fsops.File
+	segments int64
+	size     int64
+	offset   int64
+
+	current int64
+	plain   []byte
+}
+
+func newEncReader(e *EncryptedFS, file fsops.File, fileSize int64) (*encReader, error) {
+	segments, size, err := encLayout(fileSize)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: file.Name(), Err: err}
+	}
+	return &encReader{fs: e, file: file, segments: segments, size: size, current: -1}, nil
+}
+
+func (r *encReader) Name() string {
+	return r.file.Name()
+}
+
+func (r *encReader) Read(b []byte) (int, error) {
+	n, err := r.ReadAt(b, r.offset)
+	r.offset = r.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *encReader) segment(index int64) error {
+	if index == r.current {
+		return nil
+	}
+	start := encHeaderSize + index*(encSegmentSize+encOverhead)
+	n := int64(encSegmentSize + encOverhead)
+	last := index == r.segments-1
+	if last {
+		n = r.size - index*encSegmentSize + encOverhead
+	}
+	sealed := make([]byte, n)
+	if got, err := r.file.ReadAt(sealed, start); int64(got) < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := r.fs.aead.Open(r.plain[:0], sealed[:12], sealed[12:], r.fs.additionalData(index, last))
+	if err != nil {
+		r.current = -1
+		return &os.PathError{Op: "read", Path: r.file.Name(), Err: ErrCorrupted}
+	}
+	r.plain = plain
+	r.current = index
+	return nil
+}
+
+func (r *encReader) ReadAt(b []byte, off int64) (n int, err error) {
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		index := pos / encSegmentSize
+		if err := r.segment(index); err != nil {
+			return n, err
+		}
+		n = n + copy(b[n:], r.plain[pos-index*encSegmentSize:])
+	}
+	return n, nil
+}
+
+func (r *encReader) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: r.Name(), Err: errors.New("bad file descriptor")}
+}
+
+func (r *encReader) Sync() error {
+	return nil
+}
+
+func (r *encReader) Close() error {
+	return r.file.Close()
+}
+
+// content is edited in a local temp file and encrypted into place on sync
+type encWriter struct {
+	fs     *EncryptedFS
+	name   string
+	flag   int
+	cache  *os.File
+	offset int64
+	dirty  bool
+	closed bool
+}
+
+func (w *encWriter) Name() string {
+	return w.name
+}
+
+func (w *encWriter) Read(b []byte) (int, error) {
+	n, err := w.ReadAt(b, w.offset)
+	w.offset = w.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (w *encWriter) ReadAt(b []byte, off int64) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: w.name, Err: errors.New("bad file descriptor")}
+	}
+	return w.cache.ReadAt(b, off)
+}
+
+func (w *encWriter) WriteAt(b []byte, off int64) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.dirty = true
+	return w.cache.WriteAt(b, off)
+}
+
+func (w *encWriter) Sync() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	if !w.dirty {
+		return nil
+	}
+	info, err := w.cache.Stat()
+	if err != nil {
+		return err
+	}
+	file, err := w.fs.inner.OpenFile(w.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err = w.fs.encrypt(file, w.cache, info.Size()); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *encWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	err := w.Sync()
+	w.drop()
+	return err
+}
+
+func (w *encWriter) drop() {
+	w.closed = true
+	w.cache.Close()
+	os.Remove(w.cache.Name())
+}
@@ -0,0 +1,137 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"gcloudsync/internal/fsops"
+	"gcloudsync/internal/storage"
+	"math/rand"
+	"testing"
+)
+
+func masterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptedFS(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := storage.NewEncryptedFS(inner, masterKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, size := range []int{0, 100, 65536, len(data)} {
+		path := root + "/file"
+		if err := fsops.WriteAll(fsys, path, data[:size]); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, fsys, path); got != string(data[:size]) {
+			t.Fatalf("size %d: read back %d bytes", size, len(got))
+		}
+		if info, err := fsys.Stat(path); err != nil || info.Size() != int64(size) {
+			t.Fatalf("size %d: stat %v, %v", size, info, err)
+		}
+		stored := readFile(t, inner, path)
+		if size > 0 && bytes.Contains([]byte(stored), data[:16]) {
+			t.Fatalf("size %d: content stored in plain", size)
+		}
+	}
+
+	// partial write and read across segments
+	path := root + "/file"
+	if _, err := fsops.WriteOnce(fsys, path, []byte("changed"), 65530); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[65530:], "changed")
+	b := make([]byte, 20)
+	if _, err := fsops.ReadOnce(fsys, path, b, 65525); err != nil || !bytes.Equal(b, data[65525:65545]) {
+		t.Fatalf("read %q, %v", b, err)
+	}
+
+	// written before encryption was turned on
+	if err := fsops.WriteAll(inner, root+"/plain", []byte("plain content")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, root+"/plain"); got != "plain content" {
+		t.Fatalf("read plain file %q", got)
+	}
+
+	other, _ := storage.NewEncryptedFS(inner, masterKey(2))
+	if _, err := fsops.ReadAll(other, path); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("read with other key gave %v", err)
+	}
+	stored := []byte(readFile(t, inner, path))
+	stored[100] ^= 1
+	if err := fsops.WriteAll(inner, path, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsops.ReadAll(fsys, path); !errors.Is(err, storage.ErrCorrupted) {
+		t.Fatalf("read damaged file gave %v", err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	inner := fsops.NewMemFS()
+	root := "/root"
+	if err := fsops.MakedirAll(inner, root+"/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(inner, root+"/plain", []byte("plain content")); err != nil {
+		t.Fatal(err)
+	}
+	open := func(key []byte) *storage.ChunkFS {
+		t.Helper()
+		enc, err := storage.NewEncryptedFS(inner, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys, err := storage.NewChunkFS(enc, root, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsys
+	}
+	fsys := open(masterKey(1))
+	for _, name := range []string{"/one", "/a/two"} {
+		if err := fsops.WriteAll(fsys, root+name, []byte("aaaabbbbcc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := storage.RotateKey(inner, root, masterKey(1), masterKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// plain file, two manifests, refs, its log and three chunks
+	if stats.Files != 8 || stats.Skipped != 0 {
+		t.Fatalf("rotate stats %+v", stats)
+	}
+	fsys = open(masterKey(2))
+	for name, want := range map[string]string{"/one": "aaaabbbbcc", "/a/two": "aaaabbbbcc", "/plain": "plain content"} {
+		if got := readFile(t, fsys, root+name); got != want {
+			t.Fatalf("read %s after rotation: %q", name, got)
+		}
+	}
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := storage.NewEncryptedFS(inner, masterKey(1))
+	if _, err := fsops.ReadAll(old, root+"/plain"); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("read with old key gave %v", err)
+	}
+
+	// an interrupted rotation is run again
+	stats, err = storage.RotateKey(inner, root, masterKey(1), masterKey(2))
+	if err != nil || stats.Files != 0 || stats.Skipped != 8 {
+		t.Fatalf("second rotation %+v, %v", stats, err)
+	}
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"gcloudsync/internal/fsops"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a chunk store is used by one process at a time, as serve and gc keep
+// reference counts in memory and would overwrite those of each other.
+// <root>/.gcs-chunks/lock names its owner and when it was last refreshed,
+// a lock not refreshed for lockExpiry is left over by a process which did
+// not stop cleanly and is taken over.
+const lockFile = "lock"
+
+var lockRefresh = time.Minute
+var lockExpiry = 5 * time.Minute
+
+// tells apart stores opened by the same process
+var lockCount uint64
+
+type storeLock struct {
+	fsys  fsops.FS
+	path  string
+	owner string
+	stop  chan bool
+	done  chan bool
+}
+
+// host and process holding a lock
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + " " + strconv.Itoa(os.Getpid()) + " " +
+		strconv.FormatUint(atomic.AddUint64(&lockCount, 1), 10)
+}
+
+// content of lock file, time of refresh followed by owner
+func parseLock(data []byte) (owner string, at time.Time, ok bool) {
+	fields := strings.SplitN(strings.TrimSpace(string(data)), " ", 2)
+	if len(fields) != 2 {
+		return "", at, false
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", at, false
+	}
+	return fields[1], time.Unix(sec, 0), true
+}
+
+func (l *storeLock) write() error {
+	data := strconv.FormatInt(time.Now().Unix(), 10) + " " + l.owner + "\n"
+	return fsops.WriteAll(l.fsys, l.path, []byte(data))
+}
+
+// whether lock file still names this owner
+func (l *storeLock) held() bool {
+	data, err := fsops.ReadAll(l.fsys, l.path)
+	if err != nil {
+		return false
+	}
+	owner, _, ok := parseLock(data)
+	return ok && owner == l.owner
+}
+
+// take the lock at path, refreshed until released
+func acquireLock(fsys fsops.FS, path string) (*storeLock, error) {
+	data, err := fsops.ReadAll(fsys, path)
+	if err == nil {
+		owner, at, ok := parseLock(data)
+		if ok && time.Since(at) < lockExpiry {
+			return nil, fmt.Errorf("chunk store in use by %s since %s, remove %s if it is not running",
+				owner, at.Format(time.RFC3339), path)
+		}
+		log.Println(logtag, "taking over left over lock of", owner)
+		if err := fsys.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// another process may have been quicker
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, errors.New("chunk store in use, lock taken at the same time: " + path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	l := &storeLock{fsys: fsys, path: path, owner: lockOwner(), stop: make(chan bool), done: make(chan bool)}
+	if err := l.write(); err != nil {
+		fsys.Remove(path)
+		return nil, err
+	}
+	go l.refresh()
+	return l, nil
+}
+
+func (l *storeLock) refresh() {
+	defer close(l.done)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(lockRefresh):
+		}
+		if !l.held() {
+			log.Println(logtag, "lock of chunk store was taken over:", l.path)
+			return
+		}
+		if err := l.write(); err != nil {
+			log.Println(logtag, "refresh lock of chunk store:", err)
+		}
+	}
+}
+
+// stop refreshing and remove lock file if it is still ours
+func (l *storeLock) release() error {
+	close(l.stop)
+	<-l.done
+	if !l.held() {
+		return nil
+	}
+	return l.fsys.Remove(l.path)
+}
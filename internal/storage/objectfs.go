@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"errors"
+	"gcloudsync/internal/fsops"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fsops.FS on top of an object store
+// paths map to keys without the leading slash, folders are kept as
+// empty marker objects ending with "/". a folder also exists implicitly
+// while any key lies below it.
+// opened files are cached in a local temp file, downloaded on open and
+// uploaded on Sync or Close. rename is copy and delete, so unlike on
+// disk it is not atomic and files opened before a rename keep the old key.
+type objectFS struct {
+	b Backend
+}
+
+func NewFS(b Backend) fsops.FS {
+	return &objectFS{b: b}
+}
+
+// key of a path, "" for root
+func objectKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+func dirKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func pathError(op string, p string, err error) error {
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// os.ErrNotExist if missing
+func (o *objectFS) stat(key string) (Object, error) {
+	if key == "" {
+		return Object{Key: "", IsDir: true}, nil
+	}
+	obj, err := o.b.Stat(key)
+	if !os.IsNotExist(err) {
+		return obj, err
+	}
+	obj, err = o.b.Stat(dirKey(key))
+	if !os.IsNotExist(err) {
+		return obj, err
+	}
+	children, err := o.b.List(dirKey(key), false)
+	if err != nil {
+		return Object{}, err
+	}
+	if len(children) == 0 {
+		return Object{}, os.ErrNotExist
+	}
+	return Object{Key: dirKey(key), IsDir: true}, nil
+}
+
+func (o *objectFS) Stat(p string) (os.FileInfo, error) {
+	obj, err := o.stat(objectKey(p))
+	if err != nil {
+		return nil, pathError("stat", p, unwrap(err))
+	}
+	return objectInfo(obj), nil
+}
+
+func (o *objectFS) ReadDir(p string) ([]os.FileInfo, error) {
+	key := objectKey(p)
+	obj, err := o.stat(key)
+	if err != nil {
+		return nil, pathError("readdir", p, unwrap(err))
+	}
+	if !obj.IsDir {
+		return nil, pathError("readdir", p, errors.New("not a directory"))
+	}
+	objects, err := o.b.List(dirKey(key), false)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var entries []os.FileInfo
+	for _, obj := range objects {
+		info := objectInfo(obj)
+		if seen[info.Name()] {
+			continue
+		}
+		seen[info.Name()] = true
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *objectFS) Walk(root string, fn filepath.WalkFunc) error {
+	return fsops.Walk(o, root, fn)
+}
+
+func (o *objectFS) Open(p string) (fsops.File, error) {
+	return o.OpenFile(p, os.O_RDONLY, 0)
+}
+
+func (o *objectFS) OpenFile(p string, flag int, perm os.FileMode) (fsops.File, error) {
+	key := objectKey(p)
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	obj, err := o.stat(key)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, pathError("open", p, err)
+	}
+
+	if exists && obj.IsDir {
+		if write {
+			return nil, pathError("open", p, errors.New("is a directory"))
+		}
+		return &objectFile{name: p, dir: true}, nil
+	}
+	if exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, pathError("open", p, os.ErrExist)
+	}
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, pathError("open", p, os.ErrNotExist)
+		}
+		if parent, err := o.stat(objectKey(path.Dir("/" + key))); err != nil || !parent.IsDir {
+			return nil, pathError("open", p, os.ErrNotExist)
+		}
+	}
+
+	cache, err := ioutil.TempFile("", "gcs-object-")
+	if err != nil {
+		return nil, err
+	}
+	f := &objectFile{fs: o, key: key, name: p, flag: flag, cache: cache}
+	switch {
+	case !exists:
+		// make the name visible right away
+		err = o.b.Put(key, strings.NewReader(""), 0)
+	case flag&os.O_TRUNC != 0:
+		f.dirty = true
+	default:
+		err = o.b.Get(key, cache)
+	}
+	if err != nil {
+		f.drop()
+		return nil, pathError("open", p, unwrap(err))
+	}
+	return f, nil
+}
+
+// copy every key below oldpath, then delete the originals
+func (o *objectFS) Rename(oldpath string, newpath string) error {
+	oldKey := objectKey(oldpath)
+	newKey := objectKey(newpath)
+	obj, err := o.stat(oldKey)
+	if err != nil {
+		return pathError("rename", oldpath, unwrap(err))
+	}
+	if parent, err := o.stat(objectKey(path.Dir("/" + newKey))); err != nil || !parent.IsDir {
+		return pathError("rename", newpath, os.ErrNotExist)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	if !obj.IsDir {
+		if dest, err := o.stat(newKey); err == nil && dest.IsDir {
+			return pathError("rename", newpath, os.ErrExist)
+		}
+		if err := o.b.Copy(oldKey, newKey); err != nil {
+			return err
+		}
+		return o.b.Delete(oldKey)
+	}
+
+	if oldKey == "" || strings.HasPrefix(newKey, dirKey(oldKey)) {
+		return pathError("rename", newpath, errors.New("invalid argument"))
+	}
+	if dest, err := o.stat(newKey); err == nil {
+		if !dest.IsDir {
+			return pathError("rename", newpath, os.ErrExist)
+		}
+		if children, err := o.b.List(dirKey(newKey), false); err != nil || len(children) > 0 {
+			return pathError("rename", newpath, os.ErrExist)
+		}
+	}
+	objects, err := o.b.List(dirKey(oldKey), true)
+	if err != nil {
+		return err
+	}
+	if err := o.b.Put(dirKey(newKey), strings.NewReader(""), 0); err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		dest := dirKey(newKey) + strings.TrimPrefix(obj.Key, dirKey(oldKey))
+		if obj.IsDir {
+			err = o.b.Put(dest, strings.NewReader(""), 0)
+		} else {
+			err = o.b.Copy(obj.Key, dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return o.removeAll(oldKey, objects)
+}
+
+func (o *objectFS) Remove(p string) error {
+	key := objectKey(p)
+	obj, err := o.stat(key)
+	if err != nil {
+		return pathError("remove", p, unwrap(err))
+	}
+	if !obj.IsDir {
+		return o.b.Delete(key)
+	}
+	children, err := o.b.List(dirKey(key), false)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return pathError("remove", p, errors.New("directory not empty"))
+	}
+	return o.b.Delete(dirKey(key))
+}
+
+func (o *objectFS) RemoveAll(p string) error {
+	key := objectKey(p)
+	if key == "" {
+		return pathError("removeall", p, errors.New("invalid argument"))
+	}
+	objects, err := o.b.List(dirKey(key), true)
+	if err != nil {
+		return err
+	}
+	return o.removeAll(key, objects)
+}
+
+// delete objects deepest first, then key itself as file and as folder
+func (o *objectFS) removeAll(key string, objects []Object) error {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key > objects[j].Key })
+	for _, obj := range objects {
+		if err := o.b.Delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	if err := o.b.Delete(dirKey(key)); err != nil {
+		return err
+	}
+	return o.b.Delete(key)
+}
+
+func (o *objectFS) Mkdir(p string, perm os.FileMode) error {
+	key := objectKey(p)
+	if _, err := o.stat(key); err == nil {
+		return pathError("mkdir", p, os.ErrExist)
+	}
+	if parent, err := o.stat(objectKey(path.Dir("/" + key))); err != nil || !parent.IsDir {
+		return pathError("mkdir", p, os.ErrNotExist)
+	}
+	return o.b.Put(dirKey(key), strings.NewReader(""), 0)
+}
+
+func (o *objectFS) MkdirAll(p string, perm os.FileMode) error {
+	key := objectKey(p)
+	var missing []string
+	for cur := key; cur != ""; cur = objectKey(path.Dir("/" + cur)) {
+		obj, err := o.stat(cur)
+		if err == nil {
+			if !obj.IsDir {
+				return pathError("mkdir", "/"+cur, errors.New("not a directory"))
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, cur)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := o.b.Put(dirKey(missing[i]), strings.NewReader(""), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects carry no permission bits
+func (o *objectFS) Chmod(p string, mode os.FileMode) error {
+	if _, err := o.stat(objectKey(p)); err != nil {
+		return pathError("chmod", p, unwrap(err))
+	}
+	return nil
+}
+
+func unwrap(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
+
+func objectInfo(obj Object) os.FileInfo {
+	info := &objectFileInfo{name: path.Base("/" + strings.TrimSuffix(obj.Key, "/")), size: obj.Size, modTime: obj.ModTime, mode: 0644}
+	if obj.IsDir {
+		info.size = 0
+		info.mode = os.ModeDir | 0755
+	}
+	return info
+}
+
+type objectFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *objectFileInfo) Name() string       { return i.name }
+func (i *objectFileInfo) Size() int64        { return i.size }
+func (i *objectFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *objectFileInfo) ModTime() time.Time { return i.modTime }
+func (i *objectFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *objectFileInfo) Sys() interface{}   { return nil }
+
+type objectFile struct {
+	fs     *objectFS
+	key    string
+	name   string
+	flag   int
+	dir    bool
+	cache  *os.File
+	offset int64
+	dirty  bool
+	closed bool
+}
+
+func (f *objectFile) Name() string {
+	return f.name
+}
+
+func (f *objectFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset = f.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *objectFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.dir {
+		return 0, pathError("read", f.name, errors.New("is a directory"))
+	}
+	return f.cache.ReadAt(b, off)
+}
+
+func (f *objectFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.dir || f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathError("write", f.name, errors.New("bad file descriptor"))
+	}
+	f.dirty = true
+	return f.cache.WriteAt(b, off)
+}
+
+// upload local changes
+func (f *objectFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.dirty {
+		return nil
+	}
+	info, err := f.cache.Stat()
+	if err != nil {
+		return err
+	}
+	err = f.fs.b.Put(f.key, io.NewSectionReader(f.cache, 0, info.Size()), info.Size())
+	if err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *objectFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	err := f.Sync()
+	f.drop()
+	return err
+}
+
+func (f *objectFile) drop() {
+	f.closed = true
+	if f.cache != nil {
+		f.cache.Close()
+		os.Remove(f.cache.Name())
+	}
+}
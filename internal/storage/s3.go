@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gcloudsync/internal/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// objects kept in a bucket of an S3 compatible service,
+// addressed path style: endpoint/bucket/key
+type S3Backend struct {
+	endpoint *url.URL
+	bucket   string
+	signer   Signer
+	client   *http.Client
+}
+
+func NewS3Backend(cfg config.StorageConfig) (*S3Backend, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage needs Endpoint and Bucket")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.New("s3 endpoint must be an http or https url: " + cfg.Endpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Backend{
+		endpoint: endpoint,
+		bucket:   cfg.Bucket,
+		signer:   Signer{AccessKey: cfg.AccessKey, SecretKey: cfg.SecretKey, Region: region, Service: "s3"},
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// error response of the service
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (s *S3Backend) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		p = p + "/" + key
+	}
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// send a signed request, responses other than 2xx are returned as *S3Error
+func (s *S3Backend) do(method string, key string, query url.Values, header http.Header, body io.ReadSeeker, size int64) (*http.Response, error) {
+	payloadHash := PayloadHash(nil)
+	if body != nil {
+		h, err := hashReader(body)
+		if err != nil {
+			return nil, err
+		}
+		payloadHash = h
+	}
+
+	req, err := http.NewRequest(method, s.url(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(io.LimitReader(body, size))
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.signer.Sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &S3Error{Status: resp.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, e)
+		if e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// hex sha256 of r, r is rewound afterwards
+func hashReader(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func notFound(err error) bool {
+	e, ok := err.(*S3Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+func (s *S3Backend) Stat(key string) (Object, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if notFound(err) {
+		return Object{}, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, ModTime: modTime, IsDir: strings.HasSuffix(key, "/")}, nil
+}
+
+func (s *S3Backend) Get(key string, w io.Writer) error {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0)
+	if notFound(err) {
+		return &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (s *S3Backend) Put(key string, r io.ReadSeeker, size int64) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Backend) Copy(src string, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", uriEncode("/"+s.bucket+"/"+src, false))
+	resp, err := s.do(http.MethodPut, dst, nil, header, nil, 0)
+	if notFound(err) {
+		return &os.PathError{Op: "copy", Path: src, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a copy may fail after 200 OK was sent
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &S3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+func (s *S3Backend) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if notFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Backend) List(prefix string, recursive bool) (objects []Object, err error) {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if !recursive {
+			query.Set("delimiter", "/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			// folder marker of prefix itself
+			if c.Key == prefix {
+				continue
+			}
+			objects = append(objects, Object{Key: c.Key, Size: c.Size, ModTime: c.LastModified, IsDir: strings.HasSuffix(c.Key, "/")})
+		}
+		for _, p := range result.CommonPrefixes {
+			objects = append(objects, Object{Key: p.Prefix, IsDir: true})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, errors.New("s3: truncated listing without continuation token")
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string
+}
+
+func PayloadHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// add x-amz-date, x-amz-content-sha256 and authorization headers
+// @payloadHash: hex sha256 of the body, or UnsignedPayload
+func (s Signer) Sign(req *http.Request, payloadHash string) {
+	s.SignAt(req, payloadHash, time.Now())
+}
+
+func (s Signer) SignAt(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var signed []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			signed = append(signed, name)
+		}
+	}
+	signed = append(signed, "host")
+	sort.Strings(signed)
+
+	scope := s.scope(amzDate)
+	req.Header.Set("Authorization", signAlgorithm+" Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+
+		", Signature="+s.signature(req, signed, payloadHash, amzDate))
+}
+
+// check authorization header of an incoming request,
+// the body is not verified against x-amz-content-sha256
+func (s Signer) Verify(req *http.Request) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signAlgorithm+" ") {
+		return errors.New("missing signature")
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	amzDate := req.Header.Get("X-Amz-Date")
+	if _, err := time.Parse(amzDateFormat, amzDate); err != nil {
+		return errors.New("bad x-amz-date")
+	}
+	if fields["Credential"] != s.AccessKey+"/"+s.scope(amzDate) {
+		return errors.New("bad credential")
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	want := s.signature(req, signed, req.Header.Get("X-Amz-Content-Sha256"), amzDate)
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(want)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func (s Signer) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.Region + "/" + s.Service + "/aws4_request"
+}
+
+func (s Signer) signature(req *http.Request, signed []string, payloadHash string, amzDate string) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	toSign := strings.Join([]string{signAlgorithm, amzDate, s.scope(amzDate), PayloadHash([]byte(canonical))}, "\n")
+
+	key := hmacSum([]byte("AWS4"+s.SecretKey), amzDate[:8])
+	key = hmacSum(key, s.Region)
+	key = hmacSum(key, s.Service)
+	key = hmacSum(key, "aws4_request")
+	return hex.EncodeToString(hmacSum(key, toSign))
+}
+
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// percent encode everything but unreserved characters
+// @slash: encode "/" too
+func uriEncode(s string, slash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
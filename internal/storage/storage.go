@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"gcloudsync/internal/config"
+	"gcloudsync/internal/fsops"
+	"io"
+	"time"
+)
+
+var logtag string = "[Storage]"
+
+// one stored object, or a common prefix in non recursive listing
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// key is a folder, ends with "/"
+	IsDir bool
+}
+
+// flat key value store the server folder can be kept in, made a filesystem by NewFS
+// keys are slash separated paths without leading slash,
+// a key ending with "/" marks a folder
+// S3Backend keeps objects in a bucket, DirBackend as files below a folder
+type Backend interface {
+	// os.ErrNotExist if key does not exist
+	Stat(key string) (Object, error)
+	// write content of key to w
+	Get(key string, w io.Writer) error
+	// store size bytes from r under key, replacing existing content
+	Put(key string, r io.ReadSeeker, size int64) error
+	Copy(src string, dst string) error
+	// no error if key does not exist
+	Delete(key string) error
+	// objects with keys starting with prefix, prefix is "" or ends with "/"
+	// @recursive: if false, only direct children are listed, folders included
+	List(prefix string, recursive bool) ([]Object, error)
+}
+
+// filesystem for the server folder as configured
+// @root: synced folder, the chunk store of Dedup lives below it
+func Open(cfg config.StorageConfig, root string) (fsops.FS, error) {
+	fsys, err := openBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encrypt {
+		key, err := LoadMasterKey(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		// chunks and manifests are encrypted as any other file
+		if fsys, err = NewEncryptedFS(fsys, key); err != nil {
+			return nil, err
+		}
+	}
+	if !cfg.Dedup {
+		return fsys, nil
+	}
+	return NewChunkFS(fsys, root, cfg.ChunkSize)
+}
+
+// give up what Open holds, such as the lock of a chunk store
+func Close(fsys fsops.FS) error {
+	if closer, ok := fsys.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// where files are stored, without encryption or dedup
+func openBackend(cfg config.StorageConfig) (fsops.FS, error) {
+	switch cfg.Type {
+	case "", "dir":
+		// plain folder on disk, not NewFS(NewDirBackend(root)): renames stay
+		// atomic instead of copies followed by deletes, and files are written
+		// once instead of through a temp copy stored again on close
+		return fsops.OS, nil
+	case "s3":
+		b, err := NewS3Backend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewFS(b), nil
+	default:
+		return nil, errors.New("unknown storage type: " + cfg.Type)
+	}
+}
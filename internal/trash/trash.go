@@ -0,0 +1,234 @@
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gcloudsync/internal/common"
+	"gcloudsync/internal/fsops"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logtag string = "[Trash]"
+
+// trash folder structured as below
+// <root>/.gcs-trash/
+// +-- index.json     records of all trashed items
+// +-- files/<id>     trashed file or folder
+const (
+	indexFile = "index.json"
+	filesDir  = "files"
+)
+
+type Item struct {
+	ID           string
+	OriginalPath string // relative to root path
+	DeletedAt    time.Time
+	IsDir        bool
+}
+
+// guard index.json against concurrent modification
+var lock sync.Mutex
+
+func trashPath(root string) string {
+	return root + "/" + common.TrashDir
+}
+
+func itemPath(root string, id string) string {
+	return trashPath(root) + "/" + filesDir + "/" + id
+}
+
+func readIndex(fsys fsops.FS, root string) (items []Item, err error) {
+	data, err := fsops.ReadAll(fsys, trashPath(root)+"/"+indexFile)
+	if os.IsNotExist(err) {
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &items)
+	return
+}
+
+func writeIndex(fsys fsops.FS, root string, items []Item) error {
+	data, err := json.MarshalIndent(items, "", "    ")
+	if err != nil {
+		return err
+	}
+	return fsops.WriteAll(fsys, trashPath(root)+"/"+indexFile, data)
+}
+
+// move file or folder into trash instead of removing it
+// @root: root path of the sync folder
+// @absPath: path to be deleted, must lie under root
+func MoveToTrash(fsys fsops.FS, root string, absPath string) (err error) {
+	if !fsops.IsFileExist(fsys, absPath) {
+		return errors.New("file not exist")
+	}
+	isDir, _ := fsops.IsFolder(fsys, absPath)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = fsops.MakedirAll(fsys, trashPath(root)+"/"+filesDir)
+	if err != nil {
+		return err
+	}
+
+	items, err := readIndex(fsys, root)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	id := strconv.FormatInt(now.UnixNano(), 36)
+	err = fsops.Rename(fsys, absPath, itemPath(root, id))
+	if err != nil {
+		return err
+	}
+
+	items = append(items, Item{ID: id, OriginalPath: absPath[len(root):],
+		DeletedAt: now, IsDir: isDir})
+	return writeIndex(fsys, root, items)
+}
+
+// list all trashed items, most recent first
+func List(fsys fsops.FS, root string) (items []Item, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	items, err = readIndex(fsys, root)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return
+}
+
+// move trashed item back to its original path
+func Restore(fsys fsops.FS, root string, id string) (item Item, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	items, err := readIndex(fsys, root)
+	if err != nil {
+		return item, err
+	}
+
+	for i, it := range items {
+		if it.ID != id {
+			continue
+		}
+		dest := root + it.OriginalPath
+		if fsops.IsFileExist(fsys, dest) {
+			return it, errors.New("original path already exists: " + it.OriginalPath)
+		}
+		err = fsops.MakedirAll(fsys, filepath.Dir(dest))
+		if err != nil {
+			return it, err
+		}
+		err = fsops.Rename(fsys, itemPath(root, id), dest)
+		if err != nil {
+			return it, err
+		}
+		items = append(items[:i], items[i+1:]...)
+		return it, writeIndex(fsys, root, items)
+	}
+	return item, errors.New("no such item: " + id)
+}
+
+// remove items deleted earlier than retention
+// @retention: 0 or less means nothing expires, as with StartPurging
+// @return: number of items purged
+func Purge(fsys fsops.FS, root string, retention time.Duration) (n int, err error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	items, err := readIndex(fsys, root)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+
+	var remain []Item
+	deadline := time.Now().Add(-retention)
+	for _, it := range items {
+		if it.DeletedAt.After(deadline) {
+			remain = append(remain, it)
+			continue
+		}
+		err = fsops.Delete(fsys, itemPath(root, it.ID))
+		if err != nil {
+			common.ErrorHandleDebug(logtag, err)
+			remain = append(remain, it)
+			continue
+		}
+		n++
+	}
+	return n, writeIndex(fsys, root, remain)
+}
+
+// purge expired items periodically
+// @retentionDays: 0 means never purge
+func StartPurging(fsys fsops.FS, root string, retentionDays int) {
+	if retentionDays <= 0 {
+		return
+	}
+	retention := time.Duration(retentionDays) * 24 * time.Hour
+	for {
+		n, err := Purge(fsys, root, retention)
+		common.ErrorHandleDebug(logtag, err)
+		if n > 0 {
+			log.Println(logtag, "purged", n, "expired items")
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// handle trash command from command line
+// usage: trash list | trash restore <id> | trash purge
+func RunCommand(fsys fsops.FS, root string, retentionDays int, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: trash list | trash restore <id> | trash purge")
+	}
+
+	switch args[0] {
+	case "list":
+		items, err := List(fsys, root)
+		if err != nil {
+			return err
+		}
+		for _, it := range items {
+			kind := "file"
+			if it.IsDir {
+				kind = "dir"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", it.ID,
+				it.DeletedAt.Format(time.RFC3339), kind, it.OriginalPath)
+		}
+	case "restore":
+		if len(args) < 2 {
+			return errors.New("usage: trash restore <id>")
+		}
+		it, err := Restore(fsys, root, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println("restored:", it.OriginalPath)
+	case "purge":
+		n, err := Purge(fsys, root, time.Duration(retentionDays)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		fmt.Println("purged", n, "items")
+	default:
+		return errors.New("unknown trash command: " + args[0])
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package trash
+
+import (
+	"gcloudsync/internal/fsops"
+	"testing"
+	"time"
+)
+
+const root = "/sync"
+
+func newFS(t *testing.T) fsops.FS {
+	fsys := fsops.NewMemFS()
+	steps := []error{
+		fsops.MakedirAll(fsys, root+"/docs"),
+		fsops.WriteAll(fsys, root+"/docs/a.txt", []byte("a")),
+		fsops.WriteAll(fsys, root+"/b.txt", []byte("b")),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	return fsys
+}
+
+func TestMoveAndRestore(t *testing.T) {
+	fsys := newFS(t)
+	if err := MoveToTrash(fsys, root, root+"/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if fsops.IsFileExist(fsys, root+"/docs") {
+		t.Fatal("folder still there after trashing it")
+	}
+	if err := MoveToTrash(fsys, root, root+"/missing"); err == nil {
+		t.Fatal("missing file trashed")
+	}
+
+	items, err := List(fsys, root)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("items %v, %v", items, err)
+	}
+	if it := items[0]; it.OriginalPath != "/docs" || !it.IsDir {
+		t.Fatalf("item %+v", it)
+	}
+
+	it, err := Restore(fsys, root, items[0].ID)
+	if err != nil || it.OriginalPath != "/docs" {
+		t.Fatalf("restored %+v, %v", it, err)
+	}
+	data, err := fsops.ReadAll(fsys, root+"/docs/a.txt")
+	if err != nil || string(data) != "a" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if items, err := List(fsys, root); err != nil || len(items) != 0 {
+		t.Fatalf("items after restore %v, %v", items, err)
+	}
+	if _, err := Restore(fsys, root, it.ID); err == nil {
+		t.Fatal("item restored twice")
+	}
+}
+
+// a path in use again is not overwritten
+func TestRestoreOntoExisting(t *testing.T) {
+	fsys := newFS(t)
+	if err := MoveToTrash(fsys, root, root+"/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsops.WriteAll(fsys, root+"/b.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	items, err := List(fsys, root)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("items %v, %v", items, err)
+	}
+	if _, err := Restore(fsys, root, items[0].ID); err == nil {
+		t.Fatal("restored onto existing file")
+	}
+	data, err := fsops.ReadAll(fsys, root+"/b.txt")
+	if err != nil || string(data) != "new" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if items, err := List(fsys, root); err != nil || len(items) != 1 {
+		t.Fatalf("item lost after failed restore %v, %v", items, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	fsys := newFS(t)
+	for _, path := range []string{"/docs", "/b.txt"} {
+		if err := MoveToTrash(fsys, root, root+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// docs was deleted long ago
+	items, err := readIndex(fsys, root)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("items %v, %v", items, err)
+	}
+	expired := itemPath(root, items[0].ID)
+	items[0].DeletedAt = time.Now().Add(-48 * time.Hour)
+	if err := writeIndex(fsys, root, items); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing expires without retention
+	if n, err := Purge(fsys, root, 0); err != nil || n != 0 {
+		t.Fatalf("purged %d without retention, %v", n, err)
+	}
+	if err := RunCommand(fsys, root, 0, []string{"purge"}); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := List(fsys, root); err != nil || len(items) != 2 {
+		t.Fatalf("items after purge without retention %v, %v", items, err)
+	}
+
+	if n, err := Purge(fsys, root, 24*time.Hour); err != nil || n != 1 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+	items, err = List(fsys, root)
+	if err != nil || len(items) != 1 || items[0].OriginalPath != "/b.txt" {
+		t.Fatalf("items after purge %v, %v", items, err)
+	}
+	if fsops.IsFileExist(fsys, expired) || !fsops.IsFileExist(fsys, itemPath(root, items[0].ID)) {
+		t.Fatal("wrong item removed from trash")
+	}
+}
@@ -20,4 +20,15 @@ echo "build server in arm64..."
 CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -x -v -work -o  ../build/arm64/linux/gCloudSync_server ../internal/server
 CGO_ENABLED=0 GOOS=darwin GOARCH=arm64 go build -x -v -work -o ../build/arm64/darwin/gCloudSync_server ../internal/server
 
+# build amd64 command line
+echo "build gcloudsync in amd64..."
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -x -v -work -o  ../build/amd64/linux/gcloudsync ../internal/gcloudsync
+CGO_ENABLED=0 GOOS=darwin GOARCH=amd64 go build -x -v -work -o  ../build/amd64/darwin/gcloudsync ../internal/gcloudsync
+CGO_ENABLED=0 GOOS=windows GOARCH=amd64 go build -x -v -work -o  ../build/amd64/windows/gcloudsync.exe ../internal/gcloudsync
+
+# build arm64 command line
+echo "build gcloudsync in arm64..."
+CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -x -v -work -o  ../build/arm64/linux/gcloudsync ../internal/gcloudsync
+CGO_ENABLED=0 GOOS=darwin GOARCH=arm64 go build -x -v -work -o ../build/arm64/darwin/gcloudsync ../internal/gcloudsync
+
 echo "build finished."
\ No newline at end of file